@@ -0,0 +1,334 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"chainmaker.org/chainmaker/logger/v2"
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"chainmaker.org/chainmaker/protocol/v2"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+)
+
+// wasm value types of the calibration modules
+const (
+	valI32 byte = 0x7f
+	valI64 byte = 0x7e
+	valF32 byte = 0x7d
+	valF64 byte = 0x7c
+)
+
+// shapes of the calibration benchmarks
+const (
+	// T op T -> T, acc = acc op arg
+	benchBinary = iota
+	// T -> T, acc = op acc
+	benchUnary
+	// i32 address -> i32, acc = load acc, the memory is zero so the address stays 0
+	benchLoad
+	// store acc at the address arg
+	benchStore
+)
+
+// calibrationBench the micro benchmark of an opcode, the function `bench(n i32, arg T) acc` runs a loop of
+// n iterations, each one runs the opcode Unroll times. The accumulator (local 2) carries a dependency
+// from one opcode to the next, the compiler can neither hoist nor drop them.
+type calibrationBench struct {
+	op    wasmergo.Opcode
+	shape int
+	acc   byte
+	arg   byte
+	align byte
+}
+
+// calibrationBenches the opcodes a clean dependency chain can be built for, the others keep the default cost
+var calibrationBenches = func() []calibrationBench {
+	var benches []calibrationBench
+	add := func(shape int, typ byte, ops ...wasmergo.Opcode) {
+		for _, op := range ops {
+			benches = append(benches, calibrationBench{op: op, shape: shape, acc: typ, arg: typ})
+		}
+	}
+	add(benchBinary, valI32, I32Add, I32Sub, I32Mul, I32DivS, I32DivU, I32RemS, I32RemU, I32And, I32Or,
+		I32Xor, I32Shl, I32ShrS, I32ShrU, I32Rotl, I32Rotr,
+		I32Eq, I32Ne, I32LtS, I32LtU, I32GtS, I32GtU, I32LeS, I32LeU, I32GeS, I32GeU)
+	add(benchUnary, valI32, I32Eqz, I32Clz, I32Ctz, I32Popcnt, I32Extend8S, I32Extend16S)
+	add(benchBinary, valI64, I64Add, I64Sub, I64Mul, I64DivS, I64DivU, I64RemS, I64RemU, I64And, I64Or,
+		I64Xor, I64Shl, I64ShrS, I64ShrU, I64Rotl, I64Rotr)
+	add(benchUnary, valI64, I64Clz, I64Ctz, I64Popcnt, I64Extend8S, I64Extend16S, I64Extend32S)
+	add(benchBinary, valF32, F32Add, F32Sub, F32Mul, F32Div, F32Min, F32Max, F32Copysign)
+	add(benchUnary, valF32, F32Abs, F32Neg, F32Ceil, F32Floor, F32Trunc, F32Nearest, F32Sqrt)
+	add(benchBinary, valF64, F64Add, F64Sub, F64Mul, F64Div, F64Min, F64Max, F64Copysign)
+	add(benchUnary, valF64, F64Abs, F64Neg, F64Ceil, F64Floor, F64Trunc, F64Nearest, F64Sqrt)
+
+	for op, align := range map[wasmergo.Opcode]byte{
+		I32Load: 2, I32Load8S: 0, I32Load8U: 0, I32Load16S: 1, I32Load16U: 1,
+	} {
+		benches = append(benches, calibrationBench{op: op, shape: benchLoad, acc: valI32, arg: valI32, align: align})
+	}
+	for op, store := range map[wasmergo.Opcode]struct{ typ, align byte }{
+		I32Store: {valI32, 2}, I32Store8: {valI32, 0}, I32Store16: {valI32, 1},
+		I64Store: {valI64, 3}, I64Store8: {valI64, 0}, I64Store16: {valI64, 1}, I64Store32: {valI64, 2},
+		F32Store: {valF32, 2}, F64Store: {valF64, 3},
+	} {
+		benches = append(benches, calibrationBench{op: op, shape: benchStore, acc: store.typ, arg: valI32,
+			align: store.align})
+	}
+	sort.Slice(benches, func(i, j int) bool {
+		return benches[i].op < benches[j].op
+	})
+	return benches
+}()
+
+// opcodeByte the binary encoding of a numeric or memory opcode
+func opcodeByte(op wasmergo.Opcode) byte {
+	if op >= I32Load && op <= I64Store32 {
+		return 0x28 + byte(op-I32Load)
+	}
+	return 0x45 + byte(op-I32Eqz)
+}
+
+// module the byte code of the benchmark, a nil bench is the empty loop every benchmark is compared with
+func (b *calibrationBench) module(unroll int) []byte {
+	acc, arg := valI32, valI32
+	if b != nil {
+		acc, arg = b.acc, b.arg
+	}
+
+	var body []byte
+	// one local, the accumulator
+	body = append(body, 0x01, 0x01, acc)
+	if acc == arg {
+		// local.get 1, local.set 2
+		body = append(body, 0x20, 0x01, 0x21, 0x02)
+	}
+	// block, loop, br_if 1 (n == 0)
+	body = append(body, 0x02, 0x40, 0x03, 0x40, 0x20, 0x00, 0x45, 0x0d, 0x01)
+	for i := 0; b != nil && i < unroll; i++ {
+		body = b.appendUnit(body)
+	}
+	// n = n - 1, br 0, end loop, end block, return acc
+	body = append(body, 0x20, 0x00, 0x41, 0x01, 0x6b, 0x21, 0x00, 0x0c, 0x00, 0x0b, 0x0b, 0x20, 0x02, 0x0b)
+
+	out := []byte("\x00asm\x01\x00\x00\x00")
+	section := func(id byte, payload []byte) {
+		out = append(out, id)
+		out = appendU32(out, uint32(len(payload)))
+		out = append(out, payload...)
+	}
+	section(1, []byte{0x01, 0x60, 0x02, valI32, arg, 0x01, acc})
+	section(3, []byte{0x01, 0x00})
+	section(5, []byte{0x01, 0x00, 0x01})
+	section(7, []byte{0x01, 0x05, 'b', 'e', 'n', 'c', 'h', 0x00, 0x00})
+	code := appendU32([]byte{0x01}, uint32(len(body)))
+	section(10, append(code, body...))
+	return out
+}
+
+// appendUnit append the instructions running the opcode once
+func (b *calibrationBench) appendUnit(body []byte) []byte {
+	op := opcodeByte(b.op)
+	switch b.shape {
+	case benchBinary:
+		return append(body, 0x20, 0x02, 0x20, 0x01, op, 0x21, 0x02)
+	case benchUnary:
+		return append(body, 0x20, 0x02, op, 0x21, 0x02)
+	case benchLoad:
+		return append(body, 0x20, 0x02, op, b.align, 0x00, 0x21, 0x02)
+	default:
+		return append(body, 0x20, 0x01, 0x20, 0x02, op, b.align, 0x00)
+	}
+}
+
+// argument the operand passed to bench, the values keep the accumulator a normal number,
+// subnormal floats are much slower than the others
+func (b *calibrationBench) argument() interface{} {
+	if b == nil || b.shape == benchLoad || b.shape == benchStore {
+		return int32(0)
+	}
+	switch b.arg {
+	case valI64:
+		return int64(3)
+	case valF32:
+		return float32(1)
+	case valF64:
+		return float64(1)
+	default:
+		return int32(3)
+	}
+}
+
+// GasCalibrationConfig how CalibrateGasSchedule measures the opcodes
+type GasCalibrationConfig struct {
+	// every cost is relative to the reference opcode, which costs ReferenceCost
+	Reference     wasmergo.Opcode
+	ReferenceCost uint32
+	// loop iterations of a run, and opcodes run by every iteration
+	Iterations int32
+	Unroll     int
+	// runs of every benchmark, the fastest one is kept
+	Repeats int
+	// the benchmarks are compiled with the metering middleware of the schedule, it is part of the measured time
+	Schedule *GasSchedule
+}
+
+// DefaultGasCalibrationConfig costs relative to I32Add = 1, measured with the metering of default cost 1
+func DefaultGasCalibrationConfig() *GasCalibrationConfig {
+	return &GasCalibrationConfig{
+		Reference:     I32Add,
+		ReferenceCost: 1,
+		Iterations:    100000,
+		Unroll:        64,
+		Repeats:       5,
+		Schedule:      newGasSchedule(0, 1, map[wasmergo.Opcode]uint32{}),
+	}
+}
+
+// GasCalibration the costs proposed by CalibrateGasSchedule
+type GasCalibration struct {
+	Reference     wasmergo.Opcode
+	ReferenceCost uint32
+	// host wall time of one opcode in nanoseconds, the loop is not included
+	Nanos map[wasmergo.Opcode]float64
+	// proposed cost of every measured opcode
+	Costs map[wasmergo.Opcode]uint32
+}
+
+// CalibrateGasSchedule run a micro benchmark of every opcode calibrationBenches knows through the metering
+// middleware, and propose costs proportional to the host wall time. The costs depend on the host,
+// calibrate on the hardware the nodes run on, and review them before they go into a schedule.
+func CalibrateGasSchedule(config *GasCalibrationConfig, log *logger.CMLogger) (*GasCalibration, error) {
+	if config.Iterations <= 0 || config.Unroll <= 0 || config.Repeats <= 0 || config.ReferenceCost == 0 {
+		return nil, errors.New("iterations, unroll, repeats and reference cost must be positive")
+	}
+	engine := newSharedEngine(config.Schedule.settings)
+	store := engine.newStore()
+	defer store.Close()
+
+	run := func(b *calibrationBench) (time.Duration, error) {
+		contract := &commonPb.Contract{Name: "gas_calibration"}
+		if b != nil {
+			contract.Version = opcodeNameOf(b.op)
+		}
+		module, _, err := engine.compile(store, contract, b.module(config.Unroll), log)
+		if err != nil {
+			return 0, err
+		}
+		defer module.Close()
+		instance, err := wasmergo.NewInstance(module, wasmergo.NewImportObject())
+		if err != nil {
+			return 0, fmt.Errorf("[%s] instantiate failed, %v", contract.Version, err)
+		}
+		defer instance.Close()
+		fn, err := instance.Exports.GetRawFunction("bench")
+		if err != nil {
+			return 0, err
+		}
+		defer fn.Close()
+
+		best := time.Duration(math.MaxInt64)
+		for i := 0; i < config.Repeats; i++ {
+			instance.SetGasLimit(protocol.GasLimit)
+			start := time.Now()
+			if _, err = fn.Call(config.Iterations, b.argument()); err != nil {
+				return 0, fmt.Errorf("[%s] bench failed, %v", contract.Version, err)
+			}
+			if elapsed := time.Since(start); elapsed < best {
+				best = elapsed
+			}
+		}
+		return best, nil
+	}
+
+	loop, err := run(nil)
+	if err != nil {
+		return nil, err
+	}
+	units := float64(config.Iterations) * float64(config.Unroll)
+	nanos := make(map[wasmergo.Opcode]float64, len(calibrationBenches))
+	for i := range calibrationBenches {
+		b := &calibrationBenches[i]
+		elapsed, err := run(b)
+		if err != nil {
+			return nil, err
+		}
+		nanos[b.op] = math.Max(0, float64(elapsed-loop)) / units
+		log.Debugf("gas calibration %s %.3f ns", opcodeNameOf(b.op), nanos[b.op])
+	}
+
+	costs, err := proposeCosts(nanos, config.Reference, config.ReferenceCost)
+	if err != nil {
+		return nil, err
+	}
+	return &GasCalibration{
+		Reference:     config.Reference,
+		ReferenceCost: config.ReferenceCost,
+		Nanos:         nanos,
+		Costs:         costs,
+	}, nil
+}
+
+// proposeCosts scale the wall time of every opcode to the reference, no measured opcode is free
+func proposeCosts(nanos map[wasmergo.Opcode]float64, reference wasmergo.Opcode,
+	referenceCost uint32) (map[wasmergo.Opcode]uint32, error) {
+	unit, ok := nanos[reference]
+	if !ok || unit <= 0 {
+		return nil, fmt.Errorf("reference %s is not measured", opcodeNameOf(reference))
+	}
+	costs := make(map[wasmergo.Opcode]uint32, len(nanos))
+	for op, ns := range nanos {
+		cost := math.Round(ns / unit * float64(referenceCost))
+		costs[op] = uint32(math.Min(math.Max(cost, 1), math.MaxUint32))
+	}
+	costs[reference] = referenceCost
+	return costs, nil
+}
+
+// ScheduleConfig the proposed schedule as an item of the wasmer_gas_schedules chain config, see parseGasSchedules,
+// the opcodes not measured cost as much as the reference
+func (c *GasCalibration) ScheduleConfig(blockVersion uint32) map[string]interface{} {
+	costs := make(map[string]interface{}, len(c.Costs))
+	for op, cost := range c.Costs {
+		costs[opcodeNameOf(op)] = cost
+	}
+	return map[string]interface{}{
+		configKeyBlockVersion: blockVersion,
+		configKeyDefaultCost:  c.ReferenceCost,
+		configKeyCosts:        costs,
+	}
+}
+
+// JSON the proposed schedule as an item of the value of wasmer_gas_schedules in the chain config
+func (c *GasCalibration) JSON(blockVersion uint32) string {
+	// a map of strings and numbers is always marshaled
+	out, _ := json.MarshalIndent(c.ScheduleConfig(blockVersion), "", "  ")
+	return string(out)
+}
+
+// opcodeNamesByCode opcode -> name of opcodeNames
+var opcodeNamesByCode = func() map[wasmergo.Opcode]string {
+	m := make(map[wasmergo.Opcode]string, len(opcodeNames))
+	for name, op := range opcodeNames {
+		m[op] = name
+	}
+	return m
+}()
+
+// opcodeNameOf the name of the opcode in the gas schedule config
+func opcodeNameOf(op wasmergo.Opcode) string {
+	if name, ok := opcodeNamesByCode[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("Opcode(%d)", op)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+
+	logger2 "chainmaker.org/chainmaker/logger/v2"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -run TestCalibrateGasSchedule -gas-calibration 在本机测量并输出建议的 wasmer_gas_schedules 链配置
+var gasCalibration = flag.Bool("gas-calibration", false, "measure the opcodes and print a proposed gas schedule")
+
+func TestCalibrationModules(t *testing.T) {
+	store := defaultEngine().newStore()
+	defer store.Close()
+
+	var loop *calibrationBench
+	assert.Nil(t, wasmergo.ValidateModule(store, loop.module(4)))
+	for i := range calibrationBenches {
+		b := &calibrationBenches[i]
+		assert.Nil(t, wasmergo.ValidateModule(store, b.module(4)), opcodeNameOf(b.op))
+	}
+	assert.Equal(t, byte(0x6a), opcodeByte(I32Add))
+	assert.Equal(t, byte(0x36), opcodeByte(I32Store))
+	assert.Equal(t, byte(0xc4), opcodeByte(I64Extend32S))
+}
+
+func TestProposeCosts(t *testing.T) {
+	nanos := map[wasmergo.Opcode]float64{I32Add: 0.3, I32DivS: 6.1, I32Eqz: 0.01}
+	costs, err := proposeCosts(nanos, I32Add, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(10), costs[I32Add])
+	assert.Equal(t, uint32(203), costs[I32DivS])
+	// a measured opcode is never free
+	assert.Equal(t, uint32(1), costs[I32Eqz])
+
+	_, err = proposeCosts(nanos, I64Add, 1)
+	assert.NotNil(t, err)
+
+	// the proposed schedule is accepted by the chain config as it is
+	calibration := &GasCalibration{Reference: I32Add, ReferenceCost: 10, Nanos: nanos, Costs: costs}
+	schedules, err := parseChainGasSchedules("[" + calibration.JSON(2040000) + "]")
+	assert.Nil(t, err)
+	schedule := schedules.selectFor(2040000)
+	assert.Equal(t, uint32(2040000), schedule.BlockVersion)
+	assert.Equal(t, uint32(10), schedule.Cost(I64Add))
+	assert.Equal(t, uint32(203), schedule.Cost(I32DivS))
+	assert.Contains(t, calibration.JSON(2040000), `"I32DivS": 203`)
+}
+
+func TestCalibrateGasSchedule(t *testing.T) {
+	config := DefaultGasCalibrationConfig()
+	if !*gasCalibration {
+		// a quick run checks the harness, its costs mean nothing
+		config.Iterations, config.Repeats = 1000, 3
+	}
+	calibration, err := CalibrateGasSchedule(config, logger2.GetLogger("unit_test"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, len(calibrationBenches), len(calibration.Costs))
+	assert.Equal(t, config.ReferenceCost, calibration.Costs[config.Reference])
+	if *gasCalibration {
+		fmt.Println(calibration.JSON(0))
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"sync/atomic"
+	"testing"
+
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"chainmaker.org/chainmaker/protocol/v2"
+	"chainmaker.org/chainmaker/vm/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeInstance_EstimateGas(t *testing.T) {
+	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+	parameters := map[string][]byte{"key": []byte("test_key")}
+	fillingBaseParams(parameters)
+
+	manager, err := NewInstancesManager(ChainId, nil)
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+
+	txSimContext := prepareTxSimContext(ChainId, BlockVersion, contractId.Name, "increase", parameters,
+		SnapshotMock{chainConfig: gasSchedulesChainConfig(unitGasSchedules)})
+	runtimeInst, err := manager.NewRuntimeInstance(txSimContext, "", "", "", &contractId, wasmBytes, logger)
+	assert.Nil(t, err)
+	runtime, _ := runtimeInst.(*RuntimeInstance)
+	pool := runtime.Pool()
+	size, useCount := atomic.LoadInt32(&pool.currentSize), atomic.LoadInt32(&pool.useCount)
+
+	// the length of ctx_ptr changes the gas of the parameters
+	pinCtxIndex()
+	estimate, err := runtime.EstimateGas(&contractId, "increase", wasmBytes, parameters, txSimContext)
+	assert.Nil(t, err)
+	assert.Equal(t, commonPb.TxStatusCode_SUCCESS, estimate.Code, estimate.Result.Message)
+	assert.True(t, estimate.GasUsed > 0)
+	assert.Equal(t, 1, estimate.WriteSetSize)
+	assert.True(t, estimate.RWSetBytes > 0)
+
+	// the dry run leaves the tx sim context and the pool alone
+	assert.Equal(t, 0, len(txSimContext.GetTxRWSet(true).TxWrites))
+	assert.Equal(t, size, atomic.LoadInt32(&pool.currentSize))
+	assert.Equal(t, useCount, atomic.LoadInt32(&pool.useCount))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&pool.ephemeralLive))
+
+	// the real invoke uses the estimated gas
+	pinCtxIndex()
+	result, _ := runtimeInst.Invoke(&contractId, "increase", wasmBytes, parameters, txSimContext, 0)
+	assert.Equal(t, uint32(0), result.Code, result.Message)
+	assert.Equal(t, estimate.GasUsed, result.GasUsed)
+
+	// a failed dry run reports the status code of the runtime
+	estimate, err = runtime.EstimateGas(&contractId, "not_exist", wasmBytes, parameters, txSimContext)
+	assert.Nil(t, err)
+	assert.Equal(t, commonPb.TxStatusCode_CONTRACT_FAIL, estimate.Code)
+	assert.Equal(t, 0, estimate.WriteSetSize)
+
+	_, err = runtime.EstimateGas(&contractId, "increase", wasmBytes, parameters, nil)
+	assert.NotNil(t, err)
+	assert.False(t, vm.IsGasEstimate(txSimContext))
+}
+
+func TestRuntimeInstance_InvokeTime(t *testing.T) {
+	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+	parameters := map[string][]byte{"key": []byte("test_key")}
+	fillingBaseParams(parameters)
+
+	manager, err := NewInstancesManager(ChainId, nil)
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+
+	newTxSimContext := func() protocol.TxSimContext {
+		return prepareTxSimContext(ChainId, BlockVersion, contractId.Name, "increase", parameters,
+			SnapshotMock{chainConfig: gasSchedulesChainConfig(unitGasSchedules)})
+	}
+	txSimContext := newTxSimContext()
+	runtimeInst, err := manager.NewRuntimeInstance(txSimContext, "", "", "", &contractId, wasmBytes, logger)
+	assert.Nil(t, err)
+	runtime, _ := runtimeInst.(*RuntimeInstance)
+
+	pinCtxIndex()
+	expected, _ := runtime.Invoke(&contractId, "increase", wasmBytes, parameters, txSimContext, 0)
+	assert.Equal(t, uint32(0), expected.Code, expected.Message)
+
+	// the timed invoke runs the same invocation, the state is written and the gas is charged alike
+	txSimContext = newTxSimContext()
+	pinCtxIndex()
+	result, _, startTime, endTime, _ := runtime.InvokeTime(&contractId, "increase", wasmBytes, parameters,
+		txSimContext, 0)
+	assert.Equal(t, uint32(0), result.Code, result.Message)
+	assert.Equal(t, expected.GasUsed, result.GasUsed)
+	assert.Equal(t, 1, len(txSimContext.GetTxRWSet(true).TxWrites))
+	assert.True(t, endTime >= startTime)
+
+	// the status code of a failed invoke is not carried over to the next one
+	runtime.statusCode = commonPb.TxStatusCode_TIMEOUT
+	result, _, _, _, _ = runtime.InvokeTime(&contractId, "not_exist", wasmBytes, parameters, txSimContext, 0)
+	assert.Equal(t, uint32(1), result.Code)
+	assert.Equal(t, commonPb.TxStatusCode_CONTRACT_FAIL, runtime.TxStatusCode())
+}
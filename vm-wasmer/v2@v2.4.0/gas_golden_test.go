@@ -0,0 +1,322 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"chainmaker.org/chainmaker/protocol/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -run TestGasGolden -update-gas-golden 重新生成 testdata/gas_golden
+var updateGasGolden = flag.Bool("update-gas-golden", false, "rewrite the golden gas files in testdata/gas_golden")
+
+const (
+	gasGoldenDir = "./testdata/gas_golden"
+	// runs of each case on pooled instances, on fresh instances and concurrently
+	gasGoldenRuns = 4
+	// ctx_ptr is serialized into the parameters, its length changes the gas,
+	// every invoke of the suite gets a ctx_ptr of 4 digits
+	gasGoldenCtxIndex = int32(1000)
+)
+
+// gasGoldenCase a method of a testdata contract with fixed parameters
+type gasGoldenCase struct {
+	file       string
+	method     string
+	parameters map[string]string
+	// the module has no contract sdk, the export is called directly with arg
+	raw bool
+	arg int32
+}
+
+// gasGolden the checked in gas of a case
+type gasGolden struct {
+	GasUsed uint64 `json:"gas_used"`
+	Code    uint32 `json:"code"`
+}
+
+// gasGoldenCases the cases of every contract in testdata, the methods only use the syscalls SnapshotMock serves.
+// Not covered:
+//   - rust-sql-2.0.0.wasm, every method runs sql, which needs the sql store of the blockchain store
+//   - instrumented_module.wasm and serialized_module.wasm, they are serialized wasmer modules of the module cache
+//     tests, not wasm
+var gasGoldenCases = []gasGoldenCase{
+	// rust
+	{file: "rust-counter-1.2.0.wasm", method: "increase", parameters: map[string]string{"key": "test_key"}},
+	{file: "rust-counter-1.2.0.wasm", method: "query", parameters: map[string]string{"key": "test_key"}},
+	{file: "rust-counter-2.0.0.wasm", method: "increase", parameters: map[string]string{"key": "test_key"}},
+	{file: "rust-counter-2.0.0.wasm", method: "query", parameters: map[string]string{"key": "test_key"}},
+	{file: "rust-fact-2.0.0.wasm", method: "increase", parameters: map[string]string{"key": "test_key"}},
+	{file: "rust-fact-2.0.0.wasm", method: "save", parameters: map[string]string{
+		"file_hash": "005521f27d745a04999c6d09f559764f9c44376a",
+		"file_name": "aoteman.jpg",
+		"time":      "16456254",
+	}},
+	{file: "rust-func-verify-2.0.0.wasm", method: "increase", parameters: map[string]string{"key": "test_key"}},
+	{file: "rust-func-verify-2.0.0.wasm", method: "find_by_file_hash", parameters: map[string]string{
+		"file_hash": "005521f27d745a04999c6d09f559764f9c44376a",
+	}},
+	{file: "rust-func-verify-2.1.0.wasm", method: "increase", parameters: map[string]string{"key": "test_key"}},
+	{file: "rust-func-verify-2.1.0.wasm", method: "sum", parameters: map[string]string{"arg1": "1", "arg2": "2"}},
+	{file: "rust-asset-2.0.0.wasm", method: "init_contract", parameters: map[string]string{"issue_limit": "1000"}},
+	{file: "rust-asset-2.0.0.wasm", method: "name"},
+	{file: "rust-asset-2.0.0.wasm", method: "total_supply"},
+	{file: "rust-crypto-2.0.0.wasm", method: "save_encrypt_data", parameters: map[string]string{
+		"key": "test_key", "encrypt_data": "data",
+	}},
+	{file: "rust-crypto-2.0.0.wasm", method: "query_encrypt_data", parameters: map[string]string{"key": "test_key"}},
+	{file: "compute-rust.wasm", method: "normalCal"},
+	{file: "compute-rust.wasm", method: "hashCal"},
+	{file: "compute-rust.wasm", method: "bigNumCal"},
+	{file: "testgas-rust.wasm", method: "normalCal"},
+	{file: "testgas-rust.wasm", method: "hashCal"},
+	{file: "testgas-rust.wasm", method: "bigNumCal"},
+
+	// go
+	{file: "compute-modify-go.wasm", method: "normalCal"},
+	{file: "compute-modify-go.wasm", method: "hashCal"},
+	{file: "compute-modify-go.wasm", method: "bigNumCal"},
+	{file: "compute-modify2-go.wasm", method: "normalCal"},
+	{file: "compute-modify2-go.wasm", method: "hashCal"},
+	{file: "testcompute-go.wasm", method: "normalCal"},
+	{file: "testcompute-go.wasm", method: "hashCal"},
+	{file: "testgas-go.wasm", method: "hashCal"},
+	{file: "testgas-go.wasm", method: "bigNumCal"},
+	{file: "testmemory-go.wasm", method: "init_contract"},
+	{file: "testmemory-go.wasm", method: "testmemory"},
+	{file: "fact-go.wasm", method: "saveAndFindByFileHash", parameters: map[string]string{
+		"file_hash": "005521f27d745a04999c6d09f559764f9c44376a",
+		"file_name": "aoteman.jpg",
+		"time":      "16456254",
+	}},
+	{file: "enc_data_modify-go.wasm", method: "init_contract"},
+	{file: "enc_data_modify-go.wasm", method: "get_enc_data", parameters: map[string]string{"data_key": "dataKey"}},
+	{file: "erc721-go.wasm", method: "init_contract"},
+	{file: "erc721-go.wasm", method: "name"},
+	{file: "erc721-go.wasm", method: "balanceOf", parameters: map[string]string{
+		"account": "c0d8e4ce07a48081eff14a3016699b1c839c4375",
+	}},
+	{file: "erc721-go.wasm", method: "ownerOf", parameters: map[string]string{"tokenId": "111111111111111111111112"}},
+	{file: "erc1155-go.wasm", method: "init_contract"},
+	{file: "erc1155-go.wasm", method: "Uri"},
+	{file: "exchange-go.wasm", method: "init_contract"},
+	{file: "raffle-go.wasm", method: "init_contract"},
+	{file: "raffle-go.wasm", method: "registRaffle", parameters: map[string]string{
+		"peoples":   `{"peoples":[{"num":1,"name":"Chris"},{"num":2,"name":"Linus"}]}`,
+		"timestamp": "13235432",
+		"level":     "1",
+	}},
+	{file: "raffle-go.wasm", method: "query"},
+	{file: "vote-go.wasm", method: "init_contract"},
+	{file: "vote-go.wasm", method: "queryProjectVoters", parameters: map[string]string{"projectId": "project1"}},
+	{file: "trace-go.wasm", method: "init_contract"},
+	{file: "trace-go.wasm", method: "goodsStatus", parameters: map[string]string{"goodsId": "goods1"}},
+	{file: "itinerary-go.wasm", method: "init_contract"},
+	{file: "standard-evidence-go.wasm", method: "Standards"},
+	{file: "standard-evidence-go.wasm", method: "ExistsOfHash", parameters: map[string]string{"hash": "hash1"}},
+	{file: "standard_dfa-go.wasm", method: "Standards"},
+	{file: "standard_dfa-go.wasm", method: "Name"},
+	{file: "standard_dfa-go.wasm", method: "TotalSupply"},
+	{file: "standard_identity-go.wasm", method: "Standards"},
+	{file: "standard_identity-go.wasm", method: "SupportStandard", parameters: map[string]string{
+		"standardName": "CMID",
+	}},
+	{file: "standard_nfa-go.wasm", method: "Standards"},
+	{file: "standard_nfa-go.wasm", method: "TotalSupply"},
+	{file: "reactor-go.wasm", method: "increase"},
+
+	// tinygo and c
+	{file: "compute-tinygo.wasm", method: "normalCal"},
+	{file: "compute-tinygo.wasm", method: "hashCal"},
+
+	// modules without the contract sdk
+	{file: "fib-c.wasm", method: "fib", raw: true, arg: 20},
+	{file: "fib-c.wasm", method: "fib_iter", raw: true, arg: 20},
+	{file: "fib-go.wasm", method: "fib", raw: true, arg: 20},
+	{file: "fib-tinygo.wasm", method: "fib", raw: true, arg: 20},
+	{file: "snapshot-go.wasm", method: "grow", raw: true, arg: 1},
+}
+
+// TestGasGolden every case uses exactly the checked in gas, on pooled and fresh instances, run after run
+// and concurrently
+func TestGasGolden(t *testing.T) {
+	manager, err := NewInstancesManager(ChainId, nil)
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+
+	var files []string
+	casesOfFile := make(map[string][]gasGoldenCase)
+	for _, c := range gasGoldenCases {
+		if _, ok := casesOfFile[c.file]; !ok {
+			files = append(files, c.file)
+		}
+		casesOfFile[c.file] = append(casesOfFile[c.file], c)
+	}
+
+	for _, file := range files {
+		file := file
+		t.Run(file, func(t *testing.T) {
+			wasmBytes, contractId, logger := prepareContract("./testdata/"+file, t)
+			contractId.Name = strings.TrimSuffix(file, ".wasm")
+			// the pool is compiled by the schedule the cases are measured with
+			deployContext := prepareTxSimContext(ChainId, BlockVersion, contractId.Name, "", nil,
+				SnapshotMock{chainConfig: gasSchedulesChainConfig(unitGasSchedules)})
+			runtimeInst, err := manager.NewRuntimeInstance(deployContext, "", "", "", &contractId, wasmBytes, logger)
+			if !assert.Nil(t, err) {
+				return
+			}
+			runtime, _ := runtimeInst.(*RuntimeInstance)
+
+			goldenFile := filepath.Join(gasGoldenDir, contractId.Name+".json")
+			golden, checkedIn := readGasGolden(t, goldenFile)
+			if !checkedIn && !*updateGasGolden {
+				t.Fatalf("%s not checked in, run go test -run TestGasGolden -update-gas-golden", goldenFile)
+			}
+			for _, c := range casesOfFile[file] {
+				got := measureGasGolden(t, runtime, c)
+				if *updateGasGolden {
+					golden[c.method] = got
+				} else if want, ok := golden[c.method]; ok {
+					assert.Equal(t, want, got, "%s %s", file, c.method)
+				} else {
+					t.Errorf("no golden gas of %s %s in %s", file, c.method, goldenFile)
+				}
+			}
+			if *updateGasGolden {
+				writeGasGolden(t, goldenFile, golden)
+			}
+		})
+	}
+}
+
+// measureGasGolden run the case on pooled instances, on fresh instances and concurrently,
+// every run must use the same gas
+func measureGasGolden(t *testing.T, runtime *RuntimeInstance, c gasGoldenCase) gasGolden {
+	runs := make([]gasGolden, 0, 3*gasGoldenRuns)
+	for _, fresh := range []bool{false, true} {
+		for i := 0; i < gasGoldenRuns; i++ {
+			pinCtxIndex()
+			runs = append(runs, runGasGoldenCase(t, runtime, c, fresh))
+		}
+	}
+
+	concurrent := make([]gasGolden, gasGoldenRuns)
+	var wg sync.WaitGroup
+	pinCtxIndex()
+	for i := range concurrent {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			concurrent[i] = runGasGoldenCase(t, runtime, c, i%2 == 1)
+		}(i)
+	}
+	wg.Wait()
+	runs = append(runs, concurrent...)
+
+	for i := range runs {
+		assert.Equal(t, runs[0], runs[i], "%s %s run %d", c.file, c.method, i)
+	}
+	return runs[0]
+}
+
+// runGasGoldenCase run the case once, fresh runs on an instance never pooled nor restored
+func runGasGoldenCase(t *testing.T, runtime *RuntimeInstance, c gasGoldenCase, fresh bool) gasGolden {
+	if c.raw {
+		return callGasGoldenExport(t, runtime, c, fresh)
+	}
+	// Invoke writes into the parameters, every run has its own
+	parameters := make(map[string][]byte, len(c.parameters))
+	for k, v := range c.parameters {
+		parameters[k] = []byte(v)
+	}
+	fillingBaseParams(parameters)
+	pool := runtime.Pool()
+	contract := pool.contractId
+	txSimContext := prepareTxSimContext(ChainId, BlockVersion, contract.Name, c.method, parameters,
+		SnapshotMock{chainConfig: gasSchedulesChainConfig(unitGasSchedules)})
+
+	if fresh {
+		// a dry run runs on an ephemeral instance
+		estimate, err := runtime.EstimateGas(contract, c.method, pool.byteCode, parameters, txSimContext)
+		assert.Nil(t, err)
+		return gasGolden{GasUsed: estimate.GasUsed, Code: estimate.Result.Code}
+	}
+	result, _ := runtime.Invoke(contract, c.method, pool.byteCode, parameters, txSimContext, 0)
+	return gasGolden{GasUsed: result.GasUsed, Code: result.Code}
+}
+
+// callGasGoldenExport call the export of a module without the contract sdk, the gas is read from the instance
+func callGasGoldenExport(t *testing.T, runtime *RuntimeInstance, c gasGoldenCase, fresh bool) gasGolden {
+	pool := runtime.Pool()
+	var instanceInfo *wrappedInstance
+	var err error
+	if fresh {
+		instanceInfo, err = pool.GetEstimateInstance()
+	} else {
+		instanceInfo, err = runtime.getInstance(pool)
+	}
+	if !assert.Nil(t, err) {
+		return gasGolden{}
+	}
+	if fresh {
+		defer pool.closeEphemeral(instanceInfo)
+	} else {
+		defer pool.RevertInstance(instanceInfo)
+		assert.Nil(t, instanceInfo.restore())
+	}
+
+	instance := instanceInfo.wasmInstance
+	instance.SetGasLimit(protocol.GasLimit)
+	fn, err := instance.Exports.GetRawFunction(c.method)
+	if !assert.Nil(t, err) {
+		return gasGolden{}
+	}
+	defer fn.Close()
+	golden := gasGolden{}
+	if _, err = fn.Call(c.arg); err != nil {
+		golden.Code = 1
+	}
+	golden.GasUsed = protocol.GasLimit - instance.GetGasRemaining()
+	return golden
+}
+
+// pinCtxIndex the next ctx_ptr is gasGoldenCtxIndex + 1
+func pinCtxIndex() {
+	lock.Lock()
+	ctxIndex = gasGoldenCtxIndex
+	lock.Unlock()
+}
+
+// readGasGolden read the golden gas of the methods of a contract, false if the file is not checked in
+func readGasGolden(t *testing.T, file string) (map[string]gasGolden, bool) {
+	golden := make(map[string]gasGolden)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return golden, false
+	}
+	if assert.Nil(t, err) {
+		assert.Nil(t, json.Unmarshal(data, &golden))
+	}
+	return golden, true
+}
+
+func writeGasGolden(t *testing.T, file string, golden map[string]gasGolden) {
+	data, err := json.MarshalIndent(golden, "", "  ")
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(gasGoldenDir, 0755))
+	assert.Nil(t, ioutil.WriteFile(file, append(data, '\n'), 0644))
+}
@@ -0,0 +1,250 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"chainmaker.org/chainmaker/protocol/v2"
+	"chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+	"chainmaker.org/chainmaker/vm/v2"
+)
+
+// TxStatusCodeOutOfGas the tx status code of an invoke running out of the gas limit of the tx
+const TxStatusCodeOutOfGas = vm.TxStatusCodeGasLimitExceeded
+
+// gasMeter the gas of a contract call frame, one per Invoke.
+//
+// If the tx is charged (see txCharged), its gas is kept by the TxSimContext: the meter is seeded from
+// TxSimContext.GetGasRemaining, the wasm gas is settled into the tx before every syscall, and what the
+// syscall charged the tx, nested calls included, is taken from the instance after it. A nested call
+// starts with exactly what its caller has left, and the gas it does not use is left to the caller.
+//
+// Otherwise the frame is given protocol.GasLimit minus the gas used by its callers, only wasm gas is counted,
+// and the caller deducts the gas used by a nested call when it returns.
+//
+// The growth of the linear memory and the bytes copied into it by the host are charged by the costs of the
+// gas schedule. Memory is charged when it is checked, before every syscall and when the frame finishes,
+// an instance always starts a tx with the memory of its snapshot, so the growth is the same on every node.
+type gasMeter struct {
+	txSimContext protocol.TxSimContext
+	instance     *wasmer.Instance
+	charged      bool
+	// gas available when the frame started
+	start uint64
+	// instance gas remaining after the last settlement
+	synced    uint64
+	exhausted bool
+
+	pageCost uint64
+	byteCost uint64
+	// memory pages charged so far
+	pages uint32
+
+	// state pricing, see chargeState
+	stateCost   uint64
+	rewriteCost uint64
+	refundCost  uint64
+	refundCap   uint32
+
+	// cost of the Sha256 syscall, see GasSchedule.Sha256BaseCost
+	sha256BaseCost uint64
+	sha256WordCost uint64
+}
+
+// txCharged whether the gas of the tx is charged to its TxSimContext,
+// txs carrying no gas limit are only charged for wasm code, up to protocol.GasLimit
+func txCharged(txSimContext protocol.TxSimContext) bool {
+	return txSimContext.GetBlockVersion() >= blockVersionSyscallGas &&
+		txSimContext.GetTx().Payload.Limit != nil
+}
+
+// newGasMeter seed the gas meter of the frame and set the gas limit of the instance,
+// gasUsed is the gas used by the callers, it is only used by the txs not charged
+func newGasMeter(txSimContext protocol.TxSimContext, instance *wasmer.Instance, gasUsed uint64,
+	schedule *GasSchedule) *gasMeter {
+	m := &gasMeter{
+		txSimContext: txSimContext,
+		instance:     instance,
+		charged:      txCharged(txSimContext),
+		pageCost:     uint64(schedule.MemoryPageCost),
+		byteCost:     uint64(schedule.CopyByteCost),
+		stateCost:    uint64(schedule.StateByteCost),
+		rewriteCost:  uint64(schedule.StateRewriteByteCost),
+		refundCost:   uint64(schedule.StateRefundByteCost),
+		refundCap:    schedule.StateRefundCapPercent,
+
+		sha256BaseCost: uint64(schedule.Sha256BaseCost),
+		sha256WordCost: uint64(schedule.Sha256WordCost),
+	}
+	if m.pageCost > 0 {
+		m.pages = m.memoryPages()
+	}
+	if m.charged {
+		m.start = txSimContext.GetGasRemaining()
+		if int64(m.start) < 0 {
+			m.start = 0
+		}
+	} else if gasUsed < protocol.GasLimit {
+		m.start = protocol.GasLimit - gasUsed
+	}
+	m.synced = m.start
+	instance.SetGasLimit(m.start)
+	return m
+}
+
+// limit the gas available to the frame
+func (m *gasMeter) limit() uint64 {
+	return m.start
+}
+
+// used return the gas used by the tx so far, passed to nested calls
+func (m *gasMeter) used() uint64 {
+	if m.charged {
+		m.settle()
+		txLimit := m.txSimContext.GetTx().Payload.Limit.GasLimit
+		if m.synced > txLimit {
+			return 0
+		}
+		return txLimit - m.synced
+	}
+	return protocol.GasLimit - m.instance.GetGasRemaining()
+}
+
+// remaining the gas left to the frame, as the tx sees it if it is charged
+func (m *gasMeter) remaining() uint64 {
+	if m.charged {
+		return m.synced
+	}
+	return m.instance.GetGasRemaining()
+}
+
+// settle charge the tx the wasm gas used since the last settlement, and resync the instance with the tx
+func (m *gasMeter) settle() {
+	if !m.charged {
+		return
+	}
+	remaining := m.instance.GetGasRemaining()
+	if remaining < m.synced {
+		if err := m.txSimContext.SubtractGas(m.synced - remaining); err != nil {
+			m.exhausted = true
+		}
+	}
+	m.resync()
+}
+
+// resync take the gas charged to the tx by syscalls from the instance,
+// the instance traps at its next instruction if the tx ran out of gas
+func (m *gasMeter) resync() {
+	remaining := m.txSimContext.GetGasRemaining()
+	// TxSimContext.SubtractGas wraps around when the gas is not enough
+	if remaining > m.synced || int64(remaining) < 0 {
+		m.exhausted = true
+	}
+	if m.exhausted {
+		remaining = 0
+	}
+	m.synced = remaining
+	m.instance.SetGasLimit(remaining)
+}
+
+// beforeSyscall the syscall sees the gas remaining of the tx
+func (m *gasMeter) beforeSyscall() {
+	m.chargeMemory()
+	m.settle()
+}
+
+// charge take the gas from the frame, return false if it ran out of gas
+func (m *gasMeter) charge(gas uint64) bool {
+	if gas == 0 || m.exhausted {
+		return !m.exhausted
+	}
+	if m.charged {
+		m.settle()
+		if err := m.txSimContext.SubtractGas(gas); err != nil {
+			m.exhausted = true
+		}
+		m.resync()
+		return !m.exhausted
+	}
+	remaining := m.instance.GetGasRemaining()
+	if remaining < gas {
+		m.exhausted = true
+		m.instance.SetGasLimit(0)
+		return false
+	}
+	m.instance.SetGasLimit(remaining - gas)
+	return true
+}
+
+// chargeCopy charge the bytes the host copies into the linear memory
+func (m *gasMeter) chargeCopy(n int) bool {
+	return m.charge(uint64(n) * m.byteCost)
+}
+
+// chargeMemory charge the pages the linear memory grew by since the last check
+func (m *gasMeter) chargeMemory() bool {
+	if m.pageCost == 0 {
+		return !m.exhausted
+	}
+	pages := m.memoryPages()
+	if pages <= m.pages {
+		return !m.exhausted
+	}
+	grown := pages - m.pages
+	m.pages = pages
+	return m.charge(uint64(grown) * m.pageCost)
+}
+
+// memoryPages the size of the exported linear memory, 0 if there is none
+func (m *gasMeter) memoryPages() uint32 {
+	memory, err := m.instance.Exports.GetMemory("memory")
+	if err != nil {
+		return 0
+	}
+	pages := memory.Size()
+	return pages.ToUint32()
+}
+
+// afterSyscall the instance continues with the gas left by the syscall
+func (m *gasMeter) afterSyscall() {
+	if m.charged {
+		m.resync()
+	}
+}
+
+// afterCall deduct the gas of a nested call returned by Wacsi.CallContract,
+// gasUsed is the gas used by the tx including the nested call, it is only used by the txs not charged
+func (m *gasMeter) afterCall(gasUsed uint64) {
+	if m.charged {
+		return
+	}
+	if gasUsed >= protocol.GasLimit {
+		m.exhausted = true
+		m.instance.SetGasLimit(0)
+		return
+	}
+	m.instance.SetGasLimit(protocol.GasLimit - gasUsed)
+}
+
+// finish settle the frame, return the gas used by the frame, nested calls included,
+// and whether it ran out of gas. A frame using up exactly its gas did not run out of it,
+// only a failed charge or a trap of the metering does.
+func (m *gasMeter) finish() (uint64, bool) {
+	m.chargeMemory()
+	m.settle()
+	remaining := m.instance.GetGasRemaining()
+	if m.charged {
+		remaining = m.synced
+	}
+	if m.instance.MeteringPointsExhausted() {
+		m.exhausted = true
+	}
+	if m.exhausted {
+		return m.start, true
+	}
+	return m.start - remaining, false
+}
@@ -0,0 +1,188 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"context"
+	"testing"
+
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"chainmaker.org/chainmaker/protocol/v2"
+	"chainmaker.org/chainmaker/vm/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func prepareMeteredInstances(t *testing.T, n int) (*vmPool, []*wrappedInstance) {
+	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+	config := DefaultPoolConfig()
+	config.MinSize = int32(n)
+	vmPool, err := newVmPool(&contractId, wasmBytes, config, nil, nil, nil, logger)
+	if err != nil {
+		t.Fatalf("create vmPool error: %v", err)
+	}
+	vmPool.grow(config.MinSize)
+
+	var instances []*wrappedInstance
+	for i := 0; i < n; i++ {
+		instance, err := vmPool.GetInstance(context.Background())
+		assert.Nil(t, err)
+		instances = append(instances, instance)
+	}
+	return vmPool, instances
+}
+
+func TestGasMeterCharged(t *testing.T) {
+	vmPool, instances := prepareMeteredInstances(t, 2)
+	defer vmPool.close()
+	caller, callee := instances[0].wasmInstance, instances[1].wasmInstance
+	defer vmPool.RevertInstance(instances[0])
+	defer vmPool.RevertInstance(instances[1])
+
+	txSimContext := newGasTxSimContext(blockVersionSyscallGas, 1000)
+	m := newGasMeter(txSimContext, caller, 0, baseGasSchedule())
+	assert.Equal(t, uint64(1000), caller.GetGasRemaining())
+
+	// wasm gas is settled into the tx before a syscall, syscall gas is taken from the instance after it
+	caller.SetGasLimit(900)
+	m.beforeSyscall()
+	assert.Equal(t, uint64(900), txSimContext.GetGasRemaining())
+	assert.Nil(t, txSimContext.SubtractGas(50))
+	m.afterSyscall()
+	assert.Equal(t, uint64(850), caller.GetGasRemaining())
+	assert.Equal(t, uint64(150), m.used())
+
+	// a nested call starts with what the caller has left
+	m.beforeSyscall()
+	nested := newGasMeter(txSimContext, callee, m.used(), baseGasSchedule())
+	assert.Equal(t, uint64(850), callee.GetGasRemaining())
+	callee.SetGasLimit(750)
+	gas, exhausted := nested.finish()
+	assert.False(t, exhausted)
+	assert.Equal(t, uint64(100), gas)
+	m.afterSyscall()
+	assert.Equal(t, uint64(750), caller.GetGasRemaining())
+
+	gas, exhausted = m.finish()
+	assert.False(t, exhausted)
+	assert.Equal(t, uint64(250), gas)
+	assert.Equal(t, uint64(750), txSimContext.GetGasRemaining())
+
+	// out of gas in a syscall stops the instance
+	m = newGasMeter(txSimContext, caller, 0, baseGasSchedule())
+	m.beforeSyscall()
+	assert.NotNil(t, txSimContext.SubtractGas(1000))
+	m.afterSyscall()
+	assert.Equal(t, uint64(0), caller.GetGasRemaining())
+	gas, exhausted = m.finish()
+	assert.True(t, exhausted)
+	assert.Equal(t, uint64(750), gas)
+}
+
+func TestGasMeterUsedUp(t *testing.T) {
+	vmPool, instances := prepareMeteredInstances(t, 1)
+	defer vmPool.close()
+	instance := instances[0].wasmInstance
+	defer vmPool.RevertInstance(instances[0])
+
+	// the frame using exactly the gas it was given succeeds
+	txSimContext := newGasTxSimContext(blockVersionSyscallGas, 1000)
+	m := newGasMeter(txSimContext, instance, 0, baseGasSchedule())
+	instance.SetGasLimit(0)
+	gas, exhausted := m.finish()
+	assert.False(t, exhausted)
+	assert.Equal(t, uint64(1000), gas)
+	assert.Equal(t, uint64(0), txSimContext.GetGasRemaining())
+
+	txSimContext = newGasTxSimContext(blockVersionSyscallGas-1, 1000)
+	m = newGasMeter(txSimContext, instance, protocol.GasLimit-100, baseGasSchedule())
+	assert.True(t, m.charge(100))
+	gas, exhausted = m.finish()
+	assert.False(t, exhausted)
+	assert.Equal(t, uint64(100), gas)
+
+	// one more is out of gas
+	m = newGasMeter(txSimContext, instance, protocol.GasLimit-100, baseGasSchedule())
+	assert.False(t, m.charge(101))
+	gas, exhausted = m.finish()
+	assert.True(t, exhausted)
+	assert.Equal(t, uint64(100), gas)
+
+	// the invoke fails with the code of the gas limit, not with the one of a payer short of balance
+	m = newGasMeter(txSimContext, instance, protocol.GasLimit-100, baseGasSchedule())
+	assert.False(t, m.charge(101))
+	r := &RuntimeInstance{}
+	_, err := r.settleGas(&SimContext{TxSimContext: txSimContext, gas: m}, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, vm.TxStatusCodeGasLimitExceeded, r.TxStatusCode())
+	assert.NotEqual(t, commonPb.TxStatusCode_GAS_BALANCE_NOT_ENOUGH_FAILED, r.TxStatusCode())
+}
+
+func TestGasMeterNotCharged(t *testing.T) {
+	vmPool, instances := prepareMeteredInstances(t, 1)
+	defer vmPool.close()
+	instance := instances[0].wasmInstance
+	defer vmPool.RevertInstance(instances[0])
+
+	// the gas used by the callers is deducted from protocol.GasLimit, the tx is not touched
+	txSimContext := newGasTxSimContext(blockVersionSyscallGas-1, 1000)
+	m := newGasMeter(txSimContext, instance, 100, baseGasSchedule())
+	assert.Equal(t, uint64(protocol.GasLimit-100), instance.GetGasRemaining())
+
+	instance.SetGasLimit(protocol.GasLimit - 150)
+	m.beforeSyscall()
+	m.afterSyscall()
+	assert.Equal(t, uint64(1000), txSimContext.GetGasRemaining())
+	assert.Equal(t, uint64(150), m.used())
+
+	// a nested call used 30 gas
+	m.afterCall(m.used() + protocol.CallContractGasOnce + 30)
+	gas, exhausted := m.finish()
+	assert.False(t, exhausted)
+	assert.Equal(t, uint64(50+protocol.CallContractGasOnce+30), gas)
+
+	m.afterCall(protocol.GasLimit)
+	_, exhausted = m.finish()
+	assert.True(t, exhausted)
+}
+
+func TestGasMeterMemoryAndCopy(t *testing.T) {
+	vmPool, instances := prepareMeteredInstances(t, 1)
+	defer vmPool.close()
+	instance := instances[0].wasmInstance
+	// the memory grown by the test can not be restored, the instance is discarded
+	defer vmPool.RevertInstance(instances[0])
+
+	schedule := baseGasSchedule()
+	schedule.MemoryPageCost = 1000
+	schedule.CopyByteCost = 2
+
+	for _, blockVersion := range []uint32{blockVersionSyscallGas - 1, blockVersionSyscallGas} {
+		txSimContext := newGasTxSimContext(blockVersion, 1e6)
+		m := newGasMeter(txSimContext, instance, 0, schedule)
+
+		memory, err := instance.Exports.GetMemory("memory")
+		assert.Nil(t, err)
+		assert.True(t, memory.Grow(2))
+		m.beforeSyscall()
+		assert.True(t, m.chargeCopy(10))
+		m.afterSyscall()
+
+		// the pages are charged once
+		m.beforeSyscall()
+		m.afterSyscall()
+		gas, exhausted := m.finish()
+		assert.False(t, exhausted)
+		assert.Equal(t, uint64(2*1000+10*2), gas, "block version %d", blockVersion)
+
+		// copying more than the gas left
+		m = newGasMeter(txSimContext, instance, 0, schedule)
+		assert.False(t, m.chargeCopy(1e10))
+		_, exhausted = m.finish()
+		assert.True(t, exhausted)
+	}
+}
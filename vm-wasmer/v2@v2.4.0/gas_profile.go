@@ -0,0 +1,384 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"chainmaker.org/chainmaker/logger/v2"
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+)
+
+// GasProfile the gas used by one invocation, attributed to the wasm functions and the syscalls
+type GasProfile struct {
+	TxId     string `json:"tx_id"`
+	Contract string `json:"contract"`
+	Version  string `json:"version"`
+	Method   string `json:"method"`
+	// depth of the cross contract call, 0 for the invocation of the tx
+	Depth int `json:"depth"`
+	// gas used by the invocation, nested calls included, TotalGas = WasmGas + syscalls + HostGas
+	TotalGas uint64 `json:"total_gas"`
+	// gas of the wasm code, the sum of Functions
+	WasmGas uint64 `json:"wasm_gas"`
+	// gas charged by the host out of the syscalls, linear memory growth and the parameters copied
+	HostGas  uint64 `json:"host_gas"`
+	OutOfGas bool   `json:"out_of_gas"`
+	// sorted by gas, the functions using no gas are left out
+	Functions []*FunctionGas `json:"functions"`
+	// sorted by gas, CallContract includes the gas of the nested call
+	Syscalls []*SyscallGas `json:"syscalls"`
+}
+
+// FunctionGas the gas of the wasm code of a function
+type FunctionGas struct {
+	Index uint32 `json:"index"`
+	Name  string `json:"name"`
+	Gas   uint64 `json:"gas"`
+}
+
+// SyscallGas the gas charged by the calls of a syscall method
+type SyscallGas struct {
+	Method string `json:"method"`
+	Count  uint64 `json:"count"`
+	Gas    uint64 `json:"gas"`
+}
+
+// JSON the json report of the profile
+func (p *GasProfile) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// WritePprof write the profile in the gzipped protobuf format of pprof, `go tool pprof` reads it,
+// every sample is a function or a syscall called by the contract method
+func (p *GasProfile) WritePprof(w io.Writer) error {
+	b := &pprofBuilder{strings: map[string]int64{"": 0}, stringTable: []string{""}}
+	root := b.location(fmt.Sprintf("%s.%s", p.Contract, p.Method))
+	for _, f := range p.Functions {
+		b.sample(f.Gas, b.location(f.Name), root)
+	}
+	for _, s := range p.Syscalls {
+		b.sample(s.Gas, b.location("syscall:"+s.Method), root)
+	}
+	if p.HostGas > 0 {
+		b.sample(p.HostGas, b.location("host"), root)
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(b.encode()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// pprofBuilder encodes perftools.profiles.Profile of github.com/google/pprof/proto/profile.proto,
+// one function per location, the function id is the location id
+type pprofBuilder struct {
+	buf         []byte
+	strings     map[string]int64
+	stringTable []string
+	locations   map[string]uint64
+}
+
+func (b *pprofBuilder) str(s string) int64 {
+	if i, ok := b.strings[s]; ok {
+		return i
+	}
+	i := int64(len(b.stringTable))
+	b.strings[s] = i
+	b.stringTable = append(b.stringTable, s)
+	return i
+}
+
+func (b *pprofBuilder) location(name string) uint64 {
+	if b.locations == nil {
+		b.locations = make(map[string]uint64)
+	}
+	if id, ok := b.locations[name]; ok {
+		return id
+	}
+	id := uint64(len(b.locations) + 1)
+	b.locations[name] = id
+	// Function: id = 1, name = 2, system_name = 3
+	var fn []byte
+	fn = protoVarint(fn, 1, id)
+	fn = protoVarint(fn, 2, uint64(b.str(name)))
+	fn = protoVarint(fn, 3, uint64(b.str(name)))
+	b.buf = protoBytes(b.buf, 5, fn)
+	// Location: id = 1, line = 4 {function_id = 1}
+	var loc []byte
+	loc = protoVarint(loc, 1, id)
+	loc = protoBytes(loc, 4, protoVarint(nil, 1, id))
+	b.buf = protoBytes(b.buf, 4, loc)
+	return id
+}
+
+// sample add a sample of the gas, the stack is leaf first
+func (b *pprofBuilder) sample(gas uint64, stack ...uint64) {
+	// Sample: location_id = 1, value = 2, both packed
+	var ids []byte
+	for _, id := range stack {
+		ids = binary.AppendUvarint(ids, id)
+	}
+	var s []byte
+	s = protoBytes(s, 1, ids)
+	s = protoBytes(s, 2, binary.AppendUvarint(nil, gas))
+	b.buf = protoBytes(b.buf, 2, s)
+}
+
+func (b *pprofBuilder) encode() []byte {
+	// Profile: sample_type = 1, sample = 2, location = 4, function = 5, string_table = 6,
+	// period_type = 11, period = 12
+	valueType := protoVarint(nil, 1, uint64(b.str("gas")))
+	valueType = protoVarint(valueType, 2, uint64(b.str("gas")))
+	out := protoBytes(nil, 1, valueType)
+	out = append(out, b.buf...)
+	for _, s := range b.stringTable {
+		out = protoBytes(out, 6, []byte(s))
+	}
+	out = protoBytes(out, 11, valueType)
+	return protoVarint(out, 12, 1)
+}
+
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// GasProfiler profiles the invocations of the runtime instances it is set to, see RuntimeInstance.SetGasProfiler.
+//
+// Profiled contracts run in pools of their own, compiled from the byte code instrumented by
+// instrumentForProfile, the pools of the chain are not touched. The counting code is metered as well,
+// its gas is taken out of the reports and of the GasUsed of the tx, but the tx does pay for it, so
+// a tx is profiled against a TxSimContext of its own, never on chain.
+type GasProfiler struct {
+	lock sync.Mutex
+	// contractName_contractVersion/engine key -> instrumented pool
+	pools map[string]*profiledPool
+	// tx id -> gas of the counting code charged so far
+	overheads map[string]uint64
+	profiles  []*GasProfile
+	log       *logger.CMLogger
+}
+
+type profiledPool struct {
+	pool   *vmPool
+	module *profiledModule
+}
+
+// NewGasProfiler return a gas profiler, it should be closed after use
+func NewGasProfiler(log *logger.CMLogger) *GasProfiler {
+	return &GasProfiler{
+		pools:     make(map[string]*profiledPool),
+		overheads: make(map[string]uint64),
+		log:       log,
+	}
+}
+
+// Profiles return the reports of the invocations profiled so far, in the order they finished,
+// a nested call finishes before its caller
+func (p *GasProfiler) Profiles() []*GasProfile {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]*GasProfile{}, p.profiles...)
+}
+
+// Close close the instrumented pools
+func (p *GasProfiler) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, pp := range p.pools {
+		pp.pool.close()
+		delete(p.pools, key)
+	}
+}
+
+// acquirePool retain the instrumented pool of the contract compiled by the engine of the schedule,
+// build it on the first call
+func (p *GasProfiler) acquirePool(contract *commonPb.Contract, byteCode []byte, schedule *GasSchedule,
+	engine *sharedEngine) (*vmPool, *profiledModule, error) {
+	key := contract.Name + "_" + contract.Version + "/" + engine.settings.key()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if pp, ok := p.pools[key]; ok && pp.pool.retain() {
+		return pp.pool, pp.module, nil
+	}
+	module, err := instrumentForProfile(byteCode, schedule)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%s_%s] instrument byte code for gas profiling failed, %v",
+			contract.Name, contract.Version, err)
+	}
+	config := DefaultPoolConfig()
+	pool, err := newVmPool(contract, module.byteCode, config, engine, nil, nil, p.log)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool.grow(config.MinSize)
+	pool.retain()
+	p.pools[key] = &profiledPool{pool: pool, module: module}
+	return pool, module, nil
+}
+
+// addOverhead add the gas of the counting code charged to the tx, return its total
+func (p *GasProfiler) addOverhead(txId string, gas uint64) uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.overheads[txId] += gas
+	return p.overheads[txId]
+}
+
+// record keep the report, the overhead of the tx is dropped when its invocation finishes
+func (p *GasProfiler) record(profile *GasProfile) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if profile.Depth == 0 {
+		delete(p.overheads, profile.TxId)
+	}
+	p.profiles = append(p.profiles, profile)
+}
+
+// newFrame start the profile of a call frame, nil if the runtime instance is not profiled
+func (p *GasProfiler) newFrame(module *profiledModule, sc *SimContext) *frameProfile {
+	if p == nil || module == nil {
+		return nil
+	}
+	f := &frameProfile{
+		profiler: p,
+		module:   module,
+		syscalls: make(map[string]*SyscallGas),
+		profile: &GasProfile{
+			TxId:     sc.TxSimContext.GetTx().Payload.TxId,
+			Contract: sc.Contract.Name,
+			Version:  sc.Contract.Version,
+			Method:   sc.method,
+			Depth:    int(sc.TxSimContext.GetDepth()),
+		},
+	}
+	f.overheadStart = p.addOverhead(f.profile.TxId, 0)
+	return f
+}
+
+// frameProfile the profile of a call frame being invoked
+type frameProfile struct {
+	profiler *GasProfiler
+	module   *profiledModule
+	profile  *GasProfile
+	syscalls map[string]*SyscallGas
+	// overhead of the tx when the frame started, the overhead of the nested calls is taken out as well
+	overheadStart uint64
+	// gas remaining and overhead of the tx when the running syscall started
+	syscallRemaining uint64
+	syscallOverhead  uint64
+}
+
+// enterSyscall called after gasMeter.beforeSyscall
+func (f *frameProfile) enterSyscall(m *gasMeter) {
+	if f == nil {
+		return
+	}
+	f.syscallRemaining = m.remaining()
+	f.syscallOverhead = f.profiler.addOverhead(f.profile.TxId, 0)
+}
+
+// leaveSyscall called after gasMeter.afterSyscall, the gas the syscall charged is added to the method
+func (f *frameProfile) leaveSyscall(method interface{}, m *gasMeter) {
+	if f == nil {
+		return
+	}
+	name, _ := method.(string)
+	s, ok := f.syscalls[name]
+	if !ok {
+		s = &SyscallGas{Method: name}
+		f.syscalls[name] = s
+	}
+	overhead := f.profiler.addOverhead(f.profile.TxId, 0) - f.syscallOverhead
+	s.Count++
+	s.Gas += subGas(subGas(f.syscallRemaining, m.remaining()), overhead)
+}
+
+// finish read the counters of the instance and record the report, return the gas used by the invocation
+// of the tx without the counting code, a nested call keeps it, its caller takes it out
+func (f *frameProfile) finish(instance *wasmergo.Instance, gas uint64, outOfGas bool) uint64 {
+	if f == nil {
+		return gas
+	}
+	profile := f.profile
+	for i := uint32(0); i < f.module.funcs; i++ {
+		index := f.module.importedFuncs + i
+		used := readProfileCounter(instance, fmt.Sprintf("%s%d", gasProfileFuncExport, index))
+		if used == 0 {
+			continue
+		}
+		profile.Functions = append(profile.Functions, &FunctionGas{
+			Index: index,
+			Name:  f.module.funcName(index),
+			Gas:   used,
+		})
+		profile.WasmGas += used
+	}
+	sort.Slice(profile.Functions, func(i, j int) bool {
+		a, b := profile.Functions[i], profile.Functions[j]
+		return a.Gas > b.Gas || a.Gas == b.Gas && a.Index < b.Index
+	})
+
+	var syscallGas uint64
+	for _, s := range f.syscalls {
+		profile.Syscalls = append(profile.Syscalls, s)
+		syscallGas += s.Gas
+	}
+	sort.Slice(profile.Syscalls, func(i, j int) bool {
+		a, b := profile.Syscalls[i], profile.Syscalls[j]
+		return a.Gas > b.Gas || a.Gas == b.Gas && a.Method < b.Method
+	})
+
+	segments := readProfileCounter(instance, gasProfileSegmentsExport)
+	overhead := f.profiler.addOverhead(profile.TxId, segments*f.module.overhead) - f.overheadStart
+	profile.TotalGas = subGas(gas, overhead)
+	profile.HostGas = subGas(profile.TotalGas, profile.WasmGas+syscallGas)
+	profile.OutOfGas = outOfGas
+	f.profiler.record(profile)
+	if profile.Depth > 0 {
+		return gas
+	}
+	return profile.TotalGas
+}
+
+// readProfileCounter read an exported counter global, 0 if it can not be read
+func readProfileCounter(instance *wasmergo.Instance, name string) uint64 {
+	global, err := instance.Exports.GetGlobal(name)
+	if err != nil {
+		return 0
+	}
+	value, err := global.Get()
+	if err != nil {
+		return 0
+	}
+	n, _ := value.(int64)
+	return uint64(n)
+}
+
+func subGas(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentForProfile(t *testing.T) {
+	schedule := newGasSchedule(0, 1, map[wasmergo.Opcode]uint32{})
+
+	// fib-c has no import and no global section
+	byteCode, err := readWasmFile("./testdata/fib-c.wasm")
+	assert.Nil(t, err)
+	module, err := instrumentForProfile(byteCode, schedule)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), module.importedFuncs)
+	assert.Equal(t, uint32(2), module.funcs)
+	assert.Equal(t, "func[1]", module.funcName(1))
+	assert.Equal(t, uint64(8), module.overhead)
+
+	sections, err := readWasmSections(module.byteCode)
+	assert.Nil(t, err)
+	var ids []byte
+	for _, s := range sections {
+		ids = append(ids, s.id)
+	}
+	// the global section is created before the export section
+	assert.Equal(t, []byte{1, 3, 5, 6, 7, 10, 11}, ids)
+	assert.Nil(t, wasmergo.ValidateModule(defaultEngine().newStore(), module.byteCode))
+
+	// the functions of rust-counter are named by its name section, indexed after the imports
+	byteCode, err = readWasmFile("./testdata/rust-counter-2.0.0.wasm")
+	assert.Nil(t, err)
+	module, err = instrumentForProfile(byteCode, schedule)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), module.importedFuncs)
+	assert.NotContains(t, module.funcName(module.importedFuncs), "func[")
+
+	_, err = instrumentForProfile([]byte("not wasm"), schedule)
+	assert.NotNil(t, err)
+}
+
+func TestGasProfiler(t *testing.T) {
+	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+	parameters := map[string][]byte{"key": []byte("test_key")}
+	fillingBaseParams(parameters)
+
+	manager, err := NewInstancesManager(ChainId, nil)
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+
+	invoke := func(profiler *GasProfiler) uint64 {
+		manager.SetGasProfiler(profiler)
+		txSimContext := prepareTxSimContext(ChainId, BlockVersion, contractId.Name, "increase", parameters,
+			SnapshotMock{chainConfig: gasSchedulesChainConfig(unitGasSchedules)})
+		runtimeInst, err := manager.NewRuntimeInstance(txSimContext, "", "", "", &contractId, wasmBytes, logger)
+		assert.Nil(t, err)
+		// the length of ctx_ptr changes the gas of the parameters
+		pinCtxIndex()
+		result, _ := runtimeInst.Invoke(&contractId, "increase", wasmBytes, parameters, txSimContext, 0)
+		assert.Equal(t, uint32(0), result.Code, result.Message)
+		return result.GasUsed
+	}
+	gasUsed := invoke(nil)
+	assert.True(t, gasUsed > 0)
+
+	profiler := NewGasProfiler(logger)
+	defer profiler.Close()
+	// the counting code is not reported
+	assert.Equal(t, gasUsed, invoke(profiler))
+	profiles := profiler.Profiles()
+	assert.Equal(t, 1, len(profiles))
+	profile := profiles[0]
+	assert.Equal(t, "increase", profile.Method)
+	assert.Equal(t, gasUsed, profile.TotalGas)
+	assert.False(t, profile.OutOfGas)
+
+	var wasmGas, syscallGas uint64
+	for _, f := range profile.Functions {
+		assert.NotEmpty(t, f.Name)
+		wasmGas += f.Gas
+	}
+	assert.Equal(t, profile.WasmGas, wasmGas)
+	methods := make(map[string]bool)
+	for _, s := range profile.Syscalls {
+		methods[s.Method] = true
+		syscallGas += s.Gas
+	}
+	assert.True(t, methods["PutState"])
+	// the parameters are copied by the host out of the syscalls
+	assert.True(t, profile.HostGas > 0)
+	assert.Equal(t, profile.TotalGas, profile.WasmGas+syscallGas+profile.HostGas)
+
+	report, err := profile.JSON()
+	assert.Nil(t, err)
+	var decoded GasProfile
+	assert.Nil(t, json.Unmarshal(report, &decoded))
+	assert.Equal(t, profile.TotalGas, decoded.TotalGas)
+
+	var buf bytes.Buffer
+	assert.Nil(t, profile.WritePprof(&buf))
+	zr, err := gzip.NewReader(&buf)
+	assert.Nil(t, err)
+	raw, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+	assert.Contains(t, string(raw), profile.Functions[0].Name)
+	assert.Contains(t, string(raw), "syscall:PutState")
+}
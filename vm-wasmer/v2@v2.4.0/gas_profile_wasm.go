@@ -0,0 +1,551 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+)
+
+// wasm binary section ids used by the gas profiler
+const (
+	wasmSectionCustom byte = 0
+	wasmSectionImport byte = 2
+	wasmSectionGlobal byte = 6
+	wasmSectionExport byte = 7
+	wasmSectionCode   byte = 10
+)
+
+// wasmSectionOrder the order of the known sections in a module, custom sections may appear anywhere
+var wasmSectionOrder = map[byte]int{
+	1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 13: 6, 6: 7, 7: 8, 8: 9, 9: 10, 12: 11, 10: 12, 11: 13,
+}
+
+const (
+	// gasProfileFuncExport prefix of the exported counter global of a function, followed by the function index
+	gasProfileFuncExport = "__gas_profile_func_"
+	// gasProfileSegmentsExport the exported global counting the charged segments, see profiledModule.overhead
+	gasProfileSegmentsExport = "__gas_profile_segments"
+)
+
+var errWasmEOF = errors.New("unexpected end of wasm byte code")
+
+// profiledModule a contract instrumented for gas profiling.
+//
+// The wasmer metering middleware sums the costs of the operators up to a boundary operator (see
+// meteringBoundary) and charges the sum right before it. The instrumented code adds the same sum to a
+// mutable i64 global of the function at the same place, so the counters are exactly the gas the
+// metering charges each function. The counters are appended to the globals and exported, the indices
+// of the existing globals and functions do not change.
+type profiledModule struct {
+	// instrumented byte code
+	byteCode []byte
+	// functions imported by the module, the defined functions are indexed from it
+	importedFuncs uint32
+	// number of functions defined by the module
+	funcs uint32
+	// function index -> name of the name section
+	names map[uint32]string
+	// gas charged by the counting code of every charged segment, it is not reported
+	overhead uint64
+}
+
+// funcName the name of the function in the name section, or func[index]
+func (m *profiledModule) funcName(index uint32) string {
+	if name, ok := m.names[index]; ok {
+		return name
+	}
+	return fmt.Sprintf("func[%d]", index)
+}
+
+// wasmSection a section of the wasm binary
+type wasmSection struct {
+	id      byte
+	payload []byte
+}
+
+// wasmReader reads the wasm binary, the first error is kept and every later read returns zero values
+type wasmReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *wasmReader) done() bool {
+	return r.err != nil || r.pos >= len(r.data)
+}
+
+func (r *wasmReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.data) {
+		r.err = errWasmEOF
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *wasmReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = errWasmEOF
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+// u32 read an unsigned LEB128 integer
+func (r *wasmReader) u32() uint32 {
+	var v uint32
+	for shift := uint(0); shift < 35; shift += 7 {
+		b := r.byte()
+		v |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+	if r.err == nil {
+		r.err = errors.New("invalid LEB128 integer")
+	}
+	return 0
+}
+
+// skipLEB skip a LEB128 integer of any size and sign
+func (r *wasmReader) skipLEB() {
+	for i := 0; i < 10; i++ {
+		if r.byte()&0x80 == 0 {
+			return
+		}
+	}
+	if r.err == nil {
+		r.err = errors.New("invalid LEB128 integer")
+	}
+}
+
+func (r *wasmReader) name() string {
+	return string(r.bytes(int(r.u32())))
+}
+
+// readWasmSections split the wasm binary into sections
+func readWasmSections(byteCode []byte) ([]wasmSection, error) {
+	if len(byteCode) < 8 || string(byteCode[:4]) != "\x00asm" || binary.LittleEndian.Uint32(byteCode[4:8]) != 1 {
+		return nil, errors.New("not a wasm module of version 1")
+	}
+	r := &wasmReader{data: byteCode, pos: 8}
+	var sections []wasmSection
+	for !r.done() {
+		id := r.byte()
+		payload := r.bytes(int(r.u32()))
+		sections = append(sections, wasmSection{id: id, payload: payload})
+	}
+	return sections, r.err
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+// appendS64 append a signed LEB128 integer
+func appendS64(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// instrumentForProfile add the gas counters to the byte code, the costs are those of the schedule
+// the module is compiled with
+func instrumentForProfile(byteCode []byte, schedule *GasSchedule) (*profiledModule, error) {
+	sections, err := readWasmSections(byteCode)
+	if err != nil {
+		return nil, err
+	}
+	m := &profiledModule{names: make(map[uint32]string)}
+
+	var importedGlobals, globals uint32
+	var code *wasmSection
+	for i := range sections {
+		s := &sections[i]
+		switch s.id {
+		case wasmSectionImport:
+			if m.importedFuncs, importedGlobals, err = countImports(s.payload); err != nil {
+				return nil, fmt.Errorf("invalid import section, %v", err)
+			}
+		case wasmSectionGlobal:
+			r := &wasmReader{data: s.payload}
+			globals = r.u32()
+			if r.err != nil {
+				return nil, fmt.Errorf("invalid global section, %v", r.err)
+			}
+		case wasmSectionCode:
+			code = s
+		case wasmSectionCustom:
+			readFuncNames(s.payload, m.names)
+		}
+	}
+	if code == nil {
+		return nil, errors.New("module has no code section")
+	}
+
+	// one counter per defined function, then the segment counter
+	counterBase := importedGlobals + globals
+	body, funcs, err := instrumentCode(code.payload, counterBase, schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid code section, %v", err)
+	}
+	code.payload = body
+	m.funcs = funcs
+	m.overhead = 2 * uint64(schedule.Cost(GlobalGet)+schedule.Cost(I64Const)+schedule.Cost(I64Add)+
+		schedule.Cost(GlobalSet))
+
+	var newGlobals, newExports []byte
+	for i := uint32(0); i <= funcs; i++ {
+		// mutable i64 initialized by i64.const 0
+		newGlobals = append(newGlobals, 0x7e, 0x01, 0x42, 0x00, 0x0b)
+		exportName := gasProfileSegmentsExport
+		if i < funcs {
+			exportName = fmt.Sprintf("%s%d", gasProfileFuncExport, m.importedFuncs+i)
+		}
+		newExports = appendU32(newExports, uint32(len(exportName)))
+		newExports = append(newExports, exportName...)
+		newExports = append(newExports, 0x03)
+		newExports = appendU32(newExports, counterBase+i)
+	}
+	if sections, err = appendVecSection(sections, wasmSectionGlobal, funcs+1, newGlobals); err != nil {
+		return nil, fmt.Errorf("invalid global section, %v", err)
+	}
+	if sections, err = appendVecSection(sections, wasmSectionExport, funcs+1, newExports); err != nil {
+		return nil, fmt.Errorf("invalid export section, %v", err)
+	}
+
+	out := append([]byte{}, byteCode[:8]...)
+	for _, s := range sections {
+		out = append(out, s.id)
+		out = appendU32(out, uint32(len(s.payload)))
+		out = append(out, s.payload...)
+	}
+	m.byteCode = out
+	return m, nil
+}
+
+// countImports count the imported functions and globals
+func countImports(payload []byte) (funcs, globals uint32, err error) {
+	r := &wasmReader{data: payload}
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		r.name()
+		r.name()
+		switch kind := r.byte(); kind {
+		case 0x00: // function, type index
+			funcs++
+			r.u32()
+		case 0x01: // table, reftype and limits
+			r.byte()
+			skipLimits(r)
+		case 0x02: // memory, limits
+			skipLimits(r)
+		case 0x03: // global, valtype and mutability
+			globals++
+			r.bytes(2)
+		case 0x04: // tag, attribute and type index
+			r.byte()
+			r.u32()
+		default:
+			return 0, 0, fmt.Errorf("unknown import kind %d", kind)
+		}
+	}
+	return funcs, globals, r.err
+}
+
+func skipLimits(r *wasmReader) {
+	flags := r.byte()
+	r.skipLEB()
+	if flags&0x01 != 0 {
+		r.skipLEB()
+	}
+}
+
+// readFuncNames read the function names of the name section, a malformed name section is ignored
+func readFuncNames(payload []byte, names map[uint32]string) {
+	r := &wasmReader{data: payload}
+	if r.name() != "name" {
+		return
+	}
+	for !r.done() {
+		id := r.byte()
+		sub := &wasmReader{data: r.bytes(int(r.u32()))}
+		if r.err != nil || id != 1 {
+			continue
+		}
+		for n := sub.u32(); n > 0 && sub.err == nil; n-- {
+			index := sub.u32()
+			name := sub.name()
+			if sub.err == nil {
+				names[index] = name
+			}
+		}
+	}
+}
+
+// appendVecSection append the entries to the vector section of the id, the section is created
+// at its place if the module has none
+func appendVecSection(sections []wasmSection, id byte, count uint32, entries []byte) ([]wasmSection, error) {
+	for i := range sections {
+		if sections[i].id != id {
+			continue
+		}
+		r := &wasmReader{data: sections[i].payload}
+		n := r.u32()
+		if r.err != nil {
+			return nil, r.err
+		}
+		payload := appendU32(nil, n+count)
+		payload = append(payload, sections[i].payload[r.pos:]...)
+		sections[i].payload = append(payload, entries...)
+		return sections, nil
+	}
+
+	section := wasmSection{id: id, payload: append(appendU32(nil, count), entries...)}
+	at := len(sections)
+	for i, s := range sections {
+		if order, ok := wasmSectionOrder[s.id]; ok && order > wasmSectionOrder[id] {
+			at = i
+			break
+		}
+	}
+	sections = append(sections, wasmSection{})
+	copy(sections[at+1:], sections[at:])
+	sections[at] = section
+	return sections, nil
+}
+
+// instrumentCode add the counting code to every function body, return the new code section
+// and the number of functions
+func instrumentCode(payload []byte, counterBase uint32, schedule *GasSchedule) ([]byte, uint32, error) {
+	r := &wasmReader{data: payload}
+	funcs := r.u32()
+	out := appendU32(nil, funcs)
+	segments := counterBase + funcs
+	for i := uint32(0); i < funcs && r.err == nil; i++ {
+		body := r.bytes(int(r.u32()))
+		if r.err != nil {
+			break
+		}
+		instrumented, err := instrumentBody(body, counterBase+i, segments, schedule)
+		if err != nil {
+			return nil, 0, fmt.Errorf("function %d, %v", i, err)
+		}
+		out = appendU32(out, uint32(len(instrumented)))
+		out = append(out, instrumented...)
+	}
+	return out, funcs, r.err
+}
+
+// instrumentBody add the cost of every metered segment to the counter of the function right before
+// its boundary operator, and count the segment
+func instrumentBody(body []byte, counter, segments uint32, schedule *GasSchedule) ([]byte, error) {
+	r := &wasmReader{data: body}
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		r.u32()
+		r.byte()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	out := append(make([]byte, 0, len(body)*2), body[:r.pos]...)
+
+	var cost uint64
+	for !r.done() {
+		start := r.pos
+		op, err := readOperator(r)
+		if err != nil {
+			return nil, err
+		}
+		cost += uint64(schedule.Cost(op))
+		if meteringBoundary(op) && cost > 0 {
+			out = appendCount(out, counter, int64(cost))
+			out = appendCount(out, segments, 1)
+			cost = 0
+		}
+		out = append(out, body[start:r.pos]...)
+	}
+	return out, r.err
+}
+
+// appendCount global.get g, i64.const n, i64.add, global.set g
+func appendCount(out []byte, global uint32, n int64) []byte {
+	out = appendU32(append(out, 0x23), global)
+	out = appendS64(append(out, 0x42), n)
+	out = append(out, 0x7c, 0x24)
+	return appendU32(out, global)
+}
+
+// meteringBoundary the operators the wasmer metering middleware charges the accumulated cost before
+func meteringBoundary(op wasmergo.Opcode) bool {
+	switch op {
+	case Loop, End, Else, Br, BrIf, BrTable, Call, CallIndirect, Return:
+		return true
+	}
+	return false
+}
+
+// readOperator read an operator and its immediates, return its metering opcode.
+// Only the operators of wasm 1.0, sign extension, saturating truncation, bulk memory and
+// reference types are known, SIMD, atomics, exceptions and tail calls are not supported
+func readOperator(r *wasmReader) (wasmergo.Opcode, error) {
+	b := r.byte()
+	var op wasmergo.Opcode
+	switch {
+	case b >= 0x45 && b <= 0xc4: // numeric operators without immediates, in the order of the opcodes
+		op = I32Eqz + wasmergo.Opcode(b-0x45)
+	case b >= 0x28 && b <= 0x3e: // loads and stores, memarg
+		op = I32Load + wasmergo.Opcode(b-0x28)
+		r.u32()
+		r.skipLEB()
+	default:
+		var ok bool
+		if op, ok = readControlOperator(r, b); !ok {
+			return 0, fmt.Errorf("unsupported operator 0x%02x at %d", b, r.pos-1)
+		}
+	}
+	return op, r.err
+}
+
+// readControlOperator read the operators which are not in a contiguous range
+func readControlOperator(r *wasmReader, b byte) (wasmergo.Opcode, bool) {
+	switch b {
+	case 0x00:
+		return Unreachable, true
+	case 0x01:
+		return Nop, true
+	case 0x02, 0x03, 0x04: // block type
+		r.skipLEB()
+		return []wasmergo.Opcode{Block, Loop, If}[b-0x02], true
+	case 0x05:
+		return Else, true
+	case 0x0b:
+		return End, true
+	case 0x0c:
+		r.u32()
+		return Br, true
+	case 0x0d:
+		r.u32()
+		return BrIf, true
+	case 0x0e:
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			r.u32()
+		}
+		r.u32()
+		return BrTable, true
+	case 0x0f:
+		return Return, true
+	case 0x10:
+		r.u32()
+		return Call, true
+	case 0x11: // type index, table index
+		r.u32()
+		r.u32()
+		return CallIndirect, true
+	case 0x1a:
+		return Drop, true
+	case 0x1b:
+		return Select, true
+	case 0x1c:
+		r.bytes(int(r.u32()))
+		return TypedSelect, true
+	case 0x20, 0x21, 0x22, 0x23, 0x24:
+		r.u32()
+		return []wasmergo.Opcode{LocalGet, LocalSet, LocalTee, GlobalGet, GlobalSet}[b-0x20], true
+	case 0x25, 0x26:
+		r.u32()
+		return []wasmergo.Opcode{TableGet, TableSet}[b-0x25], true
+	case 0x3f, 0x40: // memory index
+		r.u32()
+		return []wasmergo.Opcode{MemorySize, MemoryGrow}[b-0x3f], true
+	case 0x41:
+		r.skipLEB()
+		return I32Const, true
+	case 0x42:
+		r.skipLEB()
+		return I64Const, true
+	case 0x43:
+		r.bytes(4)
+		return F32Const, true
+	case 0x44:
+		r.bytes(8)
+		return F64Const, true
+	case 0xd0:
+		r.byte()
+		return RefNull, true
+	case 0xd1:
+		return RefIsNull, true
+	case 0xd2:
+		r.u32()
+		return RefFunc, true
+	case 0xfc:
+		return readMiscOperator(r)
+	}
+	return 0, false
+}
+
+// readMiscOperator read the operators of the 0xfc prefix
+func readMiscOperator(r *wasmReader) (wasmergo.Opcode, bool) {
+	sub := r.u32()
+	switch {
+	case sub <= 7: // saturating truncation
+		return I32TruncSatF32S + wasmergo.Opcode(sub), true
+	case sub == 8: // data index, memory index
+		r.u32()
+		r.u32()
+		return MemoryInit, true
+	case sub == 9:
+		r.u32()
+		return DataDrop, true
+	case sub == 10:
+		r.u32()
+		r.u32()
+		return MemoryCopy, true
+	case sub == 11:
+		r.u32()
+		return MemoryFill, true
+	case sub == 12: // element index, table index
+		r.u32()
+		r.u32()
+		return TableInit, true
+	case sub == 13:
+		r.u32()
+		return ElemDrop, true
+	case sub == 14:
+		r.u32()
+		r.u32()
+		return TableCopy, true
+	case sub == 15:
+		r.u32()
+		return TableGrow, true
+	case sub == 16:
+		r.u32()
+		return OpTableSize, true
+	case sub == 17:
+		r.u32()
+		return TableFill, true
+	}
+	return 0, false
+}
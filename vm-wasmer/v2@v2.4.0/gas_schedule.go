@@ -0,0 +1,304 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"chainmaker.org/chainmaker/protocol/v2"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+)
+
+// chainConfigKeyGasSchedules the key of the gas schedules in the ext config of the consensus config of the chain
+// (ChainConfig.Consensus.ExtConfig), the value is a json list of schedules. The schedules are governed: they are
+// changed by a chain config update tx, so every node meters the same, and a schedule takes effect from the block
+// version it declares, e.g.
+//
+//	[
+//	  {
+//	    "block_version": 2040000,
+//	    "default_cost": 1,              // cost of the opcodes not listed in costs
+//	    "memory_page_cost": 10000,      // cost of every page the linear memory grows by
+//	    "copy_byte_cost": 1,            // cost of every byte the host copies into the linear memory
+//	    "state_byte_cost": 20,          // cost of every byte of key and value PutState writes
+//	    "state_rewrite_byte_cost": 5,   // the same, if the key is known to hold a value already
+//	    "state_refund_byte_cost": 10,   // refund of every byte of key and value DeleteState frees
+//	    "state_refund_cap_percent": 20, // refunds are capped at this percent of the gas used by the tx
+//	    "sha256_base_cost": 30,         // cost of every Sha256 syscall, 30 if not set
+//	    "sha256_word_cost": 6,          // cost of every 32 bytes word Sha256 hashes, 6 if not set
+//	    "costs": {"I32Add": 1, "I32Load": 3, "MemoryGrow": 100000}
+//	  }
+//	]
+const chainConfigKeyGasSchedules = "wasmer_gas_schedules"
+
+// configKeyGasSchedules the gas schedules used to be read from the vm config map of the node,
+// they are ignored there now, see chainConfigKeyGasSchedules
+const configKeyGasSchedules = "gas_schedules"
+
+// keys of a gas schedule
+const (
+	configKeyBlockVersion   = "block_version"
+	configKeyDefaultCost    = "default_cost"
+	configKeyMemoryPageCost = "memory_page_cost"
+	configKeyCopyByteCost   = "copy_byte_cost"
+	configKeyCosts          = "costs"
+
+	configKeyStateByteCost         = "state_byte_cost"
+	configKeyStateRewriteByteCost  = "state_rewrite_byte_cost"
+	configKeyStateRefundByteCost   = "state_refund_byte_cost"
+	configKeyStateRefundCapPercent = "state_refund_cap_percent"
+
+	configKeySha256BaseCost = "sha256_base_cost"
+	configKeySha256WordCost = "sha256_word_cost"
+)
+
+// the costs of the Sha256 syscall of a schedule not setting them, the syscall was charged them before
+// they were governed
+const (
+	defaultSha256BaseCost = 30
+	defaultSha256WordCost = 6
+)
+
+// GasSchedule the gas cost of every wasm opcode, active from BlockVersion on
+type GasSchedule struct {
+	// the schedule is used by the blocks whose version >= BlockVersion
+	BlockVersion uint32
+	// cost of the opcodes not in Costs
+	DefaultCost uint32
+	// opcode -> cost
+	Costs map[wasmergo.Opcode]uint32
+	// cost of every page the linear memory grows by during a call
+	MemoryPageCost uint32
+	// cost of every byte the host copies into the linear memory, state values, call results, parameters...
+	CopyByteCost uint32
+	// cost of every byte of key and value written by PutState, StateRewriteByteCost if the key is known
+	// to hold a value, see vm.LookupState
+	StateByteCost        uint32
+	StateRewriteByteCost uint32
+	// refund of every byte of key and value freed by DeleteState, the refunds of a tx are capped at
+	// StateRefundCapPercent of the gas it used
+	StateRefundByteCost   uint32
+	StateRefundCapPercent uint32
+	// cost of the Sha256 syscall of a charged tx, Sha256BaseCost per call and Sha256WordCost
+	// per 32 bytes word of the input
+	Sha256BaseCost uint32
+	Sha256WordCost uint32
+
+	settings engineSettings
+}
+
+// baseGasSchedule the schedule before any is configured, wasm execution is not charged
+func baseGasSchedule() *GasSchedule {
+	return newGasSchedule(0, 0, map[wasmergo.Opcode]uint32{})
+}
+
+func newGasSchedule(blockVersion, defaultCost uint32, costs map[wasmergo.Opcode]uint32) *GasSchedule {
+	s := &GasSchedule{
+		BlockVersion:   blockVersion,
+		DefaultCost:    defaultCost,
+		Costs:          costs,
+		Sha256BaseCost: defaultSha256BaseCost,
+		Sha256WordCost: defaultSha256WordCost,
+	}
+	s.settings = defaultEngineSettings()
+	s.settings.meteringTable = s.meteringTable()
+	return s
+}
+
+// Cost return the gas cost of the opcode
+func (s *GasSchedule) Cost(op wasmergo.Opcode) uint32 {
+	if cost, ok := s.Costs[op]; ok {
+		return cost
+	}
+	return s.DefaultCost
+}
+
+// meteringTable the cost table passed to the metering middleware, zero costs are left out
+func (s *GasSchedule) meteringTable() map[wasmergo.Opcode]uint32 {
+	table := make(map[wasmergo.Opcode]uint32)
+	for op := wasmergo.Opcode(0); op <= maxOpcode; op++ {
+		if cost := s.Cost(op); cost > 0 {
+			table[op] = cost
+		}
+	}
+	return table
+}
+
+// gasSchedules the gas schedules of a chain, sorted by block version, the first one is active from version 0
+type gasSchedules []*GasSchedule
+
+// parseGasSchedules parse the list of gas schedules, the base schedule is used until the first one takes effect
+func parseGasSchedules(raw interface{}) (gasSchedules, error) {
+	schedules := gasSchedules{baseGasSchedule()}
+	if raw == nil {
+		return schedules, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid %s config, expect a list, got %T", chainConfigKeyGasSchedules, raw)
+	}
+
+	versions := make(map[uint32]bool)
+	for i, item := range list {
+		schedule, err := parseGasSchedule(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s[%d] config, %v", chainConfigKeyGasSchedules, i, err)
+		}
+		if versions[schedule.BlockVersion] {
+			return nil, fmt.Errorf("invalid %s[%d] config, duplicated %s %d",
+				chainConfigKeyGasSchedules, i, configKeyBlockVersion, schedule.BlockVersion)
+		}
+		versions[schedule.BlockVersion] = true
+		if schedule.BlockVersion == 0 {
+			schedules[0] = schedule
+		} else {
+			schedules = append(schedules, schedule)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].BlockVersion < schedules[j].BlockVersion
+	})
+	return schedules, nil
+}
+
+// parseChainGasSchedules parse the json value of chainConfigKeyGasSchedules, empty if the chain has none
+func parseChainGasSchedules(value string) (gasSchedules, error) {
+	if value == "" {
+		return parseGasSchedules(nil)
+	}
+	var raw interface{}
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("invalid %s config, %v", chainConfigKeyGasSchedules, err)
+	}
+	return parseGasSchedules(raw)
+}
+
+// chainGasSchedules the gas schedules of the chain config, parsed once per value of chainConfigKeyGasSchedules
+type chainGasSchedules struct {
+	lock      sync.Mutex
+	value     string
+	schedules gasSchedules
+	err       error
+}
+
+func newChainGasSchedules() *chainGasSchedules {
+	schedules, _ := parseGasSchedules(nil)
+	return &chainGasSchedules{schedules: schedules}
+}
+
+// selectFor return the schedule of the chain config of the tx, active at the block version of the tx,
+// the base schedule if txSimContext is nil
+func (c *chainGasSchedules) selectFor(txSimContext protocol.TxSimContext) (*GasSchedule, error) {
+	if txSimContext == nil {
+		return baseGasSchedule(), nil
+	}
+	var value string
+	for _, kv := range txSimContext.GetLastChainConfig().GetConsensus().GetExtConfig() {
+		if kv.GetKey() == chainConfigKeyGasSchedules {
+			value = kv.GetValue()
+		}
+	}
+
+	c.lock.Lock()
+	if value != c.value {
+		c.value = value
+		c.schedules, c.err = parseChainGasSchedules(value)
+	}
+	schedules, err := c.schedules, c.err
+	c.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return schedules.selectFor(txSimContext.GetBlockVersion()), nil
+}
+
+func parseGasSchedule(raw interface{}) (*GasSchedule, error) {
+	m, err := toStringMap(raw)
+	if err != nil {
+		return nil, err
+	}
+	blockVersion, err := toUint32(m[configKeyBlockVersion])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s, %v", configKeyBlockVersion, err)
+	}
+	var defaultCost uint32
+	s := &GasSchedule{Sha256BaseCost: defaultSha256BaseCost, Sha256WordCost: defaultSha256WordCost}
+	for key, cost := range map[string]*uint32{
+		configKeyDefaultCost:           &defaultCost,
+		configKeyMemoryPageCost:        &s.MemoryPageCost,
+		configKeyCopyByteCost:          &s.CopyByteCost,
+		configKeyStateByteCost:         &s.StateByteCost,
+		configKeyStateRewriteByteCost:  &s.StateRewriteByteCost,
+		configKeyStateRefundByteCost:   &s.StateRefundByteCost,
+		configKeyStateRefundCapPercent: &s.StateRefundCapPercent,
+		configKeySha256BaseCost:        &s.Sha256BaseCost,
+		configKeySha256WordCost:        &s.Sha256WordCost,
+	} {
+		if val, ok := m[key]; ok {
+			if *cost, err = toUint32(val); err != nil {
+				return nil, fmt.Errorf("invalid %s, %v", key, err)
+			}
+		}
+	}
+
+	costs := make(map[wasmergo.Opcode]uint32)
+	if val, ok := m[configKeyCosts]; ok && val != nil {
+		costMap, err := toStringMap(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s, %v", configKeyCosts, err)
+		}
+		for name, val := range costMap {
+			op, ok := opcodeNames[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown opcode %s", name)
+			}
+			if costs[op], err = toUint32(val); err != nil {
+				return nil, fmt.Errorf("invalid cost of %s, %v", name, err)
+			}
+		}
+	}
+	if s.StateRefundCapPercent > 100 {
+		return nil, fmt.Errorf("invalid %s, %d is more than 100", configKeyStateRefundCapPercent,
+			s.StateRefundCapPercent)
+	}
+	schedule := newGasSchedule(blockVersion, defaultCost, costs)
+	schedule.MemoryPageCost = s.MemoryPageCost
+	schedule.CopyByteCost = s.CopyByteCost
+	schedule.StateByteCost = s.StateByteCost
+	schedule.StateRewriteByteCost = s.StateRewriteByteCost
+	schedule.StateRefundByteCost = s.StateRefundByteCost
+	schedule.StateRefundCapPercent = s.StateRefundCapPercent
+	schedule.Sha256BaseCost = s.Sha256BaseCost
+	schedule.Sha256WordCost = s.Sha256WordCost
+	return schedule, nil
+}
+
+// selectFor return the schedule active at the block version
+func (gs gasSchedules) selectFor(blockVersion uint32) *GasSchedule {
+	i := sort.Search(len(gs), func(i int) bool {
+		return gs[i].BlockVersion > blockVersion
+	})
+	if i == 0 {
+		return gs[0]
+	}
+	return gs[i-1]
+}
+
+func toUint32(val interface{}) (uint32, error) {
+	i, err := toInt64(val)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 || i > int64(^uint32(0)) {
+		return 0, fmt.Errorf("%d out of range", i)
+	}
+	return uint32(i), nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"testing"
+
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// gasSchedulesValue the value of wasmer_gas_schedules in the chain config, see chainConfigKeyGasSchedules
+const gasSchedulesValue = `[
+  {
+    "block_version": 3000000,
+    "default_cost": 2,
+    "memory_page_cost": 10000,
+    "copy_byte_cost": 3,
+    "state_byte_cost": 20,
+    "state_refund_cap_percent": 20,
+    "sha256_word_cost": 8,
+    "costs": {"I32Add": 1, "MemoryGrow": 100000}
+  },
+  {"block_version": 2040000, "default_cost": 1}
+]`
+
+func TestParseGasSchedules(t *testing.T) {
+	schedules, err := parseGasSchedules(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(schedules))
+	assert.Equal(t, uint32(0), schedules.selectFor(3000000).Cost(wasmergo.I32Add))
+	assert.Equal(t, 0, len(schedules[0].settings.meteringTable))
+
+	schedules, err = parseChainGasSchedules(gasSchedulesValue)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(schedules))
+
+	// the base schedule is active until the first configured one
+	assert.Equal(t, uint32(0), schedules.selectFor(2030100).BlockVersion)
+	assert.Equal(t, uint32(2040000), schedules.selectFor(2040000).BlockVersion)
+	assert.Equal(t, uint32(2040000), schedules.selectFor(2999999).BlockVersion)
+
+	latest := schedules.selectFor(3000001)
+	assert.Equal(t, uint32(3000000), latest.BlockVersion)
+	assert.Equal(t, uint32(1), latest.Cost(wasmergo.I32Add))
+	assert.Equal(t, uint32(100000), latest.Cost(MemoryGrow))
+	assert.Equal(t, uint32(2), latest.Cost(LocalGet))
+	assert.Equal(t, uint32(10000), latest.MemoryPageCost)
+	assert.Equal(t, uint32(3), latest.CopyByteCost)
+	assert.Equal(t, uint32(0), schedules.selectFor(2040000).CopyByteCost)
+	assert.Equal(t, uint32(20), latest.StateByteCost)
+	assert.Equal(t, uint32(0), latest.StateRewriteByteCost)
+	assert.Equal(t, uint32(20), latest.StateRefundCapPercent)
+	// the sha256 costs not set keep the price the syscall had before it was governed
+	assert.Equal(t, uint32(30), latest.Sha256BaseCost)
+	assert.Equal(t, uint32(8), latest.Sha256WordCost)
+	assert.Equal(t, uint32(6), schedules.selectFor(2040000).Sha256WordCost)
+	assert.Equal(t, uint32(6), schedules.selectFor(0).Sha256WordCost)
+	assert.Equal(t, int(maxOpcode)+1, len(latest.settings.meteringTable))
+	assert.NotEqual(t, latest.settings.key(), schedules.selectFor(2040000).settings.key())
+}
+
+func TestParseGasSchedulesInvalid(t *testing.T) {
+	invalid := []string{
+		`not json`,
+		`{"block_version": 1}`,
+		`[{"default_cost": 1}]`,
+		`[{"block_version": -1}]`,
+		`[{"block_version": 1, "copy_byte_cost": "one"}]`,
+		`[{"block_version": 1, "sha256_base_cost": -1}]`,
+		`[{"block_version": 1, "state_refund_cap_percent": 101}]`,
+		`[{"block_version": 1, "costs": {"NoSuchOp": 1}}]`,
+		`[{"block_version": 1}, {"block_version": 1}]`,
+	}
+	for _, c := range invalid {
+		_, err := parseChainGasSchedules(c)
+		assert.NotNil(t, err, c)
+	}
+}
+
+func TestChainGasSchedules(t *testing.T) {
+	schedules := newChainGasSchedules()
+	schedule, err := schedules.selectFor(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), schedule.BlockVersion)
+
+	// a chain without the config uses the base schedule
+	txSimContext := newGasTxSimContext(3000000, 0)
+	schedule, err = schedules.selectFor(txSimContext)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), schedule.BlockVersion)
+
+	txSimContext.chainConfig = gasSchedulesChainConfig(gasSchedulesValue)
+	schedule, err = schedules.selectFor(txSimContext)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3000000), schedule.BlockVersion)
+	txSimContext.blockVersion = 2040000
+	schedule, err = schedules.selectFor(txSimContext)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2040000), schedule.BlockVersion)
+
+	// the node config has no say, only a chain config update changes the schedules
+	manager, err := NewInstancesManager(ChainId, map[string]interface{}{
+		configKeyGasSchedules: []interface{}{map[string]interface{}{"block_version": 0, "default_cost": 7}},
+	})
+	assert.Nil(t, err)
+	schedule, err = manager.gasSchedules.selectFor(txSimContext)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), schedule.Cost(LocalGet))
+
+	// an invalid config fails every tx until it is fixed
+	txSimContext.chainConfig = gasSchedulesChainConfig(`[{"default_cost": 1}]`)
+	_, err = schedules.selectFor(txSimContext)
+	assert.NotNil(t, err)
+	txSimContext.chainConfig = nil
+	_, err = schedules.selectFor(txSimContext)
+	assert.Nil(t, err)
+}
+
+func TestGasScheduleActivation(t *testing.T) {
+	wasmBytes, contractId, _ := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+
+	manager, err := NewInstancesManager(ChainId, map[string]interface{}{
+		"pool": map[string]interface{}{"min_size": 1},
+	})
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+	txSimContext := newGasTxSimContext(2030100, 0)
+	txSimContext.chainConfig = gasSchedulesChainConfig(gasSchedulesValue)
+	getVmPool := func(blockVersion uint32) (*vmPool, error) {
+		txSimContext.blockVersion = blockVersion
+		schedule, err := manager.gasSchedules.selectFor(txSimContext)
+		if err != nil {
+			return nil, err
+		}
+		return manager.getVmPool(&contractId, wasmBytes, schedule, nil)
+	}
+
+	before, err := getVmPool(2030100)
+	assert.Nil(t, err)
+	same, err := getVmPool(2030101)
+	assert.Nil(t, err)
+	assert.Equal(t, before, same)
+
+	// the pool is rebuilt for the new schedule, the old one is closed
+	after, err := getVmPool(2040000)
+	assert.Nil(t, err)
+	assert.NotEqual(t, before, after)
+	assert.NotEqual(t, before.engine, after.engine)
+	assert.NotEqual(t, poolActive, before.state())
+	assert.Equal(t, 1, len(manager.instanceMap))
+}
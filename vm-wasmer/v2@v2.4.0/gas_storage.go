@@ -0,0 +1,80 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"math/bits"
+
+	"chainmaker.org/chainmaker/common/v2/serialize"
+	"chainmaker.org/chainmaker/protocol/v2"
+	"chainmaker.org/chainmaker/vm/v2"
+)
+
+// statePriced whether PutState and DeleteState are priced by the size of the state
+func (m *gasMeter) statePriced() bool {
+	return m.stateCost > 0 || m.rewriteCost > 0 || m.refundCost > 0
+}
+
+// chargeState charge the bytes of key and value written by PutState, rewrite if the key held a value
+func (m *gasMeter) chargeState(n int, rewrite bool) bool {
+	cost := m.stateCost
+	if rewrite {
+		cost = m.rewriteCost
+	}
+	if n > 0 && cost > ^uint64(0)/uint64(n) {
+		return m.charge(^uint64(0))
+	}
+	return m.charge(uint64(n) * cost)
+}
+
+// refundBytes the gas refunded for the bytes of key and value freed by DeleteState
+func (m *gasMeter) refundBytes(n int) uint64 {
+	if n > 0 && m.refundCost > ^uint64(0)/uint64(n) {
+		return ^uint64(0)
+	}
+	return uint64(n) * m.refundCost
+}
+
+// settleRefund take the refunds of the tx off the gas used by the root frame, up to refundCap percent of it,
+// the gas taken off is given back to the tx if it is charged. The refunds of a failed root frame are dropped,
+// a nested frame leaves its refunds to its caller, see vm.AddGasRefund
+func (m *gasMeter) settleRefund(gas uint64, succeeded bool) uint64 {
+	if m.txSimContext.GetDepth() > 0 {
+		return gas
+	}
+	refund := vm.TakeGasRefund(m.txSimContext)
+	if !succeeded || refund == 0 {
+		return gas
+	}
+	capPercent := m.refundCap
+	if capPercent > 100 {
+		capPercent = 100
+	}
+	// gas * capPercent / 100 without overflow
+	hi, lo := bits.Mul64(gas, uint64(capPercent))
+	limit, _ := bits.Div64(hi, lo, 100)
+	if refund > limit {
+		refund = limit
+	}
+	if m.charged {
+		vm.RefundGas(m.txSimContext, refund)
+	}
+	return gas - refund
+}
+
+// stateWrite the state key the request of PutState or DeleteState writes, the value it writes and
+// the value the key holds as the tx sees it, a blind write finds the value in the snapshot, see vm.LookupState
+func (s *WaciInstance) stateWrite() (stateKey, value, prev []byte, err error) {
+	ec := serialize.NewEasyCodecWithBytes(s.RequestBody)
+	key, _ := ec.GetString("key")
+	field, _ := ec.GetString("field")
+	value, _ = ec.GetBytes("value")
+	stateKey = protocol.GetKeyStr(key, field)
+	prev, err = vm.LookupState(s.Sc.TxSimContext, s.Sc.Contract.Name, stateKey)
+	return stateKey, value, prev, err
+}
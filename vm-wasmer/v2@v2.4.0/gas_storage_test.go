@@ -0,0 +1,156 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"testing"
+
+	"chainmaker.org/chainmaker/common/v2/serialize"
+	logger2 "chainmaker.org/chainmaker/logger/v2"
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"chainmaker.org/chainmaker/protocol/v2"
+	"chainmaker.org/chainmaker/vm/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func stateRequest(key, field string, value []byte) []byte {
+	ec := serialize.NewEasyCodec()
+	ec.AddString("key", key)
+	ec.AddString("field", field)
+	ec.AddBytes("value", value)
+	return ec.Marshal()
+}
+
+func TestStateRefund(t *testing.T) {
+	txSimContext := prepareTxSimContext(ChainId, blockVersionSyscallGas, "contract1", "invoke", nil, SnapshotMock{})
+	m := &gasMeter{txSimContext: txSimContext, refundCap: 20}
+
+	// the refunds are capped at a percent of the gas of the tx, and taken once
+	vm.AddGasRefund(txSimContext, 150)
+	assert.Equal(t, uint64(400), m.settleRefund(500, true))
+	assert.Equal(t, uint64(500), m.settleRefund(500, true))
+	vm.AddGasRefund(txSimContext, 150)
+	assert.Equal(t, uint64(850), m.settleRefund(1000, true))
+
+	// the refunds of a failed tx are dropped
+	vm.AddGasRefund(txSimContext, 150)
+	assert.Equal(t, uint64(1000), m.settleRefund(1000, false))
+	assert.Equal(t, uint64(1000), m.settleRefund(1000, true))
+
+	// no overflow
+	m.refundCap = 50
+	vm.AddGasRefund(txSimContext, ^uint64(0))
+	assert.Equal(t, ^uint64(0)/2+1, m.settleRefund(^uint64(0), true))
+
+	// a charged tx is given the refund back, the gas it reports is what it was charged
+	txSimContext.GetTx().Payload.Limit = &commonPb.Limit{GasLimit: 1000}
+	vm.RefundGas(txSimContext, 1000)
+	m = &gasMeter{txSimContext: txSimContext, charged: txCharged(txSimContext), refundCap: 20}
+	assert.True(t, m.charged)
+	assert.Nil(t, txSimContext.SubtractGas(500))
+	vm.AddGasRefund(txSimContext, 50)
+	assert.Equal(t, uint64(450), m.settleRefund(500, true))
+	assert.Equal(t, uint64(1000-450), txSimContext.GetGasRemaining())
+}
+
+func TestStatePricing(t *testing.T) {
+	vmPool, instances := prepareMeteredInstances(t, 1)
+	defer vmPool.close()
+	defer vmPool.RevertInstance(instances[0])
+	instance := instances[0].wasmInstance
+
+	schedule := baseGasSchedule()
+	schedule.StateByteCost = 20
+	schedule.StateRewriteByteCost = 5
+	schedule.StateRefundByteCost = 10
+	schedule.StateRefundCapPercent = 50
+
+	txSimContext := prepareTxSimContext(ChainId, BlockVersion, "contract1", "invoke", nil, SnapshotMock{})
+	s := &WaciInstance{Sc: &SimContext{
+		TxSimContext:   txSimContext,
+		Contract:       &commonPb.Contract{Name: "contract1"},
+		ContractResult: &commonPb.ContractResult{},
+		Log:            logger2.GetLogger("unit_test"),
+		gas:            newGasMeter(txSimContext, instance, 0, schedule),
+	}}
+	used := func() uint64 { return protocol.GasLimit - instance.GetGasRemaining() }
+	n := uint64(len(protocol.GetKeyStr("key", "field")))
+
+	// a new key is charged by its size
+	s.RequestBody = stateRequest("key", "field", []byte("value"))
+	assert.Equal(t, protocol.ContractSdkSignalResultSuccess, s.PutState())
+	assert.Equal(t, (n+5)*20, used())
+
+	// a key holding a value is rewritten at the cheaper cost
+	s.RequestBody = stateRequest("key", "field", []byte("v2"))
+	assert.Equal(t, protocol.ContractSdkSignalResultSuccess, s.PutState())
+	assert.Equal(t, (n+5)*20+(n+2)*5, used())
+
+	// deleting it refunds the bytes it held
+	s.RequestBody = stateRequest("key", "field", nil)
+	assert.Equal(t, protocol.ContractSdkSignalResultSuccess, s.DeleteState())
+	assert.Equal(t, (n+2)*10, vm.TakeGasRefund(txSimContext))
+	// deleting a key holding no value refunds nothing
+	assert.Equal(t, protocol.ContractSdkSignalResultSuccess, s.DeleteState())
+	s.RequestBody = stateRequest("other", "", nil)
+	assert.Equal(t, protocol.ContractSdkSignalResultSuccess, s.DeleteState())
+	assert.Equal(t, uint64(0), vm.TakeGasRefund(txSimContext))
+	assert.Equal(t, (n+5)*20+(n+2)*5, used())
+
+	// a deleted key is written again at the full cost
+	s.RequestBody = stateRequest("key", "field", []byte("v3"))
+	assert.Equal(t, protocol.ContractSdkSignalResultSuccess, s.PutState())
+	assert.Equal(t, (n+5)*20+(n+2)*5+(n+2)*20, used())
+
+	// running out of gas
+	s.Sc.gas = newGasMeter(txSimContext, instance, protocol.GasLimit-10, schedule)
+	assert.Equal(t, protocol.ContractSdkSignalResultFail, s.PutState())
+	assert.Contains(t, s.Sc.ContractResult.Message, "out of gas")
+}
+
+func TestStatePricingBlindWrite(t *testing.T) {
+	vmPool, instances := prepareMeteredInstances(t, 1)
+	defer vmPool.close()
+	defer vmPool.RevertInstance(instances[0])
+	instance := instances[0].wasmInstance
+
+	schedule := baseGasSchedule()
+	schedule.StateByteCost = 20
+	schedule.StateRewriteByteCost = 5
+	schedule.StateRefundByteCost = 10
+
+	// the keys were committed by earlier blocks, the tx has never read them
+	stateKey := protocol.GetKeyStr("key", "field")
+	otherKey := protocol.GetKeyStr("other", "")
+	snapshot := SnapshotMock{cache: map[string][]byte{
+		"0-contract1-" + string(stateKey): []byte("committed"),
+		"0-contract1-" + string(otherKey): []byte("committed"),
+	}}
+	txSimContext := prepareTxSimContext(ChainId, BlockVersion, "contract1", "invoke", nil, snapshot)
+	s := &WaciInstance{Sc: &SimContext{
+		TxSimContext:   txSimContext,
+		Contract:       &commonPb.Contract{Name: "contract1"},
+		ContractResult: &commonPb.ContractResult{},
+		Log:            logger2.GetLogger("unit_test"),
+		gas:            newGasMeter(txSimContext, instance, 0, schedule),
+	}}
+	used := func() uint64 { return protocol.GasLimit - instance.GetGasRemaining() }
+
+	// a blind delete of a committed key refunds the bytes it held
+	s.RequestBody = stateRequest("key", "field", nil)
+	assert.Equal(t, protocol.ContractSdkSignalResultSuccess, s.DeleteState())
+	assert.Equal(t, uint64(len(stateKey)+9)*10, vm.TakeGasRefund(txSimContext))
+
+	// a blind put on a committed key is rewritten at the cheaper cost
+	s.RequestBody = stateRequest("other", "", []byte("v2"))
+	assert.Equal(t, protocol.ContractSdkSignalResultSuccess, s.PutState())
+	assert.Equal(t, uint64(len(otherKey)+2)*5, used())
+
+	// the lookups are not recorded as reads of the tx
+	assert.Equal(t, 0, len(txSimContext.GetTxRWSet(true).TxReads))
+}
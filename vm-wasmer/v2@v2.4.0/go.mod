@@ -12,7 +12,7 @@ require (
 	chainmaker.org/chainmaker/protocol/v2 v2.4.0
 	chainmaker.org/chainmaker/store/v2 v2.4.0
 	chainmaker.org/chainmaker/utils/v2 v2.4.0
-	chainmaker.org/chainmaker/vm/v2 v2.4.0
+	chainmaker.org/chainmaker/vm/v2 v2.4.1
 	github.com/stretchr/testify v1.10.0
 )
 
@@ -120,3 +120,4 @@ require (
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
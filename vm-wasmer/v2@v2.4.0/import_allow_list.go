@@ -0,0 +1,110 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+)
+
+// blockVersionImportAllowList from this block version on, the imports of a contract are checked against
+// the allow list of its runtime type when it is deployed or upgraded
+const blockVersionImportAllowList uint32 = 2050000
+
+// importAllowList the imports a contract may have, per runtime type, active from blockVersion on
+type importAllowList struct {
+	blockVersion uint32
+	// runtime type -> namespace -> names
+	runtimes map[commonPb.RuntimeType]map[string][]string
+}
+
+var (
+	// the syscalls of the contract sdk
+	envImports = []string{"sys_call", "log_message", "log_message_with_type"}
+	// WASI of Go (GOOS=wasip1) and TinyGo, emulated by the sandbox,
+	// filesystem, sockets and stdin fail with ENOSYS and are left out
+	wasiPreview1Imports = []string{
+		"args_get", "args_sizes_get", "environ_get", "environ_sizes_get",
+		"clock_res_get", "clock_time_get", "random_get", "poll_oneoff", "sched_yield", "proc_exit",
+		"fd_write", "fd_close", "fd_fdstat_get", "fd_fdstat_set_flags", "fd_prestat_get", "fd_prestat_dir_name",
+	}
+	// the empty wasi_unstable interface of the bridge
+	wasiUnstableImports = []string{"fd_read", "fd_write", "fd_close", "fd_seek"}
+)
+
+// importAllowLists sorted by block version, add a new list to change what is allowed from a block version on,
+// never change a released one
+var importAllowLists = []*importAllowList{
+	{
+		blockVersion: blockVersionImportAllowList,
+		runtimes: map[commonPb.RuntimeType]map[string][]string{
+			// rust, c and go contracts all run on wasmer, see SimContext.CallMethod
+			commonPb.RuntimeType_WASMER: {
+				"env":                envImports,
+				wasiSnapshotPreview1: wasiPreview1Imports,
+				wasiUnstable:         wasiUnstableImports,
+			},
+			commonPb.RuntimeType_GASM: {
+				"env":                envImports,
+				wasiSnapshotPreview1: wasiPreview1Imports,
+			},
+		},
+	},
+}
+
+// selectImportAllowList return the allow list active at the block version, nil if imports are not checked yet
+func selectImportAllowList(blockVersion uint32) *importAllowList {
+	i := sort.Search(len(importAllowLists), func(i int) bool {
+		return importAllowLists[i].blockVersion > blockVersion
+	})
+	if i == 0 {
+		return nil
+	}
+	return importAllowLists[i-1]
+}
+
+// forbidden return the imports not allowed for the runtime type, as namespace.name, sorted
+func (l *importAllowList) forbidden(runtimeType commonPb.RuntimeType, imports []*wasmergo.ImportType) []string {
+	allowed := l.runtimes[runtimeType]
+	var forbidden []string
+	for _, importType := range imports {
+		namespace, name := importType.Module(), importType.Name()
+		ok := false
+		for _, n := range allowed[namespace] {
+			if n == name {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			forbidden = append(forbidden, namespace+"."+name)
+		}
+	}
+	sort.Strings(forbidden)
+	return forbidden
+}
+
+// check reject the module if it imports anything the allow list does not allow, a nil list allows everything
+func (l *importAllowList) check(contract *commonPb.Contract, module *wasmergo.Module) error {
+	if l == nil {
+		return nil
+	}
+	if _, ok := l.runtimes[contract.RuntimeType]; !ok {
+		return fmt.Errorf("[%s_%s] no import allow list of runtime type %s", contract.Name, contract.Version,
+			contract.RuntimeType)
+	}
+	if forbidden := l.forbidden(contract.RuntimeType, module.Imports()); len(forbidden) > 0 {
+		return fmt.Errorf("[%s_%s] forbidden imports of runtime type %s: %s", contract.Name, contract.Version,
+			contract.RuntimeType, strings.Join(forbidden, ", "))
+	}
+	return nil
+}
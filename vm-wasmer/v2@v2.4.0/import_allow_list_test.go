@@ -0,0 +1,115 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"testing"
+
+	logger2 "chainmaker.org/chainmaker/logger/v2"
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const forbiddenImportsWat = `(module
+  (import "env" "sys_call" (func (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "path_open"
+    (func (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "sock_accept" (func (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1))`
+
+// forbiddenReactorWat a reactor with a forbidden import, whose _initialize traps
+const forbiddenReactorWat = `(module
+  (import "wasi_snapshot_preview1" "sock_accept" (func (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "_initialize")
+    (unreachable)))`
+
+func TestSelectImportAllowList(t *testing.T) {
+	assert.Nil(t, selectImportAllowList(blockVersionImportAllowList-1))
+	assert.Equal(t, importAllowLists[0], selectImportAllowList(blockVersionImportAllowList))
+	assert.Equal(t, importAllowLists[len(importAllowLists)-1], selectImportAllowList(^uint32(0)))
+}
+
+func TestNewRuntimeInstanceImportAllowList(t *testing.T) {
+	forbiddenBytes, err := wasmergo.Wat2Wasm(forbiddenImportsWat)
+	assert.Nil(t, err)
+	manager, err := NewInstancesManager(ChainId, nil)
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+
+	cases := []struct {
+		file        string
+		byteCode    []byte
+		runtimeType commonPb.RuntimeType
+		forbidden   string
+	}{
+		{file: "rust-counter-2.0.0.wasm", runtimeType: commonPb.RuntimeType_WASMER},
+		{file: "fact-go.wasm", runtimeType: commonPb.RuntimeType_WASMER},
+		{file: "fact-go.wasm", runtimeType: commonPb.RuntimeType_GASM},
+		{file: "compute-tinygo.wasm", runtimeType: commonPb.RuntimeType_GASM},
+		// the natives are not served by the bridge
+		{file: "compute-modify-go.wasm", runtimeType: commonPb.RuntimeType_WASMER,
+			forbidden: "env.native_BigExp, env.native_sha"},
+		{file: "forbidden", byteCode: forbiddenBytes, runtimeType: commonPb.RuntimeType_WASMER,
+			forbidden: "wasi_snapshot_preview1.path_open, wasi_snapshot_preview1.sock_accept"},
+		{file: "rust-counter-2.0.0.wasm", runtimeType: commonPb.RuntimeType_EVM,
+			forbidden: "no import allow list of runtime type EVM"},
+	}
+	for i, c := range cases {
+		byteCode, contractId, logger := c.byteCode, commonPb.Contract{}, logger2.GetLogger("unit_test")
+		if byteCode == nil {
+			byteCode, contractId, logger = prepareContract("./testdata/"+c.file, t)
+		}
+		contractId.Name, contractId.Version, contractId.RuntimeType = c.file, "1.0.0", c.runtimeType
+
+		// only checked when the contract is deployed or upgraded, from blockVersionImportAllowList on
+		for _, method := range []string{InitContractFunc, UpgradeContractFunc, "invoke"} {
+			for _, blockVersion := range []uint32{blockVersionImportAllowList - 1, blockVersionImportAllowList} {
+				txSimContext := newGasTxSimContext(blockVersion, 0)
+				_, err = manager.NewRuntimeInstance(txSimContext, ChainId, method, "", &contractId, byteCode, logger)
+				if c.forbidden == "" || method == "invoke" || blockVersion < blockVersionImportAllowList {
+					assert.Nil(t, err, "case %d %s %s %d", i, c.file, method, blockVersion)
+				} else if assert.NotNil(t, err, "case %d %s %s", i, c.file, method) {
+					assert.Contains(t, err.Error(), c.forbidden)
+				}
+			}
+		}
+	}
+}
+
+func TestNewVmPoolImportAllowList(t *testing.T) {
+	wasm, err := wasmergo.Wat2Wasm(forbiddenReactorWat)
+	assert.Nil(t, err)
+	contractId := &commonPb.Contract{Name: "forbidden-reactor", Version: "1.0.0",
+		RuntimeType: commonPb.RuntimeType_WASMER}
+	logger := logger2.GetLogger("unit_test")
+
+	// the module is rejected before it is instantiated, _initialize never runs
+	_, err = newVmPool(contractId, wasm, DefaultPoolConfig(), nil, nil,
+		selectImportAllowList(blockVersionImportAllowList), logger)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "forbidden imports of runtime type WASMER: wasi_snapshot_preview1.sock_accept")
+		assert.NotContains(t, err.Error(), wasiInitializeFunc)
+	}
+
+	// without the allow list it is instantiated, and _initialize traps
+	_, err = newVmPool(contractId, wasm, DefaultPoolConfig(), nil, nil, nil, logger)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), wasiInitializeFunc)
+	}
+
+	// the rejected pool of a deployment is never published
+	manager, err := NewInstancesManager(ChainId, nil)
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+	txSimContext := newGasTxSimContext(blockVersionImportAllowList, 0)
+	_, err = manager.NewRuntimeInstance(txSimContext, ChainId, InitContractFunc, "", contractId, wasm, logger)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(manager.instanceMap))
+}
@@ -66,10 +66,24 @@ func fillingBaseParams(parameters map[string][]byte) {
 
 type SnapshotMock struct {
 	cache map[string][]byte
+	// the chain config of the block, nil if the test needs none
+	chainConfig *config.ChainConfig
+}
+
+// unitGasSchedules every opcode and every byte copied costs 1, see chainConfigKeyGasSchedules
+const unitGasSchedules = `[{"block_version": 0, "default_cost": 1, "copy_byte_cost": 1}]`
+
+// gasSchedulesChainConfig a chain config governing the gas schedules
+func gasSchedulesChainConfig(schedules string) *config.ChainConfig {
+	return &config.ChainConfig{
+		Consensus: &config.ConsensusConfig{
+			ExtConfig: []*config.ConfigKeyValue{{Key: chainConfigKeyGasSchedules, Value: schedules}},
+		},
+	}
 }
 
 func (s SnapshotMock) GetBlockFingerprint() string {
-	panic("implement me")
+	return ""
 }
 
 func (s SnapshotMock) GetKeys(txExecSeq int, keys []*vmPb.BatchKey) ([]*vmPb.BatchKey, error) {
@@ -89,7 +103,7 @@ func (s SnapshotMock) GetSpecialTxTable() []*commonPb.Transaction {
 }
 
 func (s SnapshotMock) GetBlockTimestamp() int64 {
-	panic("implement me")
+	return 0
 }
 
 func (s SnapshotMock) ApplyTxSimContext(context protocol.TxSimContext, txType protocol.ExecOrderTxType,
@@ -102,7 +116,7 @@ func (s SnapshotMock) GetBlockchainStore() protocol.BlockchainStore {
 }
 
 func (s SnapshotMock) GetLastChainConfig() *config.ChainConfig {
-	panic("implement me")
+	return s.chainConfig
 }
 
 func (s SnapshotMock) GetKey(txExecSeq int, contractName string, key []byte) ([]byte, error) {
@@ -160,7 +174,10 @@ func prepareTxSimContext(
 
 	// 构建 instanceMgrMap
 	instanceMgrMap := make(map[commonPb.RuntimeType]protocol.VmInstancesManager)
-	wasmerVmPoolManager := NewInstancesManager(chainId)
+	wasmerVmPoolManager, err := NewInstancesManager(chainId, nil)
+	if err != nil {
+		panic(err)
+	}
 	instanceMgrMap[commonPb.RuntimeType_WASMER] = wasmerVmPoolManager
 
 	// 构建 chainConfig
@@ -0,0 +1,257 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"chainmaker.org/chainmaker/logger/v2"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+)
+
+const (
+	// config key of the module cache directory, empty means the cache is disabled
+	configKeyModuleCacheDir = "module_cache_dir"
+
+	moduleCacheFileExt = ".wasmer"
+	// bump it when the artifact file layout changes
+	moduleCacheFormatVersion = uint32(1)
+)
+
+var moduleCacheMagic = []byte("CMWASMER")
+
+// artifact file layout:
+// magic(8) | format version(4) | key digest(32) | payload length(8) | payload sha256(32) | payload
+const moduleCacheHeaderSize = 8 + 4 + sha256.Size + 8 + sha256.Size
+
+var errModuleCacheMiss = errors.New("module cache miss")
+
+// moduleCacheKey identifies a compiled artifact, a serialized module can only be reused
+// by the same wasmer runtime, with the same compiler settings, on the same target, and
+// with the same metering table (the metering middleware is compiled into the artifact)
+type moduleCacheKey struct {
+	codeHash     [sha256.Size]byte
+	engine       string
+	target       string
+	meteringHash [sha256.Size]byte
+}
+
+// newModuleCacheKey build the cache key of the byte code compiled by the given engine settings
+func newModuleCacheKey(byteCode []byte, engine string, meteringLimit uint64,
+	meteringTable map[wasmergo.Opcode]uint32) moduleCacheKey {
+	return moduleCacheKey{
+		codeHash:     sha256.Sum256(byteCode),
+		engine:       engine,
+		target:       runtime.GOOS + "-" + runtime.GOARCH,
+		meteringHash: meteringTableHash(meteringLimit, meteringTable),
+	}
+}
+
+// meteringTableHash hash the metering table in opcode order so that equal tables produce equal hashes
+func meteringTableHash(limit uint64, table map[wasmergo.Opcode]uint32) [sha256.Size]byte {
+	opcodes := make([]int, 0, len(table))
+	for op := range table {
+		opcodes = append(opcodes, int(op))
+	}
+	sort.Ints(opcodes)
+
+	buf := make([]byte, 8, 8+len(opcodes)*8)
+	binary.BigEndian.PutUint64(buf, limit)
+	for _, op := range opcodes {
+		var item [8]byte
+		binary.BigEndian.PutUint32(item[:4], uint32(op))
+		binary.BigEndian.PutUint32(item[4:], table[wasmergo.Opcode(op)])
+		buf = append(buf, item[:]...)
+	}
+	return sha256.Sum256(buf)
+}
+
+// digest the hash of all key fields, it is both the file name and a header field of the artifact
+func (k moduleCacheKey) digest() [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(k.codeHash[:])
+	h.Write([]byte(k.engine))
+	h.Write([]byte{0})
+	h.Write([]byte(k.target))
+	h.Write([]byte{0})
+	h.Write(k.meteringHash[:])
+	var d [sha256.Size]byte
+	copy(d[:], h.Sum(nil))
+	return d
+}
+
+// moduleCache persists compiled modules on disk, so that restarting a node
+// does not have to compile every contract again
+type moduleCache struct {
+	dir string
+	log *logger.CMLogger
+}
+
+// newModuleCache return nil if dir is empty, a nil cache is valid and always misses
+func newModuleCache(dir string, log *logger.CMLogger) (*moduleCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("create module cache dir %s failed, %v", dir, err)
+	}
+	return &moduleCache{
+		dir: dir,
+		log: log,
+	}, nil
+}
+
+func (c *moduleCache) path(key moduleCacheKey) string {
+	d := key.digest()
+	return filepath.Join(c.dir, hex.EncodeToString(d[:])+moduleCacheFileExt)
+}
+
+// loadModule deserialize the cached artifact of key,
+// a corrupted or mismatched artifact is removed and errModuleCacheMiss is returned
+func (c *moduleCache) loadModule(store *wasmergo.Store, key moduleCacheKey) (*wasmergo.Module, error) {
+	if c == nil {
+		return nil, errModuleCacheMiss
+	}
+	payload, err := c.get(key)
+	if err != nil {
+		return nil, err
+	}
+	module, err := wasmergo.DeserializeModule(store, payload)
+	if err != nil {
+		c.log.Warnf("deserialize cached module %s failed, drop it, %v", c.path(key), err)
+		c.remove(key)
+		return nil, errModuleCacheMiss
+	}
+	return module, nil
+}
+
+// storeArtifact write the serialized module into cache, failures are only logged
+func (c *moduleCache) storeArtifact(key moduleCacheKey, payload []byte) {
+	if c == nil {
+		return
+	}
+	if err := c.put(key, payload); err != nil {
+		c.log.Warnf("write module cache failed, %v", err)
+	}
+}
+
+// get read and validate the artifact payload of key
+func (c *moduleCache) get(key moduleCacheKey) ([]byte, error) {
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.log.Warnf("read module cache %s failed, %v", path, err)
+		}
+		return nil, errModuleCacheMiss
+	}
+
+	payload, err := decodeModuleArtifact(data, key)
+	if err != nil {
+		c.log.Warnf("invalid module cache %s, drop it, %v", path, err)
+		c.remove(key)
+		return nil, errModuleCacheMiss
+	}
+	return payload, nil
+}
+
+// put write the artifact into a temp file then rename it, so that readers never see a partial file
+func (c *moduleCache) put(key moduleCacheKey, payload []byte) error {
+	tmp, err := os.CreateTemp(c.dir, "tmp-*"+moduleCacheFileExt)
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err = tmp.Write(encodeModuleArtifact(payload, key)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, c.path(key))
+}
+
+func (c *moduleCache) remove(key moduleCacheKey) {
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		c.log.Warnf("remove module cache failed, %v", err)
+	}
+}
+
+func encodeModuleArtifact(payload []byte, key moduleCacheKey) []byte {
+	digest := key.digest()
+	checksum := sha256.Sum256(payload)
+
+	data := make([]byte, 0, moduleCacheHeaderSize+len(payload))
+	data = append(data, moduleCacheMagic...)
+	data = appendUint32(data, moduleCacheFormatVersion)
+	data = append(data, digest[:]...)
+	data = appendUint64(data, uint64(len(payload)))
+	data = append(data, checksum[:]...)
+	return append(data, payload...)
+}
+
+func decodeModuleArtifact(data []byte, key moduleCacheKey) ([]byte, error) {
+	if len(data) < moduleCacheHeaderSize {
+		return nil, fmt.Errorf("artifact too short, %d bytes", len(data))
+	}
+	if !bytes.Equal(data[:8], moduleCacheMagic) {
+		return nil, errors.New("bad magic")
+	}
+	data = data[8:]
+
+	if version := binary.BigEndian.Uint32(data[:4]); version != moduleCacheFormatVersion {
+		return nil, fmt.Errorf("format version %d, expect %d", version, moduleCacheFormatVersion)
+	}
+	data = data[4:]
+
+	digest := key.digest()
+	if !bytes.Equal(data[:sha256.Size], digest[:]) {
+		return nil, errors.New("key mismatch")
+	}
+	data = data[sha256.Size:]
+
+	length := binary.BigEndian.Uint64(data[:8])
+	data = data[8:]
+	checksum := data[:sha256.Size]
+	payload := data[sha256.Size:]
+	if uint64(len(payload)) != length {
+		return nil, fmt.Errorf("payload length %d, expect %d", len(payload), length)
+	}
+	if sum := sha256.Sum256(payload); !bytes.Equal(sum[:], checksum) {
+		return nil, errors.New("payload checksum mismatch")
+	}
+	return payload, nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"os"
+	"testing"
+
+	"chainmaker.org/chainmaker/logger/v2"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModuleCachePutGet(t *testing.T) {
+	cache, err := newModuleCache(t.TempDir(), logger.GetLogger(logger.MODULE_VM))
+	assert.Nil(t, err)
+
+	key := newModuleCacheKey([]byte("byte code"), "engine", 100, map[wasmergo.Opcode]uint32{wasmergo.I32Add: 1})
+	_, err = cache.get(key)
+	assert.Equal(t, errModuleCacheMiss, err)
+
+	payload := []byte("compiled artifact")
+	assert.Nil(t, cache.put(key, payload))
+	got, err := cache.get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, got)
+
+	// a different metering table must not hit the artifact
+	otherKey := newModuleCacheKey([]byte("byte code"), "engine", 100, map[wasmergo.Opcode]uint32{wasmergo.I32Add: 2})
+	_, err = cache.get(otherKey)
+	assert.Equal(t, errModuleCacheMiss, err)
+
+	// corrupt the payload, the artifact should be dropped
+	path := cache.path(key)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0600))
+	_, err = cache.get(key)
+	assert.Equal(t, errModuleCacheMiss, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestModuleCacheKeyMismatch(t *testing.T) {
+	key := newModuleCacheKey([]byte("a"), "engine", 100, nil)
+	other := newModuleCacheKey([]byte("b"), "engine", 100, nil)
+
+	_, err := decodeModuleArtifact(encodeModuleArtifact([]byte("payload"), key), other)
+	assert.NotNil(t, err)
+
+	_, err = decodeModuleArtifact([]byte("short"), key)
+	assert.NotNil(t, err)
+}
+
+func TestNewVmPoolWithModuleCache(t *testing.T) {
+	wasmBytes, contractId, log := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+
+	cache, err := newModuleCache(t.TempDir(), log)
+	assert.Nil(t, err)
+
+	// first build compiles and writes the artifact
+	pool, err := newVmPool(&contractId, wasmBytes, DefaultPoolConfig(), nil, cache, nil, log)
+	assert.Nil(t, err)
+	pool.close()
+
+	key := defaultEngineSettings().cacheKey(wasmBytes)
+	_, err = os.Stat(cache.path(key))
+	assert.Nil(t, err)
+
+	// second build loads the artifact
+	pool, err = newVmPool(&contractId, wasmBytes, DefaultPoolConfig(), nil, cache, nil, log)
+	assert.Nil(t, err)
+	defer pool.close()
+
+	instance, err := pool.NewInstance()
+	assert.Nil(t, err)
+	pool.CloseInstance(instance)
+}
@@ -12,7 +12,10 @@ import (
 	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
 	"chainmaker.org/chainmaker/protocol/v2"
 	"chainmaker.org/chainmaker/utils/v2"
+	"chainmaker.org/chainmaker/vm/v2"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +32,15 @@ type RuntimeInstance struct {
 	log              *logger.CMLogger
 	chainId          string
 	instancesManager *InstancesManager
+	// status code of the last failed invoke, CONTRACT_FAIL unless the runtime knows better
+	statusCode commonPb.TxStatusCode
+	// invocations are profiled by it if it is not nil, see GasProfiler
+	profiler *GasProfiler
+}
+
+// SetGasProfiler profile the gas of the invocations, nil turns profiling off
+func (r *RuntimeInstance) SetGasProfiler(profiler *GasProfiler) {
+	r.profiler = profiler
 }
 
 // Pool comment at next version
@@ -37,6 +49,86 @@ func (r *RuntimeInstance) Pool() *vmPool {
 	return r.pool
 }
 
+// TxStatusCode return the tx status code of the last failed invoke
+func (r *RuntimeInstance) TxStatusCode() commonPb.TxStatusCode {
+	if r.statusCode == commonPb.TxStatusCode_SUCCESS {
+		return commonPb.TxStatusCode_CONTRACT_FAIL
+	}
+	return r.statusCode
+}
+
+// getInstance get an instance from the pool, wait no more than pool.config.AcquireTimeout
+func (r *RuntimeInstance) getInstance(pool *vmPool) (*wrappedInstance, error) {
+	ctx, cancel := pool.acquireContext()
+	defer cancel()
+	return pool.GetInstance(ctx)
+}
+
+// failGetInstance fill the contract result when no instance could be acquired,
+// an exhausted pool is reported as TIMEOUT so that it is not mistaken for a contract failure
+func (r *RuntimeInstance) failGetInstance(contractResult *commonPb.ContractResult, err error,
+	txContext protocol.TxSimContext) {
+	contractResult.Code = 1
+	contractResult.Message = fmt.Sprintf("contract invoke failed, get instance failed, %s, tx: %s",
+		err.Error(), txContext.GetTx().Payload.TxId)
+	if errors.Is(err, ErrPoolExhausted) {
+		r.statusCode = commonPb.TxStatusCode_TIMEOUT
+	}
+	r.log.Errorf(contractResult.Message)
+}
+
+// acquirePool retain the contract vm pool until pool.release is called,
+// the pool is rebuilt if it has been evicted or closed after the runtime instance was created
+func (r *RuntimeInstance) acquirePool(contract *commonPb.Contract, byteCode []byte,
+	schedule *GasSchedule) (*vmPool, error) {
+	pool := r.pool
+	for !pool.retain() {
+		if r.instancesManager == nil {
+			return nil, fmt.Errorf("[%s_%s] vm pool has been evicted or closed", contract.Name, contract.Version)
+		}
+		var err error
+		if pool, err = r.instancesManager.getVmPool(contract, byteCode, schedule, nil); err != nil {
+			return nil, err
+		}
+	}
+	r.pool = pool
+	return pool, nil
+}
+
+// acquireInvokePool retain the pool the invocation runs in, the instrumented pool of the profiler
+// if the runtime instance is profiled
+func (r *RuntimeInstance) acquireInvokePool(contract *commonPb.Contract, byteCode []byte,
+	schedule *GasSchedule) (*vmPool, *profiledModule, error) {
+	if r.profiler == nil {
+		pool, err := r.acquirePool(contract, byteCode, schedule)
+		return pool, nil, err
+	}
+	engines := defaultEngines
+	if r.instancesManager != nil {
+		engines = r.instancesManager.engines
+	}
+	return r.profiler.acquirePool(contract, byteCode, schedule, engines.get(schedule.settings))
+}
+
+// gasSchedule return the gas schedule of the chain config, active at the block version of the tx
+func (r *RuntimeInstance) gasSchedule(txContext protocol.TxSimContext) (*GasSchedule, error) {
+	if r.instancesManager == nil {
+		return baseGasSchedule(), nil
+	}
+	return r.instancesManager.gasSchedules.selectFor(txContext)
+}
+
+// settleGas settle the gas meter of the frame, an invoke running out of gas fails with TxStatusCodeOutOfGas
+func (r *RuntimeInstance) settleGas(sc *SimContext, err error) (uint64, error) {
+	gas, exhausted := sc.gas.finish()
+	if exhausted {
+		r.statusCode = TxStatusCodeOutOfGas
+		err = fmt.Errorf("contract invoke failed, out of gas %d/%d, tx: %s", gas, sc.gas.limit(),
+			sc.TxSimContext.GetTx().Payload.TxId)
+	}
+	return gas, err
+}
+
 // Invoke contract by call vm, implement protocol.RuntimeInstance
 func (r *RuntimeInstance) Invoke(contract *commonPb.Contract, method string, byteCode []byte,
 	parameters map[string][]byte, txContext protocol.TxSimContext, gasUsed uint64) (
@@ -46,6 +138,8 @@ func (r *RuntimeInstance) Invoke(contract *commonPb.Contract, method string, byt
 	logStr := fmt.Sprintf("wasmer runtime invoke[%s]: ", txContext.GetTx().Payload.TxId)
 	startTime := utils.CurrentTimeMillisSeconds()
 	blockVersion := txContext.GetBlockVersion()
+	// a runtime instance may invoke more than once, only the last failure is reported
+	r.statusCode = commonPb.TxStatusCode_SUCCESS
 
 	// set default return value
 	contractResult = &commonPb.ContractResult{
@@ -65,35 +159,65 @@ func (r *RuntimeInstance) Invoke(contract *commonPb.Contract, method string, byt
 			contractResult.Code = 1
 			contractResult.Message = fmt.Sprint(panicErr)
 			if instanceInfo != nil {
-				instanceInfo.errCount++
+				atomic.AddInt32(&instanceInfo.errCount, 1)
 			}
 			specialTxType = protocol.ExecOrderTxTypeNormal
 		}
 	}()
 
-	// if cross contract call, then new instance
-	if txContext.GetDepth() > 0 {
-		//var err error
-		//instanceInfo, err = r.pool.NewInstance()
-		//defer r.pool.CloseInstance(instanceInfo)
-		//if err != nil {
-		//	panic(err)
-		//}
+	schedule, err := r.gasSchedule(txContext)
+	if err != nil {
+		contractResult.Code = 1
+		contractResult.Message = fmt.Sprintf("contract invoke failed, %s, tx: %s", err.Error(),
+			txContext.GetTx().Payload.TxId)
+		r.log.Errorf(contractResult.Message)
+		return
+	}
+	pool, profiled, err := r.acquireInvokePool(contract, byteCode, schedule)
+	if err != nil {
+		contractResult.Code = 1
+		contractResult.Message = fmt.Sprintf("contract invoke failed, %s, tx: %s", err.Error(),
+			txContext.GetTx().Payload.TxId)
+		r.log.Errorf(contractResult.Message)
+		return
+	}
+	defer pool.release()
 
+	// a dry run never touches the pooled instances, see vm.IsGasEstimate
+	estimate := vm.IsGasEstimate(txContext)
+	// if cross contract call, the caller frames may hold every pooled instance of this contract
+	// (recursion, A->B->A), never wait for the pool, see vmPool.GetCrossCallInstance
+	if estimate {
+		instanceInfo, err = pool.GetEstimateInstance()
+	} else if txContext.GetDepth() > 0 {
 		r.log.Debugf("depth>0 before get instance for tx: %s", txContext.GetTx().Payload.TxId)
-		instanceInfo = r.pool.GetInstance()
+		instanceInfo, err = pool.GetCrossCallInstance()
 		r.log.Debugf("depth>0 after get instance for tx: %s", txContext.GetTx().Payload.TxId)
-		defer r.pool.RevertInstance(instanceInfo)
 	} else {
 		r.log.Debugf("before get instance for tx: %s", txContext.GetTx().Payload.TxId)
-		instanceInfo = r.pool.GetInstance()
+		instanceInfo, err = r.getInstance(pool)
 		r.log.Debugf("after get instance for tx: %s", txContext.GetTx().Payload.TxId)
-		defer r.pool.RevertInstance(instanceInfo)
+	}
+	if err != nil {
+		r.failGetInstance(contractResult, err, txContext)
+		return
+	}
+	if estimate {
+		defer pool.closeEphemeral(instanceInfo)
+	} else {
+		defer pool.RevertInstance(instanceInfo)
 	}
 
-	instance := instanceInfo.wasmInstance
-	instance.SetGasLimit(protocol.GasLimit - gasUsed)
+	// restore memory and globals left by the previous tx
+	if err = instanceInfo.restore(); err != nil {
+		contractResult.Code = 1
+		contractResult.Message = fmt.Sprintf("contract invoke failed, restore instance failed, %s, tx: %s",
+			err.Error(), txContext.GetTx().Payload.TxId)
+		r.log.Errorf(contractResult.Message)
+		return
+	}
 
+	instance := instanceInfo.wasmInstance
 	var sc = NewSimContext(method, r.log, r.chainId)
 	defer sc.removeCtxPointer()
 	sc.Contract = contract
@@ -102,8 +226,18 @@ func (r *RuntimeInstance) Invoke(contract *commonPb.Contract, method string, byt
 	sc.parameters = parameters
 	sc.Instance = instance
 	sc.SpecialTxType = protocol.ExecOrderTxTypeNormal
+	sc.gas = newGasMeter(txContext, instance, gasUsed, schedule)
+	sc.profile = r.profiler.newFrame(profiled, sc)
+	instanceInfo.env.bind(sc)
+	defer instanceInfo.env.unbind()
+	defer instanceInfo.env.reportOutput(sc)
 
-	err := sc.CallMethod(instance)
+	// an instance left in the middle of a call (trapped or panicked) is never reused
+	instanceInfo.discard = true
+	err = sc.CallMethod(instance)
+	exited, err := instanceInfo.env.exitResult(err)
+	// the runtime which exited is not usable any more, even with exit code 0
+	instanceInfo.discard = err != nil || exited
 	r.log.Debugf("contract invoke finished, tx:%s, call method err is %s",
 		txContext.GetTx().Payload.TxId, err)
 	if err != nil {
@@ -112,11 +246,9 @@ func (r *RuntimeInstance) Invoke(contract *commonPb.Contract, method string, byt
 	specialTxType = sc.SpecialTxType
 
 	// gas Log
-	gas := protocol.GasLimit - instance.GetGasRemaining()
-	if instance.GetGasRemaining() <= 0 {
-		err = fmt.Errorf("contract invoke failed, out of gas %d/%d, tx: %s", gas, int64(protocol.GasLimit),
-			txContext.GetTx().Payload.TxId)
-	}
+	gas, err := r.settleGas(sc, err)
+	gas = sc.profile.finish(instance, gas, sc.gas.exhausted)
+	gas = sc.gas.settleRefund(gas, err == nil && contractResult.Code == 0)
 	logStr += fmt.Sprintf("used gas %d ", gas)
 	contractResult.GasUsed = gas
 
@@ -125,17 +257,20 @@ func (r *RuntimeInstance) Invoke(contract *commonPb.Contract, method string, byt
 		msg := fmt.Sprintf("contract invoke failed, %s, tx: %s", err.Error(), txContext.GetTx().Payload.TxId)
 		r.log.Errorf(msg)
 		contractResult.Message = msg
+		if estimate {
+			return
+		}
 		if method == InitContractFunc && txContext.GetBlockVersion() >= 2201 {
 			r.instancesManager.CloseAVmPool(contract)
 		} else {
-			instanceInfo.errCount++
+			atomic.AddInt32(&instanceInfo.errCount, 1)
 		}
 		return
-	} else if blockVersion >= 2030100 && contractResult.Code != 0 {
+	} else if blockVersion >= 2030100 && contractResult.Code != 0 && !estimate {
 		if method == InitContractFunc || method == UpgradeContractFunc {
 			r.instancesManager.CloseAVmPool(contract)
 		} else {
-			instanceInfo.errCount++
+			atomic.AddInt32(&instanceInfo.errCount, 1)
 		}
 	}
 	contractResult.ContractEvent = sc.ContractEvent
@@ -143,114 +278,32 @@ func (r *RuntimeInstance) Invoke(contract *commonPb.Contract, method string, byt
 	return
 }
 
-// Invoke contract by call vm, implement protocol.RuntimeInstance
-func (r *RuntimeInstance) InvokeTime(contract *commonPb.Contract, method string, byteCode []byte,
-	parameters map[string][]byte, txContext protocol.TxSimContext, gasUsed uint64) (
-	contractResult *commonPb.ContractResult, specialTxType protocol.ExecOrderTxType, startTime, endTime int64, executionTime float64) {
-	//fmt.Println(txContext)
-	txId := txContext.GetTx().Payload.TxId
-	contractName := contract.Name
-	//r.log.Debugf("called invoke for tx:%s", txId)
-	logStr := fmt.Sprintf("wasmer runtime invoke[%s]: ", txContext.GetTx().Payload.TxId)
-	//startTime := utils.CurrentTimeMillisSeconds()
-	startTime = time.Now().UnixNano()
-	// set default return value
-	contractResult = &commonPb.ContractResult{
-		Code:    uint32(0),
-		Result:  nil,
-		Message: "",
-	}
-	specialTxType = protocol.ExecOrderTxTypeNormal
-
-	var instanceInfo *wrappedInstance
-	defer func() {
-		//endTime := utils.CurrentTimeMillisSeconds()
-		endTime = time.Now().UnixNano()
-		executionTime = float64(endTime-startTime) / 1e9
-
-		panicErr := recover()
-		if panicErr != nil {
-			contractResult.Code = 1
-			contractResult.Message = fmt.Sprint(panicErr)
-			if instanceInfo != nil {
-				instanceInfo.errCount++
-			}
-			specialTxType = protocol.ExecOrderTxTypeNormal
-		}
-		logStr = fmt.Sprintf("invoke vm, tx id:%s, contractName:%+v, contractMethod:%+v, runtimeContractResult:%d ,startTime:%d, endTime:%d, executionTime:%.6f s",
-			txId, contractName, method, contractResult.Code, startTime, endTime, executionTime)
-		r.log.Debugf(logStr)
-	}()
-
-	// if cross contract call, then new instance
-	if txContext.GetDepth() > 0 {
-		//var err error
-		//instanceInfo, err = r.pool.NewInstance()
-		//defer r.pool.CloseInstance(instanceInfo)
-		//if err != nil {
-		//	panic(err)
-		//}
-		//r.log.Debugf("before get instance for tx: %s", txContext.GetTx().Payload.TxId)
-		instanceInfo = r.pool.GetInstance()
-		//r.log.Debugf("after get instance for tx: %s", txContext.GetTx().Payload.TxId)
-		defer r.pool.RevertInstance(instanceInfo)
-	} else {
-		//r.log.Debugf("before get instance for tx: %s", txContext.GetTx().Payload.TxId)
-		instanceInfo = r.pool.GetInstance()
-		//r.log.Debugf("after get instance for tx: %s", txContext.GetTx().Payload.TxId)
-		defer r.pool.RevertInstance(instanceInfo)
-	}
-
-	instance := instanceInfo.wasmInstance
-	gasLimit := uint64(1e15)
-	r.log.Debugf("gasLimit:%d", gasLimit-gasUsed)
-	instance.SetGasLimit(gasLimit - gasUsed)
-	//instance.SetGasLimit(1e15 - gasUsed)
-	var sc = NewSimContext(method, r.log, r.chainId)
-	defer sc.removeCtxPointer()
-	sc.Contract = contract
-	sc.TxSimContext = txContext
-	sc.ContractResult = contractResult
-	sc.parameters = parameters
-	sc.Instance = instance
-	sc.SpecialTxType = protocol.ExecOrderTxTypeNormal
-
-	err := sc.CallMethod(instance)
-
-	//r.log.Infof("contract invoke finished, tx:%s, call method err is %s",
-	//	txContext.GetTx().Payload.TxId, err)
+// EstimateGas dry run the method as the tx of txContext with an effectively unlimited gas limit,
+// see vm.NewEstimateTxSimContext. Cross contract calls run in the same dry run,
+// txContext, the state and the vm pools are left unchanged
+func (r *RuntimeInstance) EstimateGas(contract *commonPb.Contract, method string, byteCode []byte,
+	parameters map[string][]byte, txContext protocol.TxSimContext) (*vm.GasEstimate, error) {
+	estimateContext, err := vm.NewEstimateTxSimContext(txContext)
 	if err != nil {
-		//r.log.Errorf("contract invoke failed, %s, tx: %s", err, txContext.GetTx().Payload.TxId)
+		return nil, err
 	}
-	specialTxType = sc.SpecialTxType
-
-	// gas Log
-	gas := gasLimit - instance.GetGasRemaining()
-	if instance.GetGasRemaining() <= 0 {
-		err = fmt.Errorf("contract invoke failed, out of gas %d/%d, tx: %s", gas, int64(protocol.GasLimit),
-			txContext.GetTx().Payload.TxId)
+	result, _ := r.Invoke(contract, method, byteCode, parameters, estimateContext, 0)
+	code := commonPb.TxStatusCode_SUCCESS
+	if result.Code != 0 {
+		code = r.TxStatusCode()
 	}
-	logStr += fmt.Sprintf("used gas %d ", gas)
-	contractResult.GasUsed = gas
+	return vm.NewGasEstimate(estimateContext, result, code), nil
+}
 
-	if err != nil {
-		contractResult.Code = 1
-		msg := fmt.Sprintf("contract invoke failed, %s, tx: %s", err.Error(), txContext.GetTx().Payload.TxId)
-		r.log.Debugf(msg)
-		contractResult.Message = msg
-		if method == "init_contract" && txContext.GetBlockVersion() >= 2201 {
-			r.instancesManager.CloseAVmPool(contract)
-		} else {
-			instanceInfo.errCount++
-		}
-		return
-	}
-	contractResult.ContractEvent = sc.ContractEvent
-	contractResult.GasUsed = gas
-	exportMemory, err := instance.Exports.GetMemory("memory")
-	if err != nil {
-		return
-	}
-	r.log.Debugf("instance id: %s, gas used:%d, exportMemory datasize %d字节 %d页", instanceInfo.id, gas, exportMemory.DataSize(), exportMemory.Size())
+// InvokeTime invoke the contract as Invoke does, and report how long the invocation took
+func (r *RuntimeInstance) InvokeTime(contract *commonPb.Contract, method string, byteCode []byte,
+	parameters map[string][]byte, txContext protocol.TxSimContext, gasUsed uint64) (
+	contractResult *commonPb.ContractResult, specialTxType protocol.ExecOrderTxType, startTime, endTime int64, executionTime float64) {
+	startTime = time.Now().UnixNano()
+	contractResult, specialTxType = r.Invoke(contract, method, byteCode, parameters, txContext, gasUsed)
+	endTime = time.Now().UnixNano()
+	executionTime = float64(endTime-startTime) / 1e9
+	r.log.Debugf("invoke vm, tx id:%s, contractName:%+v, contractMethod:%+v, runtimeContractResult:%d ,startTime:%d, endTime:%d, executionTime:%.6f s",
+		txContext.GetTx().Payload.TxId, contract.Name, method, contractResult.Code, startTime, endTime, executionTime)
 	return
 }
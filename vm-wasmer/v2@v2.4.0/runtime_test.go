@@ -352,7 +352,7 @@ func TestInvoke(t *testing.T) {
 	filePath := prepareFile(ContractName, contractType)
 
 	wasmBytes, contractId, logger := prepareContract(filePath, t)
-	vmPool, err := newVmPool(&contractId, wasmBytes, logger)
+	vmPool, err := newVmPool(&contractId, wasmBytes, DefaultPoolConfig(), nil, nil, nil, logger)
 	if err != nil {
 		t.Fatalf("create vmPool error: %v", err)
 	}
@@ -36,6 +36,9 @@ type SimContext struct {
 	ChainId            string
 	ContractEvent      []*commonPb.ContractEvent
 	SpecialTxType      protocol.ExecOrderTxType
+
+	gas     *gasMeter     // gas meter of the call frame
+	profile *frameProfile // gas profile of the call frame, nil if it is not profiled
 }
 
 // NewSimContext for every transaction
@@ -121,6 +124,10 @@ func (sc *SimContext) callContract(instance *wasmer.Instance, methodName string,
 		return fmt.Errorf("allocateResult is not int32 type")
 	}
 
+	if !sc.gas.chargeCopy(lengthOfSubject) {
+		return fmt.Errorf("out of gas, copy %d bytes of parameters", lengthOfSubject)
+	}
+
 	// Write the subject into the memory.
 	// 经测试instance.Exports.GetMemory("memory")并不会影响开销，应该只有Call的会影响
 	exportMemory, err := instance.Exports.GetMemory("memory")
@@ -135,8 +142,6 @@ func (sc *SimContext) callContract(instance *wasmer.Instance, methodName string,
 	}
 
 	// Calls the `invoke` exported function. Given the pointer to the subject.
-	gasLimit := uint64(1e15)
-	instance.SetGasLimit(gasLimit - 0)
 	exportFunc, err := instance.Exports.GetRawFunction(methodName)
 	if err != nil {
 		// add compatibility for wasmer-1.0
@@ -158,7 +163,7 @@ func (sc *SimContext) callContract(instance *wasmer.Instance, methodName string,
 
 // CallDeallocate deallocate vm memory before closing the instance
 func CallDeallocate(instance *wasmer.Instance) error {
-	// TODO 这里setgaslimit是否会影响gas计量？
+	// the instance is not running a tx any more, the gas of the next tx is set by its gasMeter
 	instance.SetGasLimit(protocol.GasLimit)
 	// TODO 这里deallocate，主要是因为原本做法参数是写在合约实例的全局变量，这里把合约实例的参数argsmap设置为空
 	deallocFunc, err := instance.Exports.GetFunction(protocol.ContractDeallocateMethod)
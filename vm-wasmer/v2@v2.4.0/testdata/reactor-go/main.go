@@ -0,0 +1,70 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// reactor-go is a contract built as a reactor, used by TestInvokeReactorGo.
+// It exports the methods of the contract ABI itself, a method which finds state left by an earlier tx
+// panics, so the trace of the panic is reported in the message of the result.
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -ldflags=-s -trimpath -o ../reactor-go.wasm .
+package main
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// runtimeTypeGasm the runtime type of the Go contracts, see commonPb.RuntimeType_GASM
+const runtimeTypeGasm = 4
+
+// booted is set by _initialize, the methods are never called before it
+var booted int32
+
+var counter int32
+
+// params the parameters of the call, written by the runtime after allocate
+var params []byte
+
+func init() {
+	booted++
+}
+
+//go:wasmexport runtime_type
+func runtimeType() int32 {
+	return runtimeTypeGasm
+}
+
+//go:wasmexport allocate
+func allocate(size int32) int32 {
+	params = make([]byte, size+1)
+	return int32(uintptr(unsafe.Pointer(&params[0])))
+}
+
+//go:wasmexport deallocate
+func deallocate(_ int32) {
+	params = nil
+}
+
+// increase count the calls, every tx must find the state _initialize left
+//
+//go:wasmexport increase
+func increase() {
+	counter++
+	fmt.Printf("increase booted %d counter %d\n", booted, counter)
+	if booted != 1 || counter != 1 {
+		panic(fmt.Sprintf("state leaked, booted %d counter %d", booted, counter))
+	}
+}
+
+// fail panic after it changed the state, the next tx must not see it
+//
+//go:wasmexport fail
+func fail() {
+	counter += 100
+	panic("fail called")
+}
+
+func main() {}
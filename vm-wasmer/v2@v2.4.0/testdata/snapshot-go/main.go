@@ -0,0 +1,34 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// snapshot-go keeps state in the Go runtime between calls, used by TestInstanceSnapshotGo.
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -ldflags=-s -trimpath -o ../snapshot-go.wasm .
+package main
+
+var counter int32
+
+var kept [][]byte
+
+// bump count the calls, and keep some heap allocated
+//
+//go:wasmexport bump
+func bump() int32 {
+	counter++
+	kept = append(kept, make([]byte, 1024))
+	return counter
+}
+
+// grow keep mb megabytes allocated, so that the heap grows the memory
+//
+//go:wasmexport grow
+func grow(mb int32) int32 {
+	kept = append(kept, make([]byte, int(mb)<<20))
+	return int32(len(kept))
+}
+
+func main() {}
@@ -47,6 +47,9 @@ type WaciInstance struct {
 
 // LogMessage print log to file
 func (s *WaciInstance) LogMessage() int32 {
+	if s.Sc.chargeGas() {
+		return wacsiWithGas.LogMessage(s.RequestBody, s.Sc.TxSimContext)
+	}
 	s.Sc.Log.Debugf("wasmer log>> [%s] %s", s.Sc.TxSimContext.GetTx().Payload.TxId, string(s.RequestBody))
 	return protocol.ContractSdkSignalResultSuccess
 }
@@ -55,6 +58,7 @@ func (s *WaciInstance) LogMessage() int32 {
 type CMEnvironment struct {
 	instance *wasmer.Instance
 	memory   *wasmer.Memory //新添加，wasmer实例整个内存的指针
+	wasi     wasiSandbox    // deterministic WASI state, see wasiSandbox
 }
 
 // nolint:gofmt
@@ -179,9 +183,13 @@ func sysCall(environment interface{}, args []wasmer.Value) ([]wasmer.Value, erro
 
 	log.Debugf("### enter syscall handling, method = '%v'", method)
 	var ret int32
+	simContext.gas.beforeSyscall()
+	simContext.profile.enterSyscall(simContext.gas)
 	if ret = waciInstance.invoke(method); ret == protocol.ContractSdkSignalResultFail {
 		log.Infof("invoke WaciInstance error: method = %v", method)
 	}
+	simContext.gas.afterSyscall()
+	simContext.profile.leaveSyscall(method, simContext.gas)
 
 	log.Debugf("### leave syscall handling, method = '%v'", method)
 
@@ -190,6 +198,19 @@ func sysCall(environment interface{}, args []wasmer.Value) ([]wasmer.Value, erro
 	}, nil
 }
 
+// chargeCopy charge the cached data copied into the linear memory by the calls which are not *Len,
+// return false if the contract ran out of gas
+func (s *WaciInstance) chargeCopy(isLen bool, data []byte) bool {
+	if isLen {
+		return true
+	}
+	if !s.Sc.gas.chargeCopy(len(data)) {
+		s.recordMsg("out of gas")
+		return false
+	}
+	return true
+}
+
 // nolint
 func (s *WaciInstance) invoke(method interface{}) int32 {
 	switch method.(string) {
@@ -290,11 +311,17 @@ func (s *WaciInstance) invoke(method interface{}) int32 {
 
 // SuccessResult record the results of contract execution success
 func (s *WaciInstance) SuccessResult() int32 {
+	if s.Sc.chargeGas() {
+		return wacsiWithGas.SuccessResult(s.Sc.ContractResult, s.Sc.TxSimContext, s.RequestBody)
+	}
 	return wacsi.SuccessResult(s.Sc.ContractResult, s.RequestBody)
 }
 
 // ErrorResult record the results of contract execution error
 func (s *WaciInstance) ErrorResult() int32 {
+	if s.Sc.chargeGas() {
+		return wacsiWithGas.ErrorResult(s.Sc.ContractResult, s.Sc.TxSimContext, s.RequestBody)
+	}
 	return wacsi.ErrorResult(s.Sc.ContractResult, s.RequestBody)
 }
 
@@ -309,9 +336,12 @@ func (s *WaciInstance) CallContract() int32 {
 }
 
 func (s *WaciInstance) callContractCore(isLen bool) int32 {
-	gasUsed := protocol.GasLimit - s.Sc.Instance.GetGasRemaining()
-	result, gas, specialTxType, err := wacsi.CallContract(s.Sc.Contract, s.RequestBody, s.Sc.TxSimContext, s.Memory,
-		s.Sc.GetStateCache, gasUsed, isLen)
+	if !s.chargeCopy(isLen, s.Sc.GetStateCache) {
+		return protocol.ContractSdkSignalResultFail
+	}
+	gasUsed := s.Sc.gas.used()
+	result, gas, specialTxType, err := s.sysWacsi().CallContract(s.Sc.Contract, s.RequestBody, s.Sc.TxSimContext,
+		s.Memory, s.Sc.GetStateCache, gasUsed, isLen)
 	if result == nil {
 		s.Sc.GetStateCache = nil // reset data
 		//s.Sc.ContractEvent = nil
@@ -320,7 +350,7 @@ func (s *WaciInstance) callContractCore(isLen bool) int32 {
 		s.Sc.ContractEvent = append(s.Sc.ContractEvent, result.ContractEvent...)
 	}
 	s.Sc.SpecialTxType = specialTxType
-	s.Sc.Instance.SetGasLimit(protocol.GasLimit - gas)
+	s.Sc.gas.afterCall(gas)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -330,7 +360,7 @@ func (s *WaciInstance) callContractCore(isLen bool) int32 {
 
 // EmitEvent emit event to chain
 func (s *WaciInstance) EmitEvent() int32 {
-	contractEvent, err := wacsi.EmitEvent(s.RequestBody, s.Sc.TxSimContext, s.Sc.Contract, s.Sc.Log)
+	contractEvent, err := s.sysWacsi().EmitEvent(s.RequestBody, s.Sc.TxSimContext, s.Sc.Contract, s.Sc.Log)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -350,7 +380,17 @@ func (s *WaciInstance) GetBulletProofsResult() int32 {
 }
 
 func (s *WaciInstance) getBulletProofsResultCore(isLen bool) int32 {
-	data, err := wacsi.BulletProofsOperation(s.RequestBody, s.Memory, s.Sc.GetStateCache, isLen)
+	if !s.chargeCopy(isLen, s.Sc.GetStateCache) {
+		return protocol.ContractSdkSignalResultFail
+	}
+	var data []byte
+	var err error
+	if s.Sc.chargeGas() {
+		data, err = wacsiWithGas.BulletProofsOperation(s.RequestBody, s.Sc.TxSimContext, s.Memory,
+			s.Sc.GetStateCache, isLen)
+	} else {
+		data, err = wacsi.BulletProofsOperation(s.RequestBody, s.Memory, s.Sc.GetStateCache, isLen)
+	}
 	s.Sc.GetStateCache = data // reset data
 	if err != nil {
 		s.recordMsg(err.Error())
@@ -370,7 +410,17 @@ func (s *WaciInstance) GetPaillierResult() int32 {
 }
 
 func (s *WaciInstance) getPaillierResultCore(isLen bool) int32 {
-	data, err := wacsi.PaillierOperation(s.RequestBody, s.Memory, s.Sc.GetStateCache, isLen)
+	if !s.chargeCopy(isLen, s.Sc.GetStateCache) {
+		return protocol.ContractSdkSignalResultFail
+	}
+	var data []byte
+	var err error
+	if s.Sc.chargeGas() {
+		data, err = wacsiWithGas.PaillierOperation(s.RequestBody, s.Sc.TxSimContext, s.Memory,
+			s.Sc.GetStateCache, isLen)
+	} else {
+		data, err = wacsi.PaillierOperation(s.RequestBody, s.Memory, s.Sc.GetStateCache, isLen)
+	}
 	s.Sc.GetStateCache = data // reset data
 	if err != nil {
 		s.recordMsg(err.Error())
@@ -383,9 +433,8 @@ func (s *WaciInstance) getPaillierResultCore(isLen bool) int32 {
 //
 //export fdWrite
 func fdWrite(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
-	return []wasmer.Value{
-		wasmer.NewValue(protocol.ContractSdkSignalResultSuccess, wasmer.I32),
-	}, nil
+	// stdout and stderr are captured like wasi_snapshot_preview1, the iovecs are the same
+	return wasiFdWrite(environment, args)
 }
 
 //export fdRead
@@ -409,9 +458,17 @@ func fdSeek(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error
 	}, nil
 }
 
+// procExit record the exit code in the sandbox and trap, so the invocation unwinds, see CMEnvironment.exitResult
+//
 //export procExit
 func procExit(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
-	return []wasmer.Value{}, nil
+	env, ok := environment.(*CMEnvironment)
+	if !ok {
+		return nil, errors.New("args 'environment' is not *CMEnvironment type")
+	}
+	code := uint32(args[0].I32())
+	env.wasi.exited, env.wasi.exitCode = true, code
+	return nil, fmt.Errorf("proc_exit(%d)", code)
 }
 
 func (s *WaciInstance) recordMsg(msg string) int32 {
@@ -562,9 +619,12 @@ func (b *vmBridgeManager) GetImports(store *wasmer.Store, env *CMEnvironment, im
 	}
 	fdseek := wasmer.NewFunctionWithEnvironment(store, seekFt, env, fdSeek)
 
-	// for wacsi empty interface
+	// deterministic clocks, randomness, args and env of wasi_snapshot_preview1 and wasi_unstable
+	registerWasiSandbox(store, env, imports)
+
+	// for wacsi empty interface, overrides the functions of the sandbox
 	imports.Register(
-		"wasi_unstable",
+		wasiUnstable,
 		map[string]wasmer.IntoExtern{
 			"fd_read":  fdread,
 			"fd_write": fdwrite,
@@ -572,18 +632,21 @@ func (b *vmBridgeManager) GetImports(store *wasmer.Store, env *CMEnvironment, im
 			"fd_seek":  fdseek,
 		})
 
-	//exitFt := wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes(wasmer.I32))
-	//if exitFt == nil {
-	//	return nil, errors.New("new function type for exit failed")
-	//}
-	//procexit := wasmer.NewFunctionWithEnvironment(store, exitFt, env, procExit)
-	//
-	//// for wasi_snapshot_preview1
-	//imports.Register(
-	//	"wasi_snapshot_preview1",
-	//	map[string]wasmer.IntoExtern{
-	//		"proc_exit": procexit,
-	//	})
+	// proc_exit has no result
+	exitFt := wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes())
+	if exitFt == nil {
+		return nil, errors.New("new function type for exit failed")
+	}
+	procexit := wasmer.NewFunctionWithEnvironment(store, exitFt, env, procExit)
+
+	// for wasi_snapshot_preview1 and wasi_unstable
+	for _, namespace := range []string{wasiSnapshotPreview1, wasiUnstable} {
+		imports.Register(
+			namespace,
+			map[string]wasmer.IntoExtern{
+				"proc_exit": procexit,
+			})
+	}
 
 	return imports, nil
 }
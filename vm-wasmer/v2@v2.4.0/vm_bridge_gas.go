@@ -0,0 +1,93 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"chainmaker.org/chainmaker/store/v2/types"
+	"chainmaker.org/chainmaker/vm/v2"
+
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"chainmaker.org/chainmaker/protocol/v2"
+)
+
+// blockVersionSyscallGas from this block version on, the syscalls are charged by wacsiWithGas,
+// the gas is taken from the tx gas of the TxSimContext and added to ContractResult.GasUsed, see gasMeter
+const blockVersionSyscallGas uint32 = 2050000
+
+// wacsiWithGas WebAssembly chainmaker system interface charging gas for syscalls
+var wacsiWithGas = vm.NewWacsiWithGas(log, &types.StandardSqlVerify{})
+
+// chargedWacsi wacsiWithGas with the syscalls protocol.WacsiWithGas does not declare, vm.WacsiWithGasImpl has them.
+// They are type-asserted, so the implementers of protocol.WacsiWithGas are not broken by new syscalls,
+// nil if wacsiWithGas misses any of them, the syscalls are not charged then
+var chargedWacsi, _ = wacsiWithGas.(wacsiWithGasSyscalls)
+
+// wacsiWithGasSyscalls the syscalls of the bridge charging gas, see chargedWacsi
+type wacsiWithGasSyscalls interface {
+	bridgeWacsi
+	Sha256(requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte,
+		baseGas, wordGas uint64) ([]byte, error)
+}
+
+// bridgeWacsi the syscalls provided by both protocol.Wacsi and vm.WacsiWithGasImpl
+type bridgeWacsi interface {
+	PutState(requestBody []byte, contractName string, txSimContext protocol.TxSimContext) error
+	GetState(requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte,
+		data []byte, isLen bool) ([]byte, error)
+	GetBatchState(requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte,
+		data []byte, isLen bool) ([]byte, error)
+	DeleteState(requestBody []byte, contractName string, txSimContext protocol.TxSimContext) error
+	GetSenderAddress(requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte,
+		data []byte, isLen bool) ([]byte, error)
+	CallContract(caller *commonPb.Contract, requestBody []byte, txSimContext protocol.TxSimContext,
+		memory []byte, data []byte, gasUsed uint64, isLen bool) (*commonPb.ContractResult, uint64,
+		protocol.ExecOrderTxType, error)
+	EmitEvent(requestBody []byte, txSimContext protocol.TxSimContext, contractId *commonPb.Contract,
+		log protocol.Logger) (*commonPb.ContractEvent, error)
+
+	KvIterator(requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte) error
+	KvPreIterator(requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte) error
+	KvIteratorHasNext(requestBody []byte, txSimContext protocol.TxSimContext, memory []byte) error
+	KvIteratorNext(requestBody []byte, txSimContext protocol.TxSimContext, memory []byte, data []byte,
+		contractName string, isLen bool) ([]byte, error)
+	KvIteratorClose(requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte) error
+
+	HistoryKvIterator(requestBody []byte, contractName string, txSimContext protocol.TxSimContext,
+		memory []byte) error
+	HistoryKvIterHasNext(requestBody []byte, txSimContext protocol.TxSimContext, memory []byte) error
+	HistoryKvIterNext(requestBody []byte, txSimContext protocol.TxSimContext, memory []byte, data []byte,
+		contractName string, isLen bool) ([]byte, error)
+	HistoryKvIterClose(requestBody []byte, contractName string, txSimContext protocol.TxSimContext,
+		memory []byte) error
+
+	ExecuteQuery(requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte,
+		chainId string) error
+	ExecuteQueryOne(requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte,
+		data []byte, chainId string, isLen bool) ([]byte, error)
+	ExecuteUpdate(requestBody []byte, contractName string, method string, txSimContext protocol.TxSimContext,
+		memory []byte, chainId string) error
+	ExecuteDDL(requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte,
+		method string) error
+	RSHasNext(requestBody []byte, txSimContext protocol.TxSimContext, memory []byte) error
+	RSNext(requestBody []byte, txSimContext protocol.TxSimContext, memory []byte, data []byte,
+		isLen bool) ([]byte, error)
+	RSClose(requestBody []byte, txSimContext protocol.TxSimContext, memory []byte) error
+}
+
+// chargeGas whether the syscalls of the tx are charged, see txCharged
+func (sc *SimContext) chargeGas() bool {
+	return txCharged(sc.TxSimContext)
+}
+
+// sysWacsi the Wacsi of the syscalls, charging gas from blockVersionSyscallGas on
+func (s *WaciInstance) sysWacsi() bridgeWacsi {
+	if s.Sc.chargeGas() && chargedWacsi != nil {
+		return chargedWacsi
+	}
+	return wacsi
+}
@@ -0,0 +1,217 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"fmt"
+	"testing"
+
+	"chainmaker.org/chainmaker/common/v2/bytehelper"
+	"chainmaker.org/chainmaker/common/v2/serialize"
+	logger2 "chainmaker.org/chainmaker/logger/v2"
+	accessPb "chainmaker.org/chainmaker/pb-go/v2/accesscontrol"
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"chainmaker.org/chainmaker/pb-go/v2/config"
+	storePb "chainmaker.org/chainmaker/pb-go/v2/store"
+	"chainmaker.org/chainmaker/pb-go/v2/syscontract"
+	vmPb "chainmaker.org/chainmaker/pb-go/v2/vm"
+	"chainmaker.org/chainmaker/protocol/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// gasTxSimContext a TxSimContext charging tx gas like vm.txSimContextImpl
+type gasTxSimContext struct {
+	protocol.TxSimContext
+	blockVersion uint32
+	gasLimit     *commonPb.Limit
+	gasRemaining uint64
+	chainConfig  *config.ChainConfig
+	// contract name -> key -> value
+	state map[string]map[string][]byte
+	iters map[int32]interface{}
+}
+
+func newGasTxSimContext(blockVersion uint32, gasLimit uint64) *gasTxSimContext {
+	return &gasTxSimContext{
+		blockVersion: blockVersion,
+		gasLimit:     &commonPb.Limit{GasLimit: gasLimit},
+		gasRemaining: gasLimit,
+	}
+}
+
+func (c *gasTxSimContext) GetBlockVersion() uint32 { return c.blockVersion }
+
+func (c *gasTxSimContext) GetGasRemaining() uint64 { return c.gasRemaining }
+
+func (c *gasTxSimContext) GetLastChainConfig() *config.ChainConfig { return c.chainConfig }
+
+func (c *gasTxSimContext) GetTx() *commonPb.Transaction {
+	return &commonPb.Transaction{Payload: &commonPb.Payload{TxId: "tx", Limit: c.gasLimit}}
+}
+
+func (c *gasTxSimContext) Get(contractName string, key []byte) ([]byte, error) {
+	return c.state[contractName][string(key)], nil
+}
+
+func (c *gasTxSimContext) GetKeys(keys []*vmPb.BatchKey) ([]*vmPb.BatchKey, error) {
+	values := make([]*vmPb.BatchKey, 0, len(keys))
+	for _, key := range keys {
+		value, _ := c.Get(key.ContractName, protocol.GetKeyStr(key.Key, key.Field))
+		values = append(values, &vmPb.BatchKey{Key: key.Key, Field: key.Field, Value: value,
+			ContractName: key.ContractName})
+	}
+	return values, nil
+}
+
+func (c *gasTxSimContext) GetHistoryIterForKey(contractName string, key []byte) (protocol.KeyHistoryIterator, error) {
+	value, _ := c.Get(contractName, key)
+	return &historyIterMock{values: []*storePb.KeyModification{{Value: value, BlockHeight: 1}}}, nil
+}
+
+func (c *gasTxSimContext) SetIterHandle(index int32, iter interface{}) {
+	if c.iters == nil {
+		c.iters = make(map[int32]interface{})
+	}
+	c.iters[index] = iter
+}
+
+func (c *gasTxSimContext) GetIterHandle(index int32) (interface{}, bool) {
+	iter, ok := c.iters[index]
+	return iter, ok
+}
+
+func (c *gasTxSimContext) GetSender() *accessPb.Member {
+	return &accessPb.Member{MemberType: accessPb.MemberType_PUBLIC_KEY}
+}
+
+func (c *gasTxSimContext) SubtractGas(gasUsed uint64) error {
+	old := c.gasRemaining
+	c.gasRemaining -= gasUsed
+	if c.gasRemaining > old {
+		return fmt.Errorf("gas is not enough")
+	}
+	return nil
+}
+
+func TestSysWacsi(t *testing.T) {
+	s := &WaciInstance{Sc: &SimContext{TxSimContext: newGasTxSimContext(blockVersionSyscallGas-1, 100)}}
+	assert.Equal(t, wacsi, s.sysWacsi())
+
+	s.Sc.TxSimContext = newGasTxSimContext(blockVersionSyscallGas, 100)
+	assert.Equal(t, wacsiWithGas, s.sysWacsi())
+
+	// txs carrying no gas limit are not charged
+	s.Sc.TxSimContext = &gasTxSimContext{blockVersion: blockVersionSyscallGas}
+	assert.Equal(t, wacsi, s.sysWacsi())
+}
+
+// historyIterMock a protocol.KeyHistoryIterator over the given values
+type historyIterMock struct {
+	values []*storePb.KeyModification
+	next   int
+}
+
+func (i *historyIterMock) Next() bool {
+	i.next++
+	return i.next <= len(i.values)
+}
+
+func (i *historyIterMock) Value() (*storePb.KeyModification, error) {
+	return i.values[i.next-1], nil
+}
+
+func (i *historyIterMock) Release() {}
+
+func TestSyscallsChargeGas(t *testing.T) {
+	batchKeys, err := (&vmPb.BatchKeys{Keys: []*vmPb.BatchKey{
+		{Key: "key", Field: "field", ContractName: "contract1"},
+	}}).Marshal()
+	assert.Nil(t, err)
+	chainConfigContract := syscontract.SystemContract_CHAIN_CONFIG.String()
+	chainConfig, err := (&config.ChainConfig{Vm: &config.Vm{}, Crypto: &config.CryptoConfig{}}).Marshal()
+	assert.Nil(t, err)
+	request := func(kvs ...interface{}) []byte {
+		ec := serialize.NewEasyCodec()
+		for i := 0; i < len(kvs); i += 2 {
+			switch v := kvs[i+1].(type) {
+			case string:
+				ec.AddString(kvs[i].(string), v)
+			case int32:
+				ec.AddInt32(kvs[i].(string), v)
+			case []byte:
+				ec.AddBytes(kvs[i].(string), v)
+			}
+		}
+		return ec.Marshal()
+	}
+
+	for _, blockVersion := range []uint32{blockVersionSyscallGas - 1, blockVersionSyscallGas} {
+		txSimContext := newGasTxSimContext(blockVersion, 1000000)
+		txSimContext.state = map[string]map[string][]byte{
+			"contract1":         {string(protocol.GetKeyStr("key", "field")): []byte("value")},
+			chainConfigContract: {chainConfigContract: chainConfig},
+		}
+		s := &WaciInstance{
+			Sc: &SimContext{
+				TxSimContext:   txSimContext,
+				Contract:       &commonPb.Contract{Name: "contract1"},
+				ContractResult: &commonPb.ContractResult{},
+				Log:            logger2.GetLogger("unit_test"),
+				gas:            &gasMeter{sha256BaseCost: 30, sha256WordCost: 6},
+			},
+			Memory: make([]byte, 1024),
+		}
+		// every syscall reading the chain or computing in the host is charged from blockVersionSyscallGas on,
+		// the iterator handle written at address 0 by HistoryKvIterator is passed to the following calls
+		handle := func() int32 {
+			index, _ := bytehelper.BytesToInt(s.Memory[0:4])
+			return index
+		}
+		syscalls := []struct {
+			name    string
+			request func() []byte
+			call    func() int32
+		}{
+			{"GetBatchState", func() []byte { return request("BatchKeys", batchKeys, "value_ptr", int32(0)) },
+				s.GetBatchStateLen},
+			{"Sha256", func() []byte { return request("hashInput", []byte("input"), "value_ptr", int32(0)) },
+				s.Sha256},
+			{"HistoryKvIterator", func() []byte {
+				return request("start_key", "key", "start_field", "field", "value_ptr", int32(0))
+			}, s.HistoryKvIterator},
+			{"HistoryKvIterHasNext", func() []byte {
+				return request("ks_index", handle(), "value_ptr", int32(4))
+			}, s.HistoryKvIterHasNext},
+			{"HistoryKvIterNext", func() []byte {
+				return request("ks_index", handle(), "value_ptr", int32(4))
+			}, s.HistoryKvIterNextLen},
+			{"HistoryKvIterClose", func() []byte {
+				return request("ks_index", handle(), "value_ptr", int32(4))
+			}, s.HistoryKvIterClose},
+			// the address of the public key member fails to resolve, the chain config read is charged first
+			{"GetSenderAddress", func() []byte { return request("value_ptr", int32(0)) }, s.GetSenderAddressLen},
+		}
+		for _, syscall := range syscalls {
+			before := txSimContext.gasRemaining
+			s.RequestBody = syscall.request()
+			result := syscall.call()
+			if syscall.name != "GetSenderAddress" {
+				assert.Equal(t, protocol.ContractSdkSignalResultSuccess, result, "%s %s", syscall.name,
+					s.Sc.ContractResult.Message)
+			}
+			if blockVersion < blockVersionSyscallGas {
+				assert.Equal(t, before, txSimContext.gasRemaining, syscall.name)
+			} else if syscall.name == "Sha256" {
+				// one word of input, priced by the gas schedule
+				assert.Equal(t, before-30-6, txSimContext.gasRemaining)
+			} else {
+				assert.True(t, txSimContext.gasRemaining < before, syscall.name)
+			}
+		}
+	}
+}
@@ -9,6 +9,7 @@ package wasmer
 
 import (
 	"chainmaker.org/chainmaker/protocol/v2"
+	"chainmaker.org/chainmaker/vm/v2"
 )
 
 // GetStateLen get state length from chain
@@ -22,7 +23,10 @@ func (s *WaciInstance) GetState() int32 {
 }
 
 func (s *WaciInstance) getStateCore(isLen bool) int32 {
-	data, err := wacsi.GetState(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory, s.Sc.GetStateCache, isLen)
+	if !s.chargeCopy(isLen, s.Sc.GetStateCache) {
+		return protocol.ContractSdkSignalResultFail
+	}
+	data, err := s.sysWacsi().GetState(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory, s.Sc.GetStateCache, isLen)
 	s.Sc.GetStateCache = data // reset _data
 	if err != nil {
 		s.recordMsg(err.Error())
@@ -42,7 +46,10 @@ func (s *WaciInstance) GetBatchState() int32 {
 }
 
 func (s *WaciInstance) getBatchStateCore(isLen bool) int32 {
-	data, err := wacsi.GetBatchState(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory, s.Sc.GetStateCache, isLen)
+	if !s.chargeCopy(isLen, s.Sc.GetStateCache) {
+		return protocol.ContractSdkSignalResultFail
+	}
+	data, err := s.sysWacsi().GetBatchState(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory, s.Sc.GetStateCache, isLen)
 	s.Sc.GetStateCache = data // reset _data
 	if err != nil {
 		s.recordMsg(err.Error())
@@ -51,8 +58,15 @@ func (s *WaciInstance) getBatchStateCore(isLen bool) int32 {
 	return protocol.ContractSdkSignalResultSuccess
 }
 
+// Sha256 hash the input in the host, charged by the sha256 costs of the gas schedule
 func (s *WaciInstance) Sha256() int32 {
-	_, err := wacsi.Sha256(s.RequestBody, s.Sc.Contract.Name, s.Memory)
+	var err error
+	if s.Sc.chargeGas() && chargedWacsi != nil {
+		_, err = chargedWacsi.Sha256(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory,
+			s.Sc.gas.sha256BaseCost, s.Sc.gas.sha256WordCost)
+	} else {
+		_, err = wacsi.Sha256(s.RequestBody, s.Sc.Contract.Name, s.Memory)
+	}
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -62,7 +76,7 @@ func (s *WaciInstance) Sha256() int32 {
 
 // HistoryKvIterator Select kv statement
 func (s *WaciInstance) HistoryKvIterator() int32 {
-	err := wacsi.HistoryKvIterator(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory)
+	err := s.sysWacsi().HistoryKvIterator(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -72,7 +86,7 @@ func (s *WaciInstance) HistoryKvIterator() int32 {
 
 // HistoryKvIterHasNext to determine whether db has next statement
 func (s *WaciInstance) HistoryKvIterHasNext() int32 {
-	err := wacsi.HistoryKvIterHasNext(s.RequestBody, s.Sc.TxSimContext, s.Memory)
+	err := s.sysWacsi().HistoryKvIterHasNext(s.RequestBody, s.Sc.TxSimContext, s.Memory)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -91,7 +105,10 @@ func (s *WaciInstance) HistoryKvIterNext() int32 {
 }
 
 func (s *WaciInstance) HistoryKvIterNextCore(isLen bool) int32 {
-	data, err := wacsi.HistoryKvIterNext(s.RequestBody, s.Sc.TxSimContext,
+	if !s.chargeCopy(isLen, s.Sc.GetStateCache) {
+		return protocol.ContractSdkSignalResultFail
+	}
+	data, err := s.sysWacsi().HistoryKvIterNext(s.RequestBody, s.Sc.TxSimContext,
 		s.Memory, s.Sc.GetStateCache, s.Sc.Contract.Name, isLen)
 	s.Sc.GetStateCache = data // reset _data
 	if err != nil {
@@ -103,7 +120,7 @@ func (s *WaciInstance) HistoryKvIterNextCore(isLen bool) int32 {
 
 // KvIteratorClose Close kv statement
 func (s *WaciInstance) HistoryKvIterClose() int32 {
-	err := wacsi.HistoryKvIterClose(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory)
+	err := s.sysWacsi().HistoryKvIterClose(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -122,7 +139,10 @@ func (s *WaciInstance) GetSenderAddress() int32 {
 }
 
 func (s *WaciInstance) getSenderAddressCore(isLen bool) int32 {
-	data, err := wacsi.GetSenderAddress(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory, s.Sc.SenderAddressCache, isLen)
+	if !s.chargeCopy(isLen, s.Sc.SenderAddressCache) {
+		return protocol.ContractSdkSignalResultFail
+	}
+	data, err := s.sysWacsi().GetSenderAddress(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory, s.Sc.SenderAddressCache, isLen)
 	s.Sc.SenderAddressCache = data // reset _data
 	if err != nil {
 		s.recordMsg(err.Error())
@@ -133,27 +153,54 @@ func (s *WaciInstance) getSenderAddressCore(isLen bool) int32 {
 
 // PutState put state to chain
 func (s *WaciInstance) PutState() int32 {
-	err := wacsi.PutState(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext)
+	var stateKey, value, prev []byte
+	var err error
+	priced := s.Sc.gas.statePriced()
+	if priced {
+		if stateKey, value, prev, err = s.stateWrite(); err != nil {
+			s.recordMsg(err.Error())
+			return protocol.ContractSdkSignalResultFail
+		}
+	}
+	err = s.sysWacsi().PutState(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
 	}
+	// a key holding a value is rewritten at the cheaper cost
+	if priced && !s.Sc.gas.chargeState(len(stateKey)+len(value), len(prev) > 0) {
+		s.recordMsg("out of gas")
+		return protocol.ContractSdkSignalResultFail
+	}
 	return protocol.ContractSdkSignalResultSuccess
 }
 
 // DeleteState delete state from chain
 func (s *WaciInstance) DeleteState() int32 {
-	err := wacsi.DeleteState(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext)
+	var stateKey, prev []byte
+	var err error
+	priced := s.Sc.gas.statePriced()
+	if priced {
+		if stateKey, _, prev, err = s.stateWrite(); err != nil {
+			s.recordMsg(err.Error())
+			return protocol.ContractSdkSignalResultFail
+		}
+	}
+	err = s.sysWacsi().DeleteState(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
 	}
+	// only a key known to hold a value frees storage
+	if priced && len(prev) > 0 {
+		vm.AddGasRefund(s.Sc.TxSimContext, s.Sc.gas.refundBytes(len(stateKey)+len(prev)))
+	}
 	return protocol.ContractSdkSignalResultSuccess
 }
 
 // KvIterator Select kv statement
 func (s *WaciInstance) KvIterator() int32 {
-	err := wacsi.KvIterator(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory)
+	err := s.sysWacsi().KvIterator(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -163,7 +210,7 @@ func (s *WaciInstance) KvIterator() int32 {
 
 // KvPreIterator comment at next version
 func (s *WaciInstance) KvPreIterator() int32 {
-	err := wacsi.KvPreIterator(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory)
+	err := s.sysWacsi().KvPreIterator(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -173,7 +220,7 @@ func (s *WaciInstance) KvPreIterator() int32 {
 
 // KvIteratorHasNext to determine whether db has next statement
 func (s *WaciInstance) KvIteratorHasNext() int32 {
-	err := wacsi.KvIteratorHasNext(s.RequestBody, s.Sc.TxSimContext, s.Memory)
+	err := s.sysWacsi().KvIteratorHasNext(s.RequestBody, s.Sc.TxSimContext, s.Memory)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -192,7 +239,10 @@ func (s *WaciInstance) KvIteratorNext() int32 {
 }
 
 func (s *WaciInstance) kvIteratorNextCore(isLen bool) int32 {
-	data, err := wacsi.KvIteratorNext(s.RequestBody, s.Sc.TxSimContext,
+	if !s.chargeCopy(isLen, s.Sc.GetStateCache) {
+		return protocol.ContractSdkSignalResultFail
+	}
+	data, err := s.sysWacsi().KvIteratorNext(s.RequestBody, s.Sc.TxSimContext,
 		s.Memory, s.Sc.GetStateCache, s.Sc.Contract.Name, isLen)
 	s.Sc.GetStateCache = data // reset _data
 	if err != nil {
@@ -204,7 +254,7 @@ func (s *WaciInstance) kvIteratorNextCore(isLen bool) int32 {
 
 // KvIteratorClose Close kv statement
 func (s *WaciInstance) KvIteratorClose() int32 {
-	err := wacsi.KvIteratorClose(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory)
+	err := s.sysWacsi().KvIteratorClose(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
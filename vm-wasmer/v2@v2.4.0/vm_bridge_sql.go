@@ -16,7 +16,7 @@ import (
 
 // ExecuteQuery execute query sql, return result set index
 func (s *WaciInstance) ExecuteQuery() int32 {
-	err := wacsi.ExecuteQuery(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory, s.ChainId)
+	err := s.sysWacsi().ExecuteQuery(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory, s.ChainId)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -35,7 +35,10 @@ func (s *WaciInstance) ExecuteQueryOne() int32 {
 }
 
 func (s *WaciInstance) executeQueryOneCore(isLen bool) int32 {
-	data, err := wacsi.ExecuteQueryOne(s.RequestBody, s.Sc.Contract.Name,
+	if !s.chargeCopy(isLen, s.Sc.GetStateCache) {
+		return protocol.ContractSdkSignalResultFail
+	}
+	data, err := s.sysWacsi().ExecuteQueryOne(s.RequestBody, s.Sc.Contract.Name,
 		s.Sc.TxSimContext, s.Memory, s.Sc.GetStateCache, s.ChainId, isLen)
 	s.Sc.GetStateCache = data // reset _data
 	if err != nil {
@@ -47,7 +50,7 @@ func (s *WaciInstance) executeQueryOneCore(isLen bool) int32 {
 
 // RSHasNext return is there a next line, 1 is has next row, 0 is no next row
 func (s *WaciInstance) RSHasNext() int32 {
-	err := wacsi.RSHasNext(s.RequestBody, s.Sc.TxSimContext, s.Memory)
+	err := s.sysWacsi().RSHasNext(s.RequestBody, s.Sc.TxSimContext, s.Memory)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -66,7 +69,10 @@ func (s *WaciInstance) RSNext() int32 {
 }
 
 func (s *WaciInstance) rsNextCore(isLen bool) int32 {
-	data, err := wacsi.RSNext(s.RequestBody, s.Sc.TxSimContext, s.Memory, s.Sc.GetStateCache, isLen)
+	if !s.chargeCopy(isLen, s.Sc.GetStateCache) {
+		return protocol.ContractSdkSignalResultFail
+	}
+	data, err := s.sysWacsi().RSNext(s.RequestBody, s.Sc.TxSimContext, s.Memory, s.Sc.GetStateCache, isLen)
 	s.Sc.GetStateCache = data // reset _data
 	if err != nil {
 		s.recordMsg(err.Error())
@@ -77,7 +83,7 @@ func (s *WaciInstance) rsNextCore(isLen bool) int32 {
 
 // RSClose close sql statement
 func (s *WaciInstance) RSClose() int32 {
-	err := wacsi.RSClose(s.RequestBody, s.Sc.TxSimContext, s.Memory)
+	err := s.sysWacsi().RSClose(s.RequestBody, s.Sc.TxSimContext, s.Memory)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -88,7 +94,7 @@ func (s *WaciInstance) RSClose() int32 {
 // ExecuteUpdate execute update and insert sql, allow single row change
 // as: update table set name = 'Tom' where uniqueKey='xxx'
 func (s *WaciInstance) ExecuteUpdate() int32 {
-	err := wacsi.ExecuteUpdate(s.RequestBody, s.Sc.Contract.Name, s.Sc.method, s.Sc.TxSimContext, s.Memory, s.ChainId)
+	err := s.sysWacsi().ExecuteUpdate(s.RequestBody, s.Sc.Contract.Name, s.Sc.method, s.Sc.TxSimContext, s.Memory, s.ChainId)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -107,7 +113,7 @@ func (s *WaciInstance) ExecuteUpdate() int32 {
 //
 // You must have a primary key to create a table
 func (s *WaciInstance) ExecuteDDL() int32 {
-	err := wacsi.ExecuteDDL(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory, s.Sc.method)
+	err := s.sysWacsi().ExecuteDDL(s.RequestBody, s.Sc.Contract.Name, s.Sc.TxSimContext, s.Memory, s.Sc.method)
 	if err != nil {
 		s.recordMsg(err.Error())
 		return protocol.ContractSdkSignalResultFail
@@ -0,0 +1,566 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+)
+
+const (
+	// wasiSnapshotPreview1 the WASI namespace imported by Go (GOOS=wasip1) and TinyGo contracts
+	wasiSnapshotPreview1 = "wasi_snapshot_preview1"
+	// wasiUnstable the WASI namespace before preview1, imported by older toolchains
+	wasiUnstable = "wasi_unstable"
+)
+
+// errno of WASI preview1
+const (
+	wasiErrnoSuccess    = 0
+	wasiErrnoBadf       = 8
+	wasiErrnoFault      = 21
+	wasiErrnoInval      = 28
+	wasiErrnoNosys      = 52
+	wasiErrnoNotcapable = 76
+)
+
+// file descriptors of the standard streams
+const (
+	wasiStdin  = 0
+	wasiStdout = 1
+	wasiStderr = 2
+)
+
+const (
+	// bytes of stdout and of stderr kept per invocation, the rest is dropped
+	wasiOutputLimit = 64 << 10
+	// bytes of stderr and of stdout appended to the message of a failed invocation
+	wasiMessageLimit = 4 << 10
+)
+
+// clock ids of WASI preview1
+const (
+	wasiClockRealtime = iota
+	wasiClockMonotonic
+	wasiClockProcessCputime
+	wasiClockThreadCputime
+)
+
+// layout of the events of poll_oneoff
+const (
+	wasiEventSize       = 32
+	wasiEventTypeClock  = 0
+	wasiSubscriptionAbs = 1
+)
+
+// wasiSubscriptionLayout the offsets of the clock fields in a subscription of poll_oneoff,
+// the clock of wasi_unstable has an identifier before them
+type wasiSubscriptionLayout struct {
+	size    uint64
+	clockId int
+	timeout int
+	flags   int
+}
+
+var (
+	wasiPreview1Subscription = wasiSubscriptionLayout{size: 48, clockId: 16, timeout: 24, flags: 40}
+	wasiUnstableSubscription = wasiSubscriptionLayout{size: 56, clockId: 24, timeout: 32, flags: 48}
+)
+
+// layout of the fdstat of fd_fdstat_get
+const (
+	wasiFdstatSize                = 24
+	wasiFiletypeCharDevice        = 2
+	wasiRightFdRead        uint64 = 1 << 1
+	wasiRightFdWrite       uint64 = 1 << 6
+)
+
+// wasiSandbox the deterministic WASI state of an instance, every node sees the same clocks and randomness.
+//
+// The sandbox serves the whole WASI of an instance, the host WASI of wasmer (the clocks, randomness, args, env
+// and files of the host) is never linked. The realtime clock starts at the block timestamp, the other clocks start at 0, all of them only move forward
+// when poll_oneoff sleeps, randomness is a sha256 stream seeded by the tx id, the block fingerprint and the
+// contract, args and env are empty and there is no preopened directory, so no filesystem.
+// What the invocation writes to stdout and stderr is captured, see reportOutput.
+// Out of an invocation, e.g. while _start or _initialize boots the runtime of the module, the clocks start at 0
+// and the seed is zero, so the snapshot of the instance is the same on every node.
+type wasiSandbox struct {
+	sc *SimContext
+	// nanoseconds the clocks moved since the invocation started
+	elapsed uint64
+	// the seed is derived when the invocation first asks for randomness
+	seed   [sha256.Size]byte
+	seeded bool
+	// blocks of the random stream used so far
+	counter uint64
+	// output of the invocation, up to wasiOutputLimit bytes each
+	stdout, stderr []byte
+	truncated      bool
+	// the runtime called proc_exit, the stack of the call was unwound by a trap
+	exited   bool
+	exitCode uint32
+}
+
+// bind the sandbox of the instance to the invocation running in it, unbind must be called when it returns
+func (env *CMEnvironment) bind(sc *SimContext) {
+	if env == nil {
+		return
+	}
+	env.wasi = wasiSandbox{sc: sc}
+}
+
+// unbind reset the sandbox to the state out of an invocation
+func (env *CMEnvironment) unbind() {
+	if env == nil {
+		return
+	}
+	env.wasi = wasiSandbox{}
+}
+
+// exitResult the result of a call which returned err, if the runtime called proc_exit the trap is not a failure
+// by itself: exit code 0 succeeds with whatever result the contract recorded, other codes fail with the code.
+// exited reports whether the runtime exited, its stack was unwound in the middle of the call
+func (env *CMEnvironment) exitResult(err error) (exited bool, result error) {
+	if env == nil || !env.wasi.exited {
+		return false, err
+	}
+	if env.wasi.exitCode != 0 {
+		return true, fmt.Errorf("contract exited with code %d", env.wasi.exitCode)
+	}
+	return true, nil
+}
+
+// now the time of the clock in nanoseconds
+func (w *wasiSandbox) now(clockId uint32) (uint64, bool) {
+	switch clockId {
+	case wasiClockRealtime:
+		if w.sc == nil {
+			return w.elapsed, true
+		}
+		return uint64(w.sc.TxSimContext.GetBlockTimestamp())*1e9 + w.elapsed, true
+	case wasiClockMonotonic, wasiClockProcessCputime, wasiClockThreadCputime:
+		return w.elapsed, true
+	}
+	return 0, false
+}
+
+// random fill p with the next bytes of the random stream
+func (w *wasiSandbox) random(p []byte) {
+	if !w.seeded && w.sc != nil {
+		h := sha256.New()
+		for _, s := range []string{w.sc.TxSimContext.GetTx().Payload.TxId,
+			w.sc.TxSimContext.GetBlockFingerprint(), w.sc.Contract.Name} {
+			var n [4]byte
+			binary.LittleEndian.PutUint32(n[:], uint32(len(s)))
+			h.Write(n[:])
+			h.Write([]byte(s))
+		}
+		copy(w.seed[:], h.Sum(nil))
+	}
+	w.seeded = true
+	var block [8 + sha256.Size]byte
+	copy(block[8:], w.seed[:])
+	for len(p) > 0 {
+		binary.LittleEndian.PutUint64(block[:8], w.counter)
+		w.counter++
+		sum := sha256.Sum256(block[:])
+		p = p[copy(p, sum[:]):]
+	}
+}
+
+// write capture the output of the invocation, the output out of an invocation is dropped
+func (w *wasiSandbox) write(fd int32, p []byte) {
+	if w.sc == nil {
+		return
+	}
+	out := &w.stdout
+	if fd == wasiStderr {
+		out = &w.stderr
+	}
+	if n := wasiOutputLimit - len(*out); n < len(p) {
+		p = p[:n]
+		w.truncated = true
+	}
+	*out = append(*out, p...)
+}
+
+// reportOutput log what the invocation wrote to stdout at info level and to stderr at error level,
+// and append it to the message of the result if the invocation failed, e.g. the trace of a Go panic
+func (env *CMEnvironment) reportOutput(sc *SimContext) {
+	if env == nil || env.wasi.sc != sc {
+		return
+	}
+	w := &env.wasi
+	txId := sc.TxSimContext.GetTx().Payload.TxId
+	for _, line := range strings.Split(strings.TrimRight(string(w.stdout), "\n"), "\n") {
+		if len(line) > 0 {
+			sc.Log.Infof("wasmer stdout>> [%s][%s] %s", txId, sc.Contract.Name, line)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(w.stderr), "\n"), "\n") {
+		if len(line) > 0 {
+			sc.Log.Errorf("wasmer stderr>> [%s][%s] %s", txId, sc.Contract.Name, line)
+		}
+	}
+	if w.truncated {
+		sc.Log.Warnf("wasmer output of tx %s truncated to %d bytes", txId, wasiOutputLimit)
+	}
+
+	if sc.ContractResult == nil || sc.ContractResult.Code == 0 {
+		return
+	}
+	for _, out := range []struct {
+		name string
+		data []byte
+	}{{"stderr", w.stderr}, {"stdout", w.stdout}} {
+		data := strings.TrimSpace(string(out.data))
+		if len(data) == 0 {
+			continue
+		}
+		if len(data) > wasiMessageLimit {
+			data = data[:wasiMessageLimit] + "..."
+		}
+		sc.ContractResult.Message += ". " + out.name + ": " + data
+	}
+}
+
+// wasiMemory the linear memory of the instance calling a WASI function
+func wasiMemory(environment interface{}) (*CMEnvironment, []byte, error) {
+	env, ok := environment.(*CMEnvironment)
+	if !ok {
+		return nil, nil, errors.New("args 'environment' is not *CMEnvironment type")
+	}
+	if env.memory != nil {
+		return env, env.memory.Data(), nil
+	}
+	if env.instance == nil {
+		return nil, nil, errors.New("instance at Environment is nil")
+	}
+	memory, err := env.instance.Exports.GetMemory("memory")
+	if err != nil {
+		return nil, nil, err
+	}
+	return env, memory.Data(), nil
+}
+
+// wasiRange the range [ptr, ptr+n) of the memory, false if it is out of bounds
+func wasiRange(memory []byte, ptr int32, n uint64) ([]byte, bool) {
+	start := uint64(uint32(ptr))
+	if start+n > uint64(len(memory)) {
+		return nil, false
+	}
+	return memory[start : start+n], true
+}
+
+func wasiErrno(errno int32) []wasmer.Value {
+	return []wasmer.Value{wasmer.NewValue(errno, wasmer.I32)}
+}
+
+// wasiPutUint32s store the values at the pointers, used by the *_sizes_get functions
+func wasiPutUint32s(environment interface{}, ptrs []int32, values []uint32) ([]wasmer.Value, error) {
+	_, memory, err := wasiMemory(environment)
+	if err != nil {
+		return nil, err
+	}
+	for i, ptr := range ptrs {
+		p, ok := wasiRange(memory, ptr, 4)
+		if !ok {
+			return wasiErrno(wasiErrnoFault), nil
+		}
+		binary.LittleEndian.PutUint32(p, values[i])
+	}
+	return wasiErrno(wasiErrnoSuccess), nil
+}
+
+// wasiEmptyGet args_get and environ_get, there is nothing to copy
+func wasiEmptyGet(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	return wasiErrno(wasiErrnoSuccess), nil
+}
+
+// wasiEmptySizesGet args_sizes_get and environ_sizes_get, no args and no env
+func wasiEmptySizesGet(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	return wasiPutUint32s(environment, []int32{args[0].I32(), args[1].I32()}, []uint32{0, 0})
+}
+
+// wasiClockResGet clock_res_get, the clocks count nanoseconds
+func wasiClockResGet(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	env, memory, err := wasiMemory(environment)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := env.wasi.now(uint32(args[0].I32())); !ok {
+		return wasiErrno(wasiErrnoInval), nil
+	}
+	p, ok := wasiRange(memory, args[1].I32(), 8)
+	if !ok {
+		return wasiErrno(wasiErrnoFault), nil
+	}
+	binary.LittleEndian.PutUint64(p, 1)
+	return wasiErrno(wasiErrnoSuccess), nil
+}
+
+// wasiClockTimeGet clock_time_get, see wasiSandbox.now
+func wasiClockTimeGet(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	env, memory, err := wasiMemory(environment)
+	if err != nil {
+		return nil, err
+	}
+	now, ok := env.wasi.now(uint32(args[0].I32()))
+	if !ok {
+		return wasiErrno(wasiErrnoInval), nil
+	}
+	p, ok := wasiRange(memory, args[2].I32(), 8)
+	if !ok {
+		return wasiErrno(wasiErrnoFault), nil
+	}
+	binary.LittleEndian.PutUint64(p, now)
+	return wasiErrno(wasiErrnoSuccess), nil
+}
+
+// wasiRandomGet random_get, see wasiSandbox.random, the bytes are charged as copied by the host
+func wasiRandomGet(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	env, memory, err := wasiMemory(environment)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := wasiRange(memory, args[0].I32(), uint64(uint32(args[1].I32())))
+	if !ok {
+		return wasiErrno(wasiErrnoFault), nil
+	}
+	if env.wasi.sc != nil {
+		// running out of gas fails the invocation when it returns
+		env.wasi.sc.gas.chargeCopy(len(p))
+	}
+	env.wasi.random(p)
+	return wasiErrno(wasiErrnoSuccess), nil
+}
+
+// wasiPollOneoff poll_oneoff of the subscription layout, every subscription is ready at once, the clocks move
+// forward to the earliest timeout of the clock subscriptions, so a sleeping runtime wakes up without waiting
+func wasiPollOneoff(layout wasiSubscriptionLayout) func(interface{}, []wasmer.Value) ([]wasmer.Value, error) {
+	return func(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+		env, memory, err := wasiMemory(environment)
+		if err != nil {
+			return nil, err
+		}
+		n := uint64(uint32(args[2].I32()))
+		if n == 0 {
+			return wasiErrno(wasiErrnoInval), nil
+		}
+		in, ok1 := wasiRange(memory, args[0].I32(), n*layout.size)
+		out, ok2 := wasiRange(memory, args[1].I32(), n*wasiEventSize)
+		nevents, ok3 := wasiRange(memory, args[3].I32(), 4)
+		if !ok1 || !ok2 || !ok3 {
+			return wasiErrno(wasiErrnoFault), nil
+		}
+
+		var sleep uint64
+		sleeping := false
+		for i := uint64(0); i < n; i++ {
+			sub := in[i*layout.size : (i+1)*layout.size]
+			event := out[i*wasiEventSize : (i+1)*wasiEventSize]
+			for j := range event {
+				event[j] = 0
+			}
+			copy(event[0:8], sub[0:8])
+			event[10] = sub[8]
+			if sub[8] != wasiEventTypeClock {
+				continue
+			}
+			timeout := binary.LittleEndian.Uint64(sub[layout.timeout:])
+			if binary.LittleEndian.Uint16(sub[layout.flags:])&wasiSubscriptionAbs != 0 {
+				now, ok := env.wasi.now(binary.LittleEndian.Uint32(sub[layout.clockId:]))
+				if !ok {
+					binary.LittleEndian.PutUint16(event[8:10], wasiErrnoInval)
+					continue
+				}
+				if timeout > now {
+					timeout -= now
+				} else {
+					timeout = 0
+				}
+			}
+			if !sleeping || timeout < sleep {
+				sleep, sleeping = timeout, true
+			}
+		}
+		env.wasi.elapsed += sleep
+		binary.LittleEndian.PutUint32(nevents, uint32(n))
+		return wasiErrno(wasiErrnoSuccess), nil
+	}
+}
+
+// wasiFdWrite fd_write, stdout and stderr are captured by the sandbox, there is no other writable file
+func wasiFdWrite(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	env, memory, err := wasiMemory(environment)
+	if err != nil {
+		return nil, err
+	}
+	fd := args[0].I32()
+	iovs, ok1 := wasiRange(memory, args[1].I32(), uint64(uint32(args[2].I32()))*8)
+	nwritten, ok2 := wasiRange(memory, args[3].I32(), 4)
+	if !ok1 || !ok2 {
+		return wasiErrno(wasiErrnoFault), nil
+	}
+	if fd != wasiStdout && fd != wasiStderr {
+		return wasiErrno(wasiErrnoBadf), nil
+	}
+	var n uint32
+	for i := 0; i < len(iovs); i += 8 {
+		buf, ok := wasiRange(memory, int32(binary.LittleEndian.Uint32(iovs[i:i+4])),
+			uint64(binary.LittleEndian.Uint32(iovs[i+4:i+8])))
+		if !ok {
+			return wasiErrno(wasiErrnoFault), nil
+		}
+		env.wasi.write(fd, buf)
+		n += uint32(len(buf))
+	}
+	binary.LittleEndian.PutUint32(nwritten, n)
+	return wasiErrno(wasiErrnoSuccess), nil
+}
+
+// wasiSchedYield sched_yield, there is only one thread
+func wasiSchedYield(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	return wasiErrno(wasiErrnoSuccess), nil
+}
+
+// wasiFdPrestatGet fd_prestat_get and fd_prestat_dir_name, there is no preopened directory
+func wasiFdPrestatGet(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	return wasiErrno(wasiErrnoBadf), nil
+}
+
+// wasiPathOpen path_open, the filesystem is not accessible
+func wasiPathOpen(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	return wasiErrno(wasiErrnoNotcapable), nil
+}
+
+// wasiFdClose fd_close, only the standard streams are open, closing them changes nothing
+func wasiFdClose(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	if fd := args[0].I32(); fd < wasiStdin || fd > wasiStderr {
+		return wasiErrno(wasiErrnoBadf), nil
+	}
+	return wasiErrno(wasiErrnoSuccess), nil
+}
+
+// wasiFdFdstatGet fd_fdstat_get, the standard streams are character devices, stdin is read only,
+// stdout and stderr are write only, whatever the streams of the node are
+func wasiFdFdstatGet(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	_, memory, err := wasiMemory(environment)
+	if err != nil {
+		return nil, err
+	}
+	fd := args[0].I32()
+	if fd < wasiStdin || fd > wasiStderr {
+		return wasiErrno(wasiErrnoBadf), nil
+	}
+	p, ok := wasiRange(memory, args[1].I32(), wasiFdstatSize)
+	if !ok {
+		return wasiErrno(wasiErrnoFault), nil
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	p[0] = wasiFiletypeCharDevice
+	rights := wasiRightFdWrite
+	if fd == wasiStdin {
+		rights = wasiRightFdRead
+	}
+	binary.LittleEndian.PutUint64(p[8:], rights)
+	return wasiErrno(wasiErrnoSuccess), nil
+}
+
+// wasiFdFdstatSetFlags fd_fdstat_set_flags, the flags of the standard streams are accepted and ignored
+func wasiFdFdstatSetFlags(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	return wasiFdClose(environment, args)
+}
+
+// wasiNosys the WASI functions which are not emulated, no host file, socket or signal is reached,
+// every node fails them alike
+func wasiNosys(environment interface{}, args []wasmer.Value) ([]wasmer.Value, error) {
+	return wasiErrno(wasiErrnoNosys), nil
+}
+
+// wasiNosysParams the params of the WASI functions served by wasiNosys, all of them return an errno
+var wasiNosysParams = map[string][]wasmer.ValueKind{
+	"fd_advise":               {wasmer.I32, wasmer.I64, wasmer.I64, wasmer.I32},
+	"fd_allocate":             {wasmer.I32, wasmer.I64, wasmer.I64},
+	"fd_datasync":             {wasmer.I32},
+	"fd_fdstat_set_rights":    {wasmer.I32, wasmer.I64, wasmer.I64},
+	"fd_filestat_get":         {wasmer.I32, wasmer.I32},
+	"fd_filestat_set_size":    {wasmer.I32, wasmer.I64},
+	"fd_filestat_set_times":   {wasmer.I32, wasmer.I64, wasmer.I64, wasmer.I32},
+	"fd_pread":                {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I64, wasmer.I32},
+	"fd_pwrite":               {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I64, wasmer.I32},
+	"fd_read":                 {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32},
+	"fd_readdir":              {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I64, wasmer.I32},
+	"fd_renumber":             {wasmer.I32, wasmer.I32},
+	"fd_seek":                 {wasmer.I32, wasmer.I64, wasmer.I32, wasmer.I32},
+	"fd_sync":                 {wasmer.I32},
+	"fd_tell":                 {wasmer.I32, wasmer.I32},
+	"path_create_directory":   {wasmer.I32, wasmer.I32, wasmer.I32},
+	"path_filestat_get":       {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32},
+	"path_filestat_set_times": {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I64, wasmer.I64, wasmer.I32},
+	"path_link":               {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32},
+	"path_readlink":           {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32},
+	"path_remove_directory":   {wasmer.I32, wasmer.I32, wasmer.I32},
+	"path_rename":             {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32},
+	"path_symlink":            {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32},
+	"path_unlink_file":        {wasmer.I32, wasmer.I32, wasmer.I32},
+	"proc_raise":              {wasmer.I32},
+	"sock_accept":             {wasmer.I32, wasmer.I32, wasmer.I32},
+	"sock_recv":               {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32},
+	"sock_send":               {wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32},
+	"sock_shutdown":           {wasmer.I32, wasmer.I32},
+}
+
+// registerWasiSandbox override the WASI functions of wasmer in wasi_snapshot_preview1 and in wasi_unstable,
+// the functions which are not deterministic are emulated, see wasiSandbox, the others fail with ENOSYS.
+// proc_exit is registered by the bridge, and so are the functions of its empty wasi_unstable interface,
+// which must be registered after the sandbox
+func registerWasiSandbox(store *wasmer.Store, env *CMEnvironment, imports *wasmer.ImportObject) {
+	i32, i64 := wasmer.I32, wasmer.I64
+	function := func(params []wasmer.ValueKind, fn func(interface{}, []wasmer.Value) ([]wasmer.Value, error),
+	) *wasmer.Function {
+		ft := wasmer.NewFunctionType(wasmer.NewValueTypes(params...), wasmer.NewValueTypes(i32))
+		return wasmer.NewFunctionWithEnvironment(store, ft, env, fn)
+	}
+
+	for namespace, subscription := range map[string]wasiSubscriptionLayout{
+		wasiSnapshotPreview1: wasiPreview1Subscription,
+		wasiUnstable:         wasiUnstableSubscription,
+	} {
+		externs := map[string]wasmer.IntoExtern{
+			"args_get":            function([]wasmer.ValueKind{i32, i32}, wasiEmptyGet),
+			"args_sizes_get":      function([]wasmer.ValueKind{i32, i32}, wasiEmptySizesGet),
+			"environ_get":         function([]wasmer.ValueKind{i32, i32}, wasiEmptyGet),
+			"environ_sizes_get":   function([]wasmer.ValueKind{i32, i32}, wasiEmptySizesGet),
+			"clock_res_get":       function([]wasmer.ValueKind{i32, i32}, wasiClockResGet),
+			"clock_time_get":      function([]wasmer.ValueKind{i32, i64, i32}, wasiClockTimeGet),
+			"random_get":          function([]wasmer.ValueKind{i32, i32}, wasiRandomGet),
+			"poll_oneoff":         function([]wasmer.ValueKind{i32, i32, i32, i32}, wasiPollOneoff(subscription)),
+			"sched_yield":         function(nil, wasiSchedYield),
+			"fd_write":            function([]wasmer.ValueKind{i32, i32, i32, i32}, wasiFdWrite),
+			"fd_close":            function([]wasmer.ValueKind{i32}, wasiFdClose),
+			"fd_fdstat_get":       function([]wasmer.ValueKind{i32, i32}, wasiFdFdstatGet),
+			"fd_fdstat_set_flags": function([]wasmer.ValueKind{i32, i32}, wasiFdFdstatSetFlags),
+			"fd_prestat_get":      function([]wasmer.ValueKind{i32, i32}, wasiFdPrestatGet),
+			"fd_prestat_dir_name": function([]wasmer.ValueKind{i32, i32, i32}, wasiFdPrestatGet),
+			"path_open": function([]wasmer.ValueKind{i32, i32, i32, i32, i32, i64, i64, i32, i32},
+				wasiPathOpen),
+		}
+		for name, params := range wasiNosysParams {
+			externs[name] = function(params, wasiNosys)
+		}
+		imports.Register(namespace, externs)
+	}
+}
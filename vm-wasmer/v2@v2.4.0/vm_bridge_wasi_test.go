@@ -0,0 +1,321 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	logger2 "chainmaker.org/chainmaker/logger/v2"
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"chainmaker.org/chainmaker/protocol/v2"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const wasiSandboxWat = `(module
+  (import "wasi_snapshot_preview1" "clock_time_get" (func $clock (param i32 i64 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "random_get" (func $random (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "args_sizes_get" (func $args (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "poll_oneoff" (func $poll (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_prestat_get" (func $prestat (param i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "clock") (param i32) (result i32)
+    (call $clock (local.get 0) (i64.const 1) (i32.const 0)))
+  (func (export "random") (param i32) (result i32)
+    (call $random (i32.const 64) (local.get 0)))
+  (func (export "args") (result i32)
+    (call $args (i32.const 8) (i32.const 12)))
+  (func (export "poll") (result i32)
+    (call $poll (i32.const 256) (i32.const 512) (i32.const 1) (i32.const 16)))
+  (func (export "prestat") (result i32)
+    (call $prestat (i32.const 3) (i32.const 0))))`
+
+// wasiTxSimContext a tx sim context of a block
+type wasiTxSimContext struct {
+	*gasTxSimContext
+	timestamp   int64
+	fingerprint string
+}
+
+func (c *wasiTxSimContext) GetBlockTimestamp() int64 { return c.timestamp }
+
+func (c *wasiTxSimContext) GetBlockFingerprint() string { return c.fingerprint }
+
+// newWasiTestInstance instantiate the module with the imports of the bridge, call runs an export
+func newWasiTestInstance(t *testing.T, wat string) (env *CMEnvironment, call func(string, ...interface{}) int32,
+	closeFn func()) {
+	store := defaultEngine().newStore()
+	wasm, err := wasmergo.Wat2Wasm(wat)
+	assert.Nil(t, err)
+	module, err := wasmergo.NewModule(store, wasm, nil)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	env = &CMEnvironment{}
+	imports, err := GetVmBridgeManager().GetImports(store, env, nil)
+	assert.Nil(t, err)
+	instance, err := wasmergo.NewInstance(module, imports)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	env.instance = instance
+	env.memory, _ = instance.Exports.GetMemory("memory")
+	instance.SetGasLimit(protocol.GasLimit)
+
+	call = func(name string, args ...interface{}) int32 {
+		fn, err := instance.Exports.GetRawFunction(name)
+		assert.Nil(t, err)
+		defer fn.Close()
+		ret, err := fn.Call(args...)
+		assert.Nil(t, err)
+		return ret.(int32)
+	}
+	closeFn = func() {
+		instance.Close()
+		module.Close()
+		store.Close()
+	}
+	return env, call, closeFn
+}
+
+// bindWasiTestBlock bind the sandbox to an invocation of contract1 in the block
+func bindWasiTestBlock(env *CMEnvironment, timestamp int64, fingerprint string) *SimContext {
+	txSimContext := &wasiTxSimContext{newGasTxSimContext(blockVersionSyscallGas-1, 0), timestamp, fingerprint}
+	sc := &SimContext{
+		TxSimContext:   txSimContext,
+		Contract:       &commonPb.Contract{Name: "contract1"},
+		ContractResult: &commonPb.ContractResult{},
+		Log:            logger2.GetLogger("unit_test"),
+		gas:            newGasMeter(txSimContext, env.instance, 0, baseGasSchedule()),
+	}
+	env.bind(sc)
+	return sc
+}
+
+func TestWasiSandbox(t *testing.T) {
+	env, call, closeFn := newWasiTestInstance(t, wasiSandboxWat)
+	defer closeFn()
+
+	uint64At := func(ptr int) uint64 { return binary.LittleEndian.Uint64(env.memory.Data()[ptr:]) }
+	random := func(n int32) []byte {
+		assert.Equal(t, int32(wasiErrnoSuccess), call("random", n))
+		return append([]byte{}, env.memory.Data()[64:64+n]...)
+	}
+
+	// out of an invocation the clocks start at 0 and the seed is zero
+	assert.Equal(t, int32(wasiErrnoSuccess), call("clock", int32(wasiClockRealtime)))
+	assert.Equal(t, uint64(0), uint64At(0))
+	unbound := random(40)
+
+	bindWasiTestBlock(env, 1700000000, "block1")
+	assert.Equal(t, int32(wasiErrnoSuccess), call("clock", int32(wasiClockRealtime)))
+	assert.Equal(t, uint64(1700000000)*1e9, uint64At(0))
+	assert.Equal(t, int32(wasiErrnoSuccess), call("clock", int32(wasiClockMonotonic)))
+	assert.Equal(t, uint64(0), uint64At(0))
+	assert.Equal(t, int32(wasiErrnoInval), call("clock", int32(9)))
+
+	// sleeping moves the clocks forward without waiting
+	subscription := env.memory.Data()[256 : 256+wasiPreview1Subscription.size]
+	binary.LittleEndian.PutUint64(subscription[0:], 42)
+	subscription[8] = wasiEventTypeClock
+	binary.LittleEndian.PutUint32(subscription[16:], wasiClockMonotonic)
+	binary.LittleEndian.PutUint64(subscription[24:], 5e6)
+	assert.Equal(t, int32(wasiErrnoSuccess), call("poll"))
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(env.memory.Data()[16:]))
+	assert.Equal(t, uint64(42), uint64At(512))
+	assert.Equal(t, int32(wasiErrnoSuccess), call("clock", int32(wasiClockRealtime)))
+	assert.Equal(t, uint64(1700000000)*1e9+5e6, uint64At(0))
+
+	// the random stream is derived from the tx and the block
+	first := random(40)
+	assert.NotEqual(t, unbound, first)
+	assert.NotEqual(t, first, random(40))
+	bindWasiTestBlock(env, 1700000000, "block1")
+	assert.Equal(t, first, random(40))
+	bindWasiTestBlock(env, 1700000000, "block2")
+	assert.NotEqual(t, first, random(40))
+
+	// no args, no env, no filesystem
+	assert.Equal(t, int32(wasiErrnoSuccess), call("args"))
+	assert.Equal(t, uint64(0), uint64At(8))
+	assert.Equal(t, int32(wasiErrnoBadf), call("prestat"))
+
+	env.unbind()
+	assert.Equal(t, unbound, random(40))
+}
+
+const wasiOutputWat = `(module
+  (import "wasi_snapshot_preview1" "fd_write" (func $write (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_unstable" "fd_write" (func $write_unstable (param i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 100) "hello\n")
+  (data (i32.const 200) "\64\00\00\00\06\00\00\00")
+  (func (export "write") (param i32) (result i32)
+    (call $write (local.get 0) (i32.const 200) (i32.const 1) (i32.const 300)))
+  (func (export "write_unstable") (param i32) (result i32)
+    (call $write_unstable (local.get 0) (i32.const 200) (i32.const 1) (i32.const 300))))`
+
+func TestWasiSandboxOutput(t *testing.T) {
+	env, call, closeFn := newWasiTestInstance(t, wasiOutputWat)
+	defer closeFn()
+
+	// the output out of an invocation is dropped
+	assert.Equal(t, int32(wasiErrnoSuccess), call("write", int32(wasiStdout)))
+	assert.Equal(t, uint32(6), binary.LittleEndian.Uint32(env.memory.Data()[300:]))
+	assert.Equal(t, 0, len(env.wasi.stdout))
+
+	sc := bindWasiTestBlock(env, 0, "")
+	assert.Equal(t, int32(wasiErrnoSuccess), call("write", int32(wasiStdout)))
+	assert.Equal(t, int32(wasiErrnoSuccess), call("write_unstable", int32(wasiStderr)))
+	assert.Equal(t, int32(wasiErrnoBadf), call("write", int32(3)))
+	assert.Equal(t, "hello\n", string(env.wasi.stdout))
+	assert.Equal(t, "hello\n", string(env.wasi.stderr))
+
+	// the output is only appended to the message of a failed invocation
+	env.reportOutput(sc)
+	assert.Equal(t, "", sc.ContractResult.Message)
+	sc.ContractResult.Code = 1
+	sc.ContractResult.Message = "contract invoke failed"
+	env.reportOutput(sc)
+	assert.Equal(t, "contract invoke failed. stderr: hello. stdout: hello", sc.ContractResult.Message)
+
+	// the output is capped
+	env.wasi.write(wasiStdout, make([]byte, wasiOutputLimit))
+	assert.Equal(t, wasiOutputLimit, len(env.wasi.stdout))
+	assert.True(t, env.wasi.truncated)
+
+	env.unbind()
+	assert.Equal(t, 0, len(env.wasi.stdout))
+}
+
+const wasiExitWat = `(module
+  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+  (memory (export "memory") 1)
+  (func (export "exit") (param i32) (result i32)
+    (call $exit (local.get 0))
+    (i32.const 0)))`
+
+func TestWasiProcExit(t *testing.T) {
+	env, _, closeFn := newWasiTestInstance(t, wasiExitWat)
+	defer closeFn()
+	exit := func(code int32) error {
+		fn, err := env.instance.Exports.GetRawFunction("exit")
+		assert.Nil(t, err)
+		defer fn.Close()
+		_, err = fn.Call(code)
+		// proc_exit never returns, the call is unwound by a trap
+		assert.NotNil(t, err)
+		return err
+	}
+
+	// the error of a call which did not exit is kept
+	exited, err := env.exitResult(errors.New("unreachable"))
+	assert.False(t, exited)
+	assert.EqualError(t, err, "unreachable")
+
+	// exit code 0 succeeds with the result recorded before
+	sc := bindWasiTestBlock(env, 0, "")
+	sc.ContractResult.Result = []byte("ok")
+	exited, err = env.exitResult(exit(0))
+	assert.True(t, exited)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(sc.ContractResult.Result))
+
+	bindWasiTestBlock(env, 0, "")
+	exited, err = env.exitResult(exit(3))
+	assert.True(t, exited)
+	assert.EqualError(t, err, "contract exited with code 3")
+
+	env.unbind()
+	exited, err = env.exitResult(nil)
+	assert.False(t, exited)
+	assert.Nil(t, err)
+}
+
+func TestWasiSandboxSnapshot(t *testing.T) {
+	// the Go runtime reads the clocks and seeds its hashes by random_get in _start,
+	// the instances of a contract start from the same memory on every node
+	wasmBytes, contractId, logger := prepareContract("./testdata/fib-go.wasm", t)
+	vmPool, err := newVmPool(&contractId, wasmBytes, DefaultPoolConfig(), nil, nil, nil, logger)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer vmPool.close()
+
+	first, err := vmPool.newInstanceFromModule()
+	assert.Nil(t, err)
+	defer vmPool.CloseInstance(first)
+	second, err := vmPool.newInstanceFromModule()
+	assert.Nil(t, err)
+	defer vmPool.CloseInstance(second)
+	assert.Equal(t, first.snapshot.memory, second.snapshot.memory)
+}
+
+const wasiUnstableWat = `(module
+  (import "wasi_unstable" "clock_time_get" (func $clock (param i32 i64 i32) (result i32)))
+  (import "wasi_unstable" "poll_oneoff" (func $poll (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_unstable" "proc_exit" (func $exit (param i32)))
+  (import "wasi_unstable" "fd_filestat_get" (func $filestat (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_read" (func $read (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "sock_accept" (func $accept (param i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_fdstat_get" (func $fdstat (param i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "clock") (param i32) (result i32)
+    (call $clock (local.get 0) (i64.const 1) (i32.const 0)))
+  (func (export "poll") (result i32)
+    (call $poll (i32.const 256) (i32.const 512) (i32.const 1) (i32.const 16)))
+  (func (export "exit") (param i32) (result i32)
+    (call $exit (local.get 0))
+    (i32.const 0))
+  (func (export "filestat") (result i32)
+    (call $filestat (i32.const 1) (i32.const 64)))
+  (func (export "read") (result i32)
+    (call $read (i32.const 0) (i32.const 200) (i32.const 1) (i32.const 300)))
+  (func (export "accept") (result i32)
+    (call $accept (i32.const 3) (i32.const 0) (i32.const 300)))
+  (func (export "fdstat") (param i32) (result i32)
+    (call $fdstat (local.get 0) (i32.const 64))))`
+
+func TestWasiSandboxUnstable(t *testing.T) {
+	env, call, closeFn := newWasiTestInstance(t, wasiUnstableWat)
+	defer closeFn()
+
+	// the clocks of wasi_unstable are the ones of the sandbox, its clock subscriptions have an identifier
+	bindWasiTestBlock(env, 1700000000, "block1")
+	subscription := env.memory.Data()[256 : 256+wasiUnstableSubscription.size]
+	binary.LittleEndian.PutUint64(subscription[0:], 42)
+	subscription[8] = wasiEventTypeClock
+	binary.LittleEndian.PutUint32(subscription[24:], wasiClockMonotonic)
+	binary.LittleEndian.PutUint64(subscription[32:], 5e6)
+	assert.Equal(t, int32(wasiErrnoSuccess), call("poll"))
+	assert.Equal(t, uint64(42), binary.LittleEndian.Uint64(env.memory.Data()[512:]))
+	assert.Equal(t, int32(wasiErrnoSuccess), call("clock", int32(wasiClockRealtime)))
+	assert.Equal(t, uint64(1700000000)*1e9+5e6, binary.LittleEndian.Uint64(env.memory.Data()[0:]))
+
+	// the functions which are not emulated fail alike on every node, in both namespaces
+	assert.Equal(t, int32(wasiErrnoNosys), call("filestat"))
+	assert.Equal(t, int32(wasiErrnoNosys), call("read"))
+	assert.Equal(t, int32(wasiErrnoNosys), call("accept"))
+
+	// the standard streams are character devices whatever the streams of the node are
+	assert.Equal(t, int32(wasiErrnoSuccess), call("fdstat", int32(wasiStdout)))
+	assert.Equal(t, byte(wasiFiletypeCharDevice), env.memory.Data()[64])
+	assert.Equal(t, wasiRightFdWrite, binary.LittleEndian.Uint64(env.memory.Data()[72:]))
+	assert.Equal(t, int32(wasiErrnoBadf), call("fdstat", int32(3)))
+
+	// proc_exit of wasi_unstable exits the runtime
+	fn, err := env.instance.Exports.GetRawFunction("exit")
+	assert.Nil(t, err)
+	defer fn.Close()
+	_, err = fn.Call(int32(3))
+	exited, err := env.exitResult(err)
+	assert.True(t, exited)
+	assert.EqualError(t, err, "contract exited with code 3")
+}
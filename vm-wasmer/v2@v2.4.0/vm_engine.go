@@ -0,0 +1,151 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"fmt"
+	"sync"
+
+	"chainmaker.org/chainmaker/logger/v2"
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"chainmaker.org/chainmaker/protocol/v2"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+)
+
+// engineSettings everything that changes the compiled code of a contract,
+// it is applied here only, and it is part of the module cache key
+type engineSettings struct {
+	meteringLimit uint64
+	meteringTable map[wasmergo.Opcode]uint32
+	maxPages      uint32
+}
+
+// defaultEngineSettings the settings used when the chain configures nothing
+func defaultEngineSettings() engineSettings {
+	return engineSettings{
+		meteringLimit: protocol.GasLimit,
+		meteringTable: map[wasmergo.Opcode]uint32{},
+		maxPages:      maxPagesLimit,
+	}
+}
+
+// newConfig build the wasmer config of the settings, the metering middleware is pushed only if table is not nil
+func (s engineSettings) newConfig(table *wasmergo.MeteringTable) *wasmergo.Config {
+	config := wasmergo.NewConfig()
+	if table != nil {
+		config.PushMeteringTable(s.meteringLimit, table)
+	}
+	//设置实例内存上限页数，每页64KB
+	//如果不设置默认上限为256页
+	config.MaxPagesLimit(s.maxPages)
+	return config
+}
+
+// description identifies the compiler settings, it is part of the module cache key
+func (s engineSettings) description() string {
+	return fmt.Sprintf("wasmer-%s/default-compiler/max-pages-%d", wasmergo.Version(), s.maxPages)
+}
+
+// key engines of the same key are interchangeable
+func (s engineSettings) key() string {
+	return fmt.Sprintf("%s/metering-%x", s.description(), meteringTableHash(s.meteringLimit, s.meteringTable))
+}
+
+// cacheKey the module cache key of the byte code compiled by the settings
+func (s engineSettings) cacheKey(byteCode []byte) moduleCacheKey {
+	return newModuleCacheKey(byteCode, s.description(), s.meteringLimit, s.meteringTable)
+}
+
+// sharedEngine a configured wasmer engine shared by all the vm pools of the same settings.
+//
+// The wasmer metering middleware binds itself to the first module it transforms, so an engine
+// carrying it can compile only one module. Contracts are compiled by a short-lived engine carrying
+// the middleware, and the artifact is loaded into the shared engine, which runs every module.
+// Each pool still owns a store of the shared engine, because a store keeps every instance it
+// created alive until it is closed, closing the store of a pool is what frees its instances.
+type sharedEngine struct {
+	settings engineSettings
+	engine   *wasmergo.Engine
+}
+
+func newSharedEngine(settings engineSettings) *sharedEngine {
+	return &sharedEngine{
+		settings: settings,
+		engine:   wasmergo.NewEngineWithConfig(settings.newConfig(nil)),
+	}
+}
+
+// newStore return a new store of the shared engine, wasmer engines are safe for concurrent use
+func (e *sharedEngine) newStore() *wasmergo.Store {
+	return wasmergo.NewStore(e.engine)
+}
+
+// compile the byte code with a one-off metered engine, and load it into store of the shared engine,
+// the serialized artifact is returned for the module cache.
+// The cost table is bound to a metering slot only while compiling, engines of different settings
+// compile concurrently with their own costs
+func (e *sharedEngine) compile(store *wasmergo.Store, contractId *commonPb.Contract, byteCode []byte,
+	log *logger.CMLogger) (*wasmergo.Module, []byte, error) {
+	table := wasmergo.NewMeteringTable(e.settings.meteringTable)
+	defer table.Release()
+	compileStore := wasmergo.NewStore(wasmergo.NewEngineWithConfig(e.settings.newConfig(table)))
+	defer compileStore.Close()
+
+	compiled, err := wasmergo.NewModule(compileStore, byteCode, log)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%s_%s], byte code compile failed, %v", contractId.Name, contractId.Version, err)
+	}
+	artifact, err := compiled.Serialize()
+	compiled.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%s_%s], serialize compiled module failed, %v",
+			contractId.Name, contractId.Version, err)
+	}
+
+	module, err := wasmergo.DeserializeModule(store, artifact)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%s_%s], load compiled module failed, %v",
+			contractId.Name, contractId.Version, err)
+	}
+	return module, artifact, nil
+}
+
+// engineRegistry the shared engines of a chain, one per engineSettings.key
+type engineRegistry struct {
+	lock    sync.Mutex
+	engines map[string]*sharedEngine
+}
+
+func newEngineRegistry() *engineRegistry {
+	return &engineRegistry{
+		engines: make(map[string]*sharedEngine),
+	}
+}
+
+// get return the shared engine of the settings, build it on the first call
+func (r *engineRegistry) get(settings engineSettings) *sharedEngine {
+	key := settings.key()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	engine, ok := r.engines[key]
+	if !ok {
+		engine = newSharedEngine(settings)
+		r.engines[key] = engine
+	}
+	return engine
+}
+
+// defaultEngines serves the pools built without an InstancesManager, e.g. in tests
+var defaultEngines = newEngineRegistry()
+
+// defaultEngine return the process wide shared engine of the default settings
+func defaultEngine() *sharedEngine {
+	return defaultEngines.get(defaultEngineSettings())
+}
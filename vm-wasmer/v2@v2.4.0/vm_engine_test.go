@@ -0,0 +1,96 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineRegistry(t *testing.T) {
+	registry := newEngineRegistry()
+
+	settings := defaultEngineSettings()
+	engine := registry.get(settings)
+	assert.Equal(t, engine, registry.get(defaultEngineSettings()))
+
+	other := defaultEngineSettings()
+	other.meteringTable = map[wasmergo.Opcode]uint32{wasmergo.I32Add: 1}
+	assert.NotEqual(t, engine, registry.get(other))
+	assert.NotEqual(t, settings.cacheKey([]byte("a")), other.cacheKey([]byte("a")))
+}
+
+func TestSharedEngineConcurrentPools(t *testing.T) {
+	files := []string{
+		"./testdata/rust-counter-2.0.0.wasm",
+		"./testdata/rust-fact-2.0.0.wasm",
+		"./testdata/rust-asset-2.0.0.wasm",
+		"./testdata/rust-func-verify-2.0.0.wasm",
+		"./testdata/rust-crypto-2.0.0.wasm",
+	}
+
+	manager, err := NewInstancesManager(ChainId, map[string]interface{}{
+		"pool": map[string]interface{}{"min_size": 2},
+	})
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+
+	// compile many contracts at once, several versions of each
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var pools []*vmPool
+	for i := 0; i < len(files)*4; i++ {
+		wg.Add(1)
+		go func(no int) {
+			defer wg.Done()
+			wasmBytes, contractId, _ := prepareContract(files[no%len(files)], t)
+			contractId.Name = fmt.Sprintf("contract_%d", no%len(files))
+			contractId.Version = fmt.Sprintf("v%d", no/len(files))
+
+			pool, err := manager.getVmPool(&contractId, wasmBytes, baseGasSchedule(), nil)
+			if !assert.Nil(t, err) {
+				return
+			}
+			lock.Lock()
+			pools = append(pools, pool)
+			lock.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, len(files)*4, len(pools))
+
+	// all the pools run on the same engine
+	engine := manager.engines.get(defaultEngineSettings())
+	for _, pool := range pools {
+		assert.Equal(t, engine.engine, pool.store.Engine)
+	}
+
+	// and their instances are used concurrently
+	for _, pool := range pools {
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(pool *vmPool) {
+				defer wg.Done()
+				instance, err := pool.GetInstance(context.Background())
+				if !assert.Nil(t, err) {
+					return
+				}
+				defer pool.RevertInstance(instance)
+				assert.Nil(t, instance.restore())
+				instance.wasmInstance.SetGasLimit(1000)
+				assert.Equal(t, uint64(1000), instance.wasmInstance.GetGasRemaining())
+			}(pool)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,92 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"fmt"
+
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+)
+
+const (
+	wasiStartFunc      = "_start"
+	wasiInitializeFunc = "_initialize"
+)
+
+// wasiEntrypoint how the runtime of a module is booted, once per instance, before any contract method is called
+type wasiEntrypoint int
+
+const (
+	// no WASI entrypoint, e.g. rust and c contracts
+	entrypointNone wasiEntrypoint = iota
+	// command module, _start runs main, the Go runtime exits when main returns
+	entrypointCommand
+	// reactor module, e.g. Go -buildmode=c-shared, _initialize boots the runtime and returns,
+	// the contract methods (//go:wasmexport) are then called into the running runtime
+	entrypointReactor
+)
+
+func (e wasiEntrypoint) String() string {
+	switch e {
+	case entrypointCommand:
+		return "command"
+	case entrypointReactor:
+		return "reactor"
+	}
+	return "none"
+}
+
+// detectEntrypoint a module exporting _initialize is a reactor, one exporting _start is a command
+func detectEntrypoint(module *wasmergo.Module) wasiEntrypoint {
+	entrypoint := entrypointNone
+	for _, export := range module.Exports() {
+		if export.Type().Kind() != wasmergo.FUNCTION {
+			continue
+		}
+		switch export.Name() {
+		case wasiInitializeFunc:
+			return entrypointReactor
+		case wasiStartFunc:
+			entrypoint = entrypointCommand
+		}
+	}
+	return entrypoint
+}
+
+// boot run the entrypoint of a new instance, the sandbox of env is unbound.
+//
+// A command must end with main returning or with proc_exit(0), the instance is unusable if _start traps
+// or exits with another code.
+// A reactor must return from _initialize, the instance is unusable if it traps or exits.
+func (e wasiEntrypoint) boot(instance *wasmergo.Instance, env *CMEnvironment) error {
+	defer env.unbind()
+	switch e {
+	case entrypointCommand:
+		start, _ := instance.Exports.GetWasiStartRawFunction()
+		if start == nil {
+			return nil
+		}
+		_, err := start.Call()
+		if _, exitErr := env.exitResult(err); exitErr != nil {
+			return fmt.Errorf("%s %s", wasiStartFunc, exitErr.Error())
+		}
+	case entrypointReactor:
+		initialize, err := instance.Exports.GetRawFunction(wasiInitializeFunc)
+		if err != nil {
+			return err
+		}
+		defer initialize.Close()
+		_, err = initialize.Call()
+		if exited, exitErr := env.exitResult(err); exitErr != nil {
+			return fmt.Errorf("%s failed, %s", wasiInitializeFunc, exitErr.Error())
+		} else if exited {
+			return fmt.Errorf("%s exited the runtime", wasiInitializeFunc)
+		}
+	}
+	return nil
+}
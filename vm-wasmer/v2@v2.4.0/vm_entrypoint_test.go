@@ -0,0 +1,156 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"testing"
+
+	logger2 "chainmaker.org/chainmaker/logger/v2"
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	endReturns = ""
+	endExits   = "(call $exit (i32.const 0))"
+	endFails   = "(call $exit (i32.const 2))"
+	endTraps   = "(unreachable)"
+)
+
+// entrypointWat a module booted by the entrypoint, which counts its boots at address 0 and then ends as given,
+// the method boots reads the count
+func entrypointWat(entrypoint string, end string) string {
+	return `(module
+  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+  (memory (export "memory") 1)
+  (func (export "` + entrypoint + `")
+    (i32.store (i32.const 0) (i32.add (i32.load (i32.const 0)) (i32.const 1)))
+    ` + end + `)
+  (func (export "boots") (result i32)
+    (i32.load (i32.const 0))))`
+}
+
+func newEntrypointTestPool(t *testing.T, wat string) (*vmPool, error) {
+	wasm, err := wasmergo.Wat2Wasm(wat)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	contractId := &commonPb.Contract{Name: "entrypoint", Version: "1.0.0", RuntimeType: commonPb.RuntimeType_WASMER}
+	return newVmPool(contractId, wasm, DefaultPoolConfig(), nil, nil, nil, logger2.GetLogger("unit_test"))
+}
+
+func TestDetectEntrypoint(t *testing.T) {
+	store := defaultEngine().newStore()
+	defer store.Close()
+	cases := []struct {
+		file       string
+		wat        string
+		entrypoint wasiEntrypoint
+	}{
+		{file: "rust-counter-2.0.0.wasm", entrypoint: entrypointNone},
+		{file: "fib-go.wasm", entrypoint: entrypointCommand},
+		{wat: entrypointWat(wasiStartFunc, endExits), entrypoint: entrypointCommand},
+		{wat: entrypointWat(wasiInitializeFunc, endReturns), entrypoint: entrypointReactor},
+		// _initialize must be a function
+		{wat: `(module (global (export "_initialize") i32 (i32.const 0)))`, entrypoint: entrypointNone},
+	}
+	for i, c := range cases {
+		var wasm []byte
+		var err error
+		if c.file != "" {
+			wasm, _, _ = prepareContract("./testdata/"+c.file, t)
+		} else if wasm, err = wasmergo.Wat2Wasm(c.wat); !assert.Nil(t, err) {
+			continue
+		}
+		module, err := wasmergo.NewModule(store, wasm, nil)
+		if !assert.Nil(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.entrypoint.String(), detectEntrypoint(module).String(), "case %d", i)
+		module.Close()
+	}
+}
+
+func TestEntrypointBoot(t *testing.T) {
+	// a command exits when main returns, a reactor returns from _initialize,
+	// both are booted once per instance and their methods are called directly
+	for entrypoint, end := range map[string]string{wasiStartFunc: endExits, wasiInitializeFunc: endReturns} {
+		vmPool, err := newEntrypointTestPool(t, entrypointWat(entrypoint, end))
+		if !assert.Nil(t, err, entrypoint) {
+			continue
+		}
+		instance, err := vmPool.newInstanceFromModule()
+		if assert.Nil(t, err, entrypoint) {
+			assert.False(t, instance.env.wasi.exited)
+			boots, err := instance.wasmInstance.Exports.GetFunction("boots")
+			assert.Nil(t, err)
+			count, err := boots()
+			assert.Nil(t, err)
+			assert.Equal(t, int32(1), count, entrypoint)
+			vmPool.CloseInstance(instance)
+		}
+		vmPool.close()
+	}
+
+	cases := []struct {
+		wat string
+		err string
+	}{
+		{wat: entrypointWat(wasiStartFunc, endReturns)},
+		{wat: entrypointWat(wasiStartFunc, endFails), err: "_start contract exited with code 2"},
+		{wat: entrypointWat(wasiStartFunc, endTraps), err: "_start"},
+		{wat: entrypointWat(wasiInitializeFunc, endExits), err: "_initialize exited the runtime"},
+		{wat: entrypointWat(wasiInitializeFunc, endFails), err: "_initialize failed, contract exited with code 2"},
+		{wat: entrypointWat(wasiInitializeFunc, endTraps), err: "_initialize failed"},
+	}
+	for i, c := range cases {
+		vmPool, err := newEntrypointTestPool(t, c.wat)
+		if c.err == "" {
+			if assert.Nil(t, err, "case %d", i) {
+				vmPool.close()
+			}
+		} else if assert.NotNil(t, err, "case %d", i) {
+			assert.Contains(t, err.Error(), c.err, "case %d", i)
+		}
+	}
+}
+
+func TestInvokeReactorGo(t *testing.T) {
+	// the methods of a Go reactor are called after _initialize, every tx must start from the state it left,
+	// whether the previous tx returned or panicked
+	wasmBytes, contractId, logger := prepareContract("./testdata/reactor-go.wasm", t)
+	parameters := map[string][]byte{}
+	fillingBaseParams(parameters)
+
+	manager, err := NewInstancesManager(ChainId, nil)
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+	runtimeInst, err := manager.NewRuntimeInstance(nil, "", "", "", &contractId, wasmBytes, logger)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, entrypointReactor, runtimeInst.(*RuntimeInstance).Pool().entrypoint)
+
+	invoke := func(method string) *commonPb.ContractResult {
+		txSimContext := prepareTxSimContext(ChainId, BlockVersion, contractId.Name, method, parameters, SnapshotMock{})
+		result, _ := runtimeInst.Invoke(&contractId, method, wasmBytes, parameters, txSimContext, 0)
+		return result
+	}
+	for i := 0; i < 5; i++ {
+		result := invoke("increase")
+		assert.Equal(t, uint32(0), result.Code, "tx %d: %s", i, result.Message)
+	}
+
+	result := invoke("fail")
+	assert.Equal(t, uint32(1), result.Code)
+	assert.Contains(t, result.Message, "fail called")
+
+	result = invoke("increase")
+	assert.Equal(t, uint32(0), result.Code, result.Message)
+}
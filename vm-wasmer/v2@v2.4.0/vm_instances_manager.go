@@ -9,7 +9,9 @@ package wasmer
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"chainmaker.org/chainmaker/logger/v2"
 	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
@@ -17,6 +19,19 @@ import (
 	"chainmaker.org/chainmaker/utils/v2"
 )
 
+// if idle ttl is not set or too long, idle pools and memory budget are checked in this interval
+const defaultEvictInterval = time.Minute
+
+// poolBuild a vm pool being built out of the manager lock,
+// callers asking for the same contract wait for it and share the result
+type poolBuild struct {
+	done chan struct{}
+	pool *vmPool
+	err  error
+	// the contract was closed while its pool was being built, the pool is closed once built
+	cancelled bool
+}
+
 // InstancesManager manages vm pools for all contracts
 type InstancesManager struct {
 	// chain identifier
@@ -25,18 +40,59 @@ type InstancesManager struct {
 	m sync.RWMutex
 	// contractName_contractVersion -> vm pool
 	instanceMap map[string]*vmPool
+	// contractName_contractVersion -> vm pool being built, guarded by m
+	building map[string]*poolBuild
+	// pool sizing policy of the chain and the per-contract overrides
+	poolConfigs *poolConfigs
+	// compiled module cache on disk, nil if disabled
+	moduleCache *moduleCache
+	// wasmer engines shared by the vm pools of the chain
+	engines *engineRegistry
+	// opcode gas costs by block version, governed by the chain config
+	gasSchedules *chainGasSchedules
+	// stop signal of the evicting loop, nil if the loop is not running
+	evictStopC chan struct{}
+	// set to the runtime instances created, guarded by m
+	profiler *GasProfiler
 	// module log
 	log *logger.CMLogger
 }
 
-// NewInstancesManager return InstancesManager for every chain
-func NewInstancesManager(chainId string) *InstancesManager {
+// NewInstancesManager return InstancesManager for every chain,
+// configs is the vm config map passed by vm.Provider, it may be nil
+func NewInstancesManager(chainId string, configs map[string]interface{}) (*InstancesManager, error) {
+	poolConfigs, err := parsePoolConfigs(configs)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] parse wasmer vm config failed, %v", chainId, err)
+	}
+
+	log := logger.GetLoggerByChain(logger.MODULE_VM, chainId)
+	if _, ok := configs[configKeyGasSchedules]; ok {
+		log.Warnf("[%s] %s of the vm config is ignored, the gas schedules are set by %s of the chain config",
+			chainId, configKeyGasSchedules, chainConfigKeyGasSchedules)
+	}
+	var cacheDir string
+	if dir, ok := configs[configKeyModuleCacheDir]; ok && dir != nil {
+		if cacheDir, ok = dir.(string); !ok {
+			return nil, fmt.Errorf("[%s] invalid %s config, expect a string, got %T", chainId, configKeyModuleCacheDir, dir)
+		}
+	}
+	moduleCache, err := newModuleCache(cacheDir, log)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", chainId, err)
+	}
+
 	vmPoolManager := &InstancesManager{
-		instanceMap: make(map[string]*vmPool),
-		log:         logger.GetLoggerByChain(logger.MODULE_VM, chainId),
-		chainId:     chainId,
+		instanceMap:  make(map[string]*vmPool),
+		building:     make(map[string]*poolBuild),
+		poolConfigs:  poolConfigs,
+		moduleCache:  moduleCache,
+		engines:      newEngineRegistry(),
+		gasSchedules: newChainGasSchedules(),
+		log:          log,
+		chainId:      chainId,
 	}
-	return vmPoolManager
+	return vmPoolManager, nil
 }
 
 // NewRuntimeInstance init vm pool and check byteCode correctness
@@ -59,21 +115,47 @@ func (m *InstancesManager) NewRuntimeInstance(
 		return nil, err
 	}
 
-	pool, err := m.getVmPool(contract, byteCode)
-	if err != nil || pool == nil {
+	schedule, err := m.gasSchedules.selectFor(txSimContext)
+	if err != nil {
+		m.log.Warn(err)
+		return nil, err
+	}
+	// the imports of a contract are checked when it is deployed or upgraded, before it is ever instantiated
+	var allowList *importAllowList
+	if txSimContext != nil && (method == InitContractFunc || method == UpgradeContractFunc) {
+		allowList = selectImportAllowList(txSimContext.GetBlockVersion())
+	}
+	pool, err := m.getVmPool(contract, byteCode, schedule, allowList)
+	if err != nil {
+		m.log.Warn(err)
 		return nil, err
 	}
+	if pool == nil {
+		return nil, nil
+	}
 
+	m.m.RLock()
+	profiler := m.profiler
+	m.m.RUnlock()
 	runtime := &RuntimeInstance{
 		pool:             pool,
 		log:              m.log,
 		chainId:          m.chainId,
 		instancesManager: m,
+		profiler:         profiler,
 	}
 
 	return runtime, nil
 }
 
+// SetGasProfiler profile the invocations of the runtime instances created from now on,
+// cross contract calls included, nil turns profiling off, see GasProfiler
+func (m *InstancesManager) SetGasProfiler(profiler *GasProfiler) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.profiler = profiler
+}
+
 // CloseRuntimeInstance comment at next version
 func (m *InstancesManager) CloseRuntimeInstance(
 	contractName string,
@@ -88,34 +170,106 @@ func (m *InstancesManager) CloseRuntimeInstance(
 	return nil
 }
 
-func (m *InstancesManager) getVmPool(contractId *commonPb.Contract, byteCode []byte) (*vmPool, error) {
-	var err error
+// getVmPool return the vm pool of the contract compiled by the gas schedule,
+// build it if it does not exist, or rebuild it if it was compiled by another schedule.
+// The pool is compiled and grown out of the manager lock, so that building a large contract
+// never blocks the other contracts, callers asking for the same contract share one build.
+// The imports of the contract are checked against allowList if it is not nil, see newVmPool.
+func (m *InstancesManager) getVmPool(contractId *commonPb.Contract, byteCode []byte,
+	schedule *GasSchedule, allowList *importAllowList) (*vmPool, error) {
 	key := contractId.Name + "_" + contractId.Version
+	engine := m.engines.get(schedule.settings)
 
 	m.m.RLock()
 	pool, ok := m.instanceMap[key]
 	m.m.RUnlock()
-	if !ok {
+	if ok && pool.engine == engine {
+		return pool, allowList.check(contractId, pool.module)
+	}
+
+	for {
 		m.m.Lock()
-		defer m.m.Unlock()
+		if pool, ok = m.instanceMap[key]; ok {
+			if pool.engine == engine {
+				m.m.Unlock()
+				return pool, allowList.check(contractId, pool.module)
+			}
+			// a new gas schedule takes effect, the pool of the old one is never used again
+			m.log.Infof("[%s] gas schedule of block version %d takes effect, rebuild vm pool", key,
+				schedule.BlockVersion)
+			pool.close()
+			delete(m.instanceMap, key)
+		}
+		if build, ok := m.building[key]; ok {
+			m.m.Unlock()
+			<-build.done
+			if build.err != nil {
+				return nil, build.err
+			}
+			if build.pool.engine == engine {
+				// built for a caller which may not have checked the imports
+				return build.pool, allowList.check(contractId, build.pool.module)
+			}
+			// built for another gas schedule
+			continue
+		}
+		build := &poolBuild{done: make(chan struct{})}
+		m.building[key] = build
+		m.m.Unlock()
 
-		pool, ok = m.instanceMap[key]
-		if !ok {
-			start := utils.CurrentTimeMillisSeconds()
-			m.log.Infof("[%s] init vm pool start", key)
+		m.runBuild(key, build, contractId, byteCode, engine, allowList)
+		return build.pool, build.err
+	}
+}
 
-			pool, err = newVmPool(contractId, byteCode, m.log)
-			if err != nil {
-				return nil, err
-			}
+// runBuild build the pool, the waiters are woken up even if building panics
+func (m *InstancesManager) runBuild(key string, build *poolBuild, contractId *commonPb.Contract, byteCode []byte,
+	engine *sharedEngine, allowList *importAllowList) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			build.pool, build.err = nil, fmt.Errorf("[%s] init vm pool failed, %v", key, panicErr)
+		}
+		m.finishBuild(key, build)
+	}()
+	build.pool, build.err = m.buildVmPool(key, contractId, byteCode, engine, allowList)
+}
+
+// buildVmPool compile the contract and grow the pool to its min size
+func (m *InstancesManager) buildVmPool(key string, contractId *commonPb.Contract, byteCode []byte,
+	engine *sharedEngine, allowList *importAllowList) (*vmPool, error) {
+	start := utils.CurrentTimeMillisSeconds()
+	m.log.Infof("[%s] init vm pool start", key)
+
+	pool, err := newVmPool(contractId, byteCode, m.poolConfigs.get(contractId), engine, m.moduleCache, allowList,
+		m.log)
+	if err != nil {
+		return nil, err
+	}
 
-			pool.grow(defaultMinSize)
-			m.instanceMap[key] = pool
-			end := utils.CurrentTimeMillisSeconds()
-			m.log.Infof("[%s] init vmPool done, currentSize=%d, spend %dms", key, pool.currentSize, end-start)
+	pool.grow(pool.config.MinSize)
+	end := utils.CurrentTimeMillisSeconds()
+	m.log.Infof("[%s] init vmPool done, currentSize=%d, spend %dms", key, pool.currentSize, end-start)
+	return pool, nil
+}
+
+// finishBuild publish the built pool and wake up the callers waiting for it
+func (m *InstancesManager) finishBuild(key string, build *poolBuild) {
+	m.m.Lock()
+	delete(m.building, key)
+	if build.err == nil {
+		if build.cancelled {
+			// callers retaining the closed pool get a new one, see RuntimeInstance.acquirePool
+			m.log.Infof("[%s] vm pool is closed while it was being built", key)
+			build.pool.close()
+		} else {
+			m.instanceMap[key] = build.pool
+			if m.poolConfigs.memoryBudget > 0 {
+				m.evictPoolsLocked(key)
+			}
 		}
 	}
-	return pool, err
+	m.m.Unlock()
+	close(build.done)
 }
 
 // CloseAVmPool close the contract vm pool
@@ -124,6 +278,9 @@ func (m *InstancesManager) CloseAVmPool(contractId *commonPb.Contract) {
 	defer m.m.Unlock()
 
 	key := contractId.Name + "_" + contractId.Version
+	if build, ok := m.building[key]; ok {
+		build.cancelled = true
+	}
 	pool, ok := m.instanceMap[key]
 	if ok {
 		m.log.Infof("close pool %s", key)
@@ -137,6 +294,9 @@ func (m *InstancesManager) CloseAllVmPool() {
 	m.m.Lock()
 	defer m.m.Unlock()
 
+	for _, build := range m.building {
+		build.cancelled = true
+	}
 	for key, pool := range m.instanceMap {
 		m.log.Infof("close pool %s", key)
 		pool.close()
@@ -169,16 +329,104 @@ func (m *InstancesManager) ResetAllPool() {
 	}
 }
 
-// StartVM comment at next version
+// StartVM start the evicting loop if memory budget or idle ttl is configured
 func (m *InstancesManager) StartVM() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if m.evictStopC == nil && (m.poolConfigs.memoryBudget > 0 || m.poolConfigs.idleTTL > 0) {
+		m.evictStopC = make(chan struct{})
+		go m.startEvictingLoop(m.evictStopC)
+	}
 	return nil
 }
 
-// StopVM comment at next version
+// StopVM stop the evicting loop
 func (m *InstancesManager) StopVM() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if m.evictStopC != nil {
+		close(m.evictStopC)
+		m.evictStopC = nil
+	}
 	return nil
 }
 
+func (m *InstancesManager) startEvictingLoop(stopC chan struct{}) {
+	interval := defaultEvictInterval
+	if ttl := m.poolConfigs.idleTTL; ttl > 0 && ttl/2 < interval {
+		interval = ttl / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.evictPools()
+		case <-stopC:
+			return
+		}
+	}
+}
+
+// evictPools close the idle pools that expired or exceed the memory budget
+func (m *InstancesManager) evictPools() {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.evictPoolsLocked("")
+}
+
+// evictPoolsLocked close the pools idle longer than idle ttl, then close the least recently used
+// idle pools until the estimated memory fits the budget, pools in use and pool of keepKey are kept,
+// an evicted pool is rebuilt by the next getVmPool, the caller should hold m.m
+func (m *InstancesManager) evictPoolsLocked(keepKey string) {
+	type candidate struct {
+		key       string
+		pool      *vmPool
+		idleSince int64
+	}
+
+	var total int64
+	candidates := make([]candidate, 0, len(m.instanceMap))
+	for key, pool := range m.instanceMap {
+		total += pool.estimatedMemory()
+		if key == keepKey {
+			continue
+		}
+		if since := pool.idleSince(); since >= 0 {
+			candidates = append(candidates, candidate{key: key, pool: pool, idleSince: since})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].idleSince < candidates[j].idleSince
+	})
+
+	now := utils.CurrentTimeMillisSeconds()
+	ttl := m.poolConfigs.idleTTL.Milliseconds()
+	budget := m.poolConfigs.memoryBudget
+	for _, c := range candidates {
+		expired := ttl > 0 && now-c.idleSince >= ttl
+		overBudget := budget > 0 && total > budget
+		if !expired && !overBudget {
+			// candidates are sorted from the least recently used
+			break
+		}
+
+		memory := c.pool.estimatedMemory()
+		if !c.pool.tryEvict() {
+			continue
+		}
+		delete(m.instanceMap, c.key)
+		c.pool.close()
+		total -= memory
+		m.log.Infof("evict vm pool %s, idle %dms, estimated memory %d bytes, total %d bytes",
+			c.key, now-c.idleSince, memory, total)
+	}
+}
+
 // BeforeSchedule add request before block schedule
 func (m *InstancesManager) BeforeSchedule(blockFingerprint string, blockHeight uint64) {
 }
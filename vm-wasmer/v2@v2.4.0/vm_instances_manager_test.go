@@ -9,7 +9,13 @@ package wasmer
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewRuntimeInstance(t *testing.T) {
@@ -27,7 +33,10 @@ func TestNewRuntimeInstance(t *testing.T) {
 
 	txSimContext := prepareTxSimContext(chainId, blockVersion, contractName, method, parameters, SnapshotMock{})
 
-	manager := NewInstancesManager(chainId)
+	manager, err := NewInstancesManager(chainId, nil)
+	if err != nil {
+		t.Fatalf("NewInstancesManager() error: %v", err)
+	}
 	runtimeInst, err := manager.NewRuntimeInstance(
 		nil, "", "", "", // parameters is no use for wasmer
 		&contractId, wasmBytes, logger)
@@ -41,3 +50,127 @@ func TestNewRuntimeInstance(t *testing.T) {
 	result, _ = runtimeInst.Invoke(&contractId, method, wasmBytes, parameters, txSimContext, 0)
 	fmt.Printf("2) execute result = %v", result)
 }
+
+func TestEvictIdlePools(t *testing.T) {
+	wasmBytes, contractId, _ := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+
+	manager, err := NewInstancesManager(ChainId, map[string]interface{}{
+		"pool": map[string]interface{}{
+			"min_size": 1,
+			"idle_ttl": "10ms",
+		},
+	})
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+
+	pool, err := manager.getVmPool(&contractId, wasmBytes, baseGasSchedule(), nil)
+	assert.Nil(t, err)
+
+	// a pool in use is never evicted
+	assert.True(t, pool.retain())
+	time.Sleep(20 * time.Millisecond)
+	manager.evictPools()
+	assert.Equal(t, 1, len(manager.instanceMap))
+
+	pool.release()
+	time.Sleep(20 * time.Millisecond)
+	manager.evictPools()
+	assert.Equal(t, 0, len(manager.instanceMap))
+	assert.False(t, pool.retain())
+
+	// the runtime instance created before eviction rebuilds the pool transparently
+	runtime := &RuntimeInstance{pool: pool, log: manager.log, chainId: ChainId, instancesManager: manager}
+	newPool, err := runtime.acquirePool(&contractId, wasmBytes, baseGasSchedule())
+	assert.Nil(t, err)
+	assert.NotEqual(t, pool, newPool)
+	newPool.release()
+	assert.Equal(t, 1, len(manager.instanceMap))
+}
+
+func TestEvictPoolsOverMemoryBudget(t *testing.T) {
+	wasmBytes, contractId, _ := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+
+	manager, err := NewInstancesManager(ChainId, map[string]interface{}{
+		"pool": map[string]interface{}{
+			"min_size":         1,
+			"memory_budget_mb": 1,
+		},
+	})
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+
+	first := contractId
+	second := commonPb.Contract{Name: contractId.Name + "_2", Version: contractId.Version}
+
+	_, err = manager.getVmPool(&first, wasmBytes, baseGasSchedule(), nil)
+	assert.Nil(t, err)
+	_, err = manager.getVmPool(&second, wasmBytes, baseGasSchedule(), nil)
+	assert.Nil(t, err)
+
+	// the least recently used pool is evicted to make room for the new one
+	_, ok := manager.instanceMap[first.Name+"_"+first.Version]
+	assert.False(t, ok)
+	_, ok = manager.instanceMap[second.Name+"_"+second.Version]
+	assert.True(t, ok)
+}
+
+func TestGetVmPoolSingleFlight(t *testing.T) {
+	wasmBytes, contractId, _ := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+	contractB := contractId
+	contractB.Name = contractId.Name + "_b"
+
+	manager, err := NewInstancesManager(ChainId, map[string]interface{}{
+		"pool": map[string]interface{}{"min_size": 1},
+	})
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+
+	// concurrent callers of the same contract share one pool
+	var wg sync.WaitGroup
+	pools := make([]*vmPool, 10)
+	for i := range pools {
+		wg.Add(1)
+		go func(no int) {
+			defer wg.Done()
+			pool, err := manager.getVmPool(&contractId, wasmBytes, baseGasSchedule(), nil)
+			assert.Nil(t, err)
+			pools[no] = pool
+		}(i)
+	}
+	wg.Wait()
+	for _, pool := range pools {
+		assert.Equal(t, pools[0], pool)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pools[0].currentSize))
+
+	// contract b is being built for long, it blocks neither contract a nor others
+	keyB := contractB.Name + "_" + contractB.Version
+	build := &poolBuild{done: make(chan struct{})}
+	manager.m.Lock()
+	manager.building[keyB] = build
+	manager.m.Unlock()
+
+	waiterDone := make(chan error)
+	go func() {
+		_, err := manager.getVmPool(&contractB, wasmBytes, baseGasSchedule(), nil)
+		waiterDone <- err
+	}()
+
+	contractC := contractId
+	contractC.Name = contractId.Name + "_c"
+	_, err = manager.getVmPool(&contractC, wasmBytes, baseGasSchedule(), nil)
+	assert.Nil(t, err)
+	select {
+	case <-waiterDone:
+		t.Fatalf("caller of contract b should wait for the build")
+	default:
+	}
+
+	// the waiter shares the result of the build
+	manager.m.Lock()
+	delete(manager.building, keyB)
+	manager.m.Unlock()
+	build.err = fmt.Errorf("compile failed")
+	close(build.done)
+	assert.Equal(t, build.err, <-waiterDone)
+}
@@ -8,9 +8,10 @@ SPDX-License-Identifier: Apache-2.0
 package wasmer
 
 import (
-	"chainmaker.org/chainmaker/protocol/v2"
+	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
 )
 
+// default values of PoolConfig, see vm_pool_config.go
 const (
 	// refresh vmPool time, use for grow or shrink
 	defaultRefreshTime = time.Hour * 12
@@ -36,8 +38,19 @@ const (
 	defaultApplyThreshold = 100
 	// if wasmer instance invoke error more than N times, should close and discard this instance
 	defaultDiscardCount = 10
+	// max wait time to get an instance from an exhausted pool
+	defaultAcquireTimeout = time.Second * 10
+	// max callers waiting for an exhausted pool, more callers fail immediately
+	defaultMaxWaiters = 1000
 )
 
+// 实例内存上限页数，每页64KB
+const maxPagesLimit = 128
+
+// compiled machine code is usually a few times larger than the wasm byte code,
+// used to estimate the memory held by a module
+const compiledCodeFactor = 3
+
 // OpCode，wasm运算符表，在计算gas时是依据这些运算指令计算
 const (
 	Unreachable        wasmergo.Opcode = 0
@@ -564,6 +577,10 @@ type vmPool struct {
 	byteCode   []byte
 	store      *wasmergo.Store
 	module     *wasmergo.Module
+	// how the runtime of an instance is booted, see vm_entrypoint.go
+	entrypoint wasiEntrypoint
+	// the shared engine the module is compiled for
+	engine *sharedEngine
 	// wasmergo instance pool
 	instances chan *wrappedInstance
 	// current instance size in pool
@@ -575,13 +592,54 @@ type vmPool struct {
 	// total application count for pool grow
 	// if we cannot get instance right now, applyGrowCount++
 	applyGrowCount int32
+	// applications not yet handled by the refreshing loop
+	pendingApplies int32
+	// callers waiting in GetInstance
+	waiters int32
 	// apply signal channel
-	applySignalC    chan struct{}
-	closeC          chan struct{}
-	resetC          chan struct{}
-	removeInstanceC chan struct{}
-	addInstanceC    chan struct{}
-	log             *logger.CMLogger
+	applySignalC chan struct{}
+	closeC       chan struct{}
+	resetC       chan struct{}
+	addInstanceC chan struct{}
+	// discarded instances not yet replaced by the refreshing loop
+	pendingReplenish int32
+
+	// lifecycle, see vm_pool_lifecycle.go, transitions are guarded by stateLock
+	stateLock sync.RWMutex
+	lifecycle int32
+	// bumped by reset, instances of an older generation are not returned to the pool
+	generation int32
+	// ephemeral instances not closed yet, the store must outlive them
+	ephemeralLive int32
+	// the refreshing loop has exited
+	loopDone bool
+	// sizing and refresh policy
+	config *PoolConfig
+	log    *logger.CMLogger
+
+	// usage tracking for eviction, guarded by usageLock
+	usageLock sync.Mutex
+	// callers between retain and release
+	inFlight int32
+	// unix timestamp in ms of the last retain or release
+	lastAccess int64
+	// evicted pool is closed and can not be retained any more
+	evicted bool
+	// linear memory size of a fresh instance, in bytes
+	instanceMemory int64
+
+	// statistics, see PoolStats
+	// instances discarded since the pool was built
+	discardCount int32
+	// ephemeral instances built for cross contract calls since the pool was built
+	ephemeralCount int32
+	// time spent to compile or load the module
+	compileTime time.Duration
+	// module was loaded from the module cache
+	fromCache bool
+	// all the instances of the pool (idle or in use), id -> instance, guarded by registryLock
+	registry     map[string]*wrappedInstance
+	registryLock sync.Mutex
 }
 
 // wrappedInstance wraps instance with id and other info
@@ -596,11 +654,40 @@ type wrappedInstance struct {
 	createTime int64
 	// errCount, current instance invoke method error count
 	errCount int32
+	// pristine state restored before every invocation
+	snapshot *instanceSnapshot
+	// discard is set when the instance can not be restored to its snapshot any more, e.g. it trapped
+	discard bool
+	// ephemeral instance is built for a cross contract call, it is not counted in the pool size
+	ephemeral bool
+	// generation of the pool when the instance was built
+	generation int32
+	// host environment of the imports, bound to the invocation running in the instance
+	env *CMEnvironment
+}
+
+// restore the instance to the state right after it was created
+func (w *wrappedInstance) restore() error {
+	if w.snapshot == nil {
+		return nil
+	}
+	if err := w.snapshot.restore(w.wasmInstance); err != nil {
+		w.discard = true
+		return err
+	}
+	return nil
 }
 
-// GetInstance get a vm instance to run contract
-// should be followed by defer resetInstance
-func (p *vmPool) GetInstance() *wrappedInstance {
+// ErrPoolExhausted is returned by GetInstance when no instance is available in time,
+// or too many callers are already waiting for the pool
+var ErrPoolExhausted = errors.New("vm pool exhausted")
+
+// GetInstance get a vm instance to run contract, wait until ctx is done if the pool is empty,
+// should be followed by defer RevertInstance
+func (p *vmPool) GetInstance(ctx context.Context) (*wrappedInstance, error) {
+	if p.state() != poolActive {
+		return nil, fmt.Errorf("%w, [%s_%s]", ErrPoolClosed, p.contractId.Name, p.contractId.Version)
+	}
 
 	var instance *wrappedInstance
 	// get instance from vm pool
@@ -608,45 +695,160 @@ func (p *vmPool) GetInstance() *wrappedInstance {
 	case instance = <-p.instances:
 		// concurrency safe here
 		atomic.AddInt32(&p.useCount, 1)
-		instance.lastUseTime = utils.CurrentTimeMillisSeconds()
-		return instance
+		atomic.StoreInt64(&instance.lastUseTime, utils.CurrentTimeMillisSeconds())
+		return instance, nil
 	default:
 		// nothing
 	}
-	if instance == nil {
-		log.Debugf("can't get wrappedInstance from vmPool.")
+	log.Debugf("can't get wrappedInstance from vmPool.")
+
+	// bounded wait queue, fail fast instead of piling up callers on a stuck contract
+	if atomic.AddInt32(&p.waiters, 1) > p.config.MaxWaiters {
+		atomic.AddInt32(&p.waiters, -1)
+		return nil, fmt.Errorf("%w, [%s_%s] already has %d waiters", ErrPoolExhausted,
+			p.contractId.Name, p.contractId.Version, p.config.MaxWaiters)
 	}
+	defer atomic.AddInt32(&p.waiters, -1)
 
-	// if we cannot get it right now, send apply signal and wait
-	// add wait time to total delay
-	curTimeMS1 := utils.CurrentTimeMillisSeconds()
-	go func() {
-		p.applySignalC <- struct{}{}
+	// if we cannot get it right now, send apply signal and wait,
+	// signals are coalesced, the refreshing loop reads pendingApplies
+	atomic.AddInt32(&p.pendingApplies, 1)
+	select {
+	case p.applySignalC <- struct{}{}:
 		log.Debugf("send 'applySignal' to vmPool.")
-	}()
+	default:
+	}
 
-	instance = <-p.instances
+	// add wait time to total delay
+	curTimeMS1 := utils.CurrentTimeMillisSeconds()
+	select {
+	case instance = <-p.instances:
+	case <-p.closeC:
+		return nil, fmt.Errorf("%w, [%s_%s]", ErrPoolClosed, p.contractId.Name, p.contractId.Version)
+	case <-ctx.Done():
+		elapsedTimeMS := int32(utils.CurrentTimeMillisSeconds() - curTimeMS1)
+		atomic.AddInt32(&p.totalDelay, elapsedTimeMS)
+		return nil, fmt.Errorf("%w, [%s_%s] waited %dms, %v", ErrPoolExhausted,
+			p.contractId.Name, p.contractId.Version, elapsedTimeMS, ctx.Err())
+	}
 	log.Debugf("got an wrappedInstance from vmPool.")
 	atomic.AddInt32(&p.useCount, 1)
 	curTimeMS2 := utils.CurrentTimeMillisSeconds()
-	instance.lastUseTime = curTimeMS2
+	atomic.StoreInt64(&instance.lastUseTime, curTimeMS2)
 	elapsedTimeMS := int32(curTimeMS2 - curTimeMS1)
 	atomic.AddInt32(&p.totalDelay, elapsedTimeMS)
 
-	return instance
+	return instance, nil
+}
+
+// acquireContext return the context bounding GetInstance by config.AcquireTimeout
+func (p *vmPool) acquireContext() (context.Context, context.CancelFunc) {
+	if p.config.AcquireTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), p.config.AcquireTimeout)
+}
+
+// GetCrossCallInstance get a vm instance for a cross contract call (depth > 0), never waits.
+// The caller frames of the same tx may hold every pooled instance of this contract,
+// e.g. a contract calls itself recursively, or A->B->A, waiting for the pool would deadlock.
+// A pooled instance is used if one is idle, otherwise an ephemeral instance is built,
+// RevertInstance adopts it into the pool if there is room, or closes it.
+func (p *vmPool) GetCrossCallInstance() (*wrappedInstance, error) {
+	select {
+	case instance := <-p.instances:
+		atomic.AddInt32(&p.useCount, 1)
+		atomic.StoreInt64(&instance.lastUseTime, utils.CurrentTimeMillisSeconds())
+		return instance, nil
+	default:
+	}
+
+	// apply for a grow, so that the next call frames find an idle instance
+	atomic.AddInt32(&p.pendingApplies, 1)
+	select {
+	case p.applySignalC <- struct{}{}:
+	default:
+	}
+
+	instance, err := p.newEphemeralInstance()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&p.useCount, 1)
+	atomic.AddInt32(&p.ephemeralCount, 1)
+	return instance, nil
+}
+
+// GetEstimateInstance get an ephemeral instance for a dry run, the pooled instances, the pool size
+// and the statistics of the pool are not touched, the instance must be returned by closeEphemeral
+func (p *vmPool) GetEstimateInstance() (*wrappedInstance, error) {
+	return p.newEphemeralInstance()
+}
+
+// newEphemeralInstance build an instance out of the pool from the compiled module
+func (p *vmPool) newEphemeralInstance() (*wrappedInstance, error) {
+	if !p.beginEphemeral() {
+		return nil, fmt.Errorf("%w, [%s_%s]", ErrPoolClosed, p.contractId.Name, p.contractId.Version)
+	}
+	instance, err := p.NewInstance()
+	if err != nil {
+		p.endEphemeral()
+		return nil, fmt.Errorf("[%s_%s] new ephemeral instance failed, %v",
+			p.contractId.Name, p.contractId.Version, err)
+	}
+	instance.ephemeral = true
+	return instance, nil
 }
 
-// RevertInstance revert instance to pool
+// closeEphemeral close an ephemeral instance
+func (p *vmPool) closeEphemeral(instance *wrappedInstance) {
+	p.CloseInstance(instance)
+	p.endEphemeral()
+}
+
+// RevertInstance revert instance to pool,
+// an instance returned after the pool was reset or closed is closed instead
 func (p *vmPool) RevertInstance(instance *wrappedInstance) {
+	if instance.ephemeral {
+		if p.shouldDiscard(instance) || !p.adopt(instance) {
+			p.closeEphemeral(instance)
+		} else {
+			p.endEphemeral()
+		}
+		return
+	}
 	if p.shouldDiscard(instance) {
-		go func() {
-			p.removeInstanceC <- struct{}{}
-			p.addInstanceC <- struct{}{}
-			p.CloseInstance(instance)
-		}()
-	} else {
-		p.instances <- instance
+		atomic.AddInt32(&p.discardCount, 1)
+		p.retire(instance)
+		p.replenish()
+		return
+	}
+	if !p.putIdle(instance) {
+		p.retire(instance)
+	}
+}
+
+// adopt turn an ephemeral instance into a pool member, false if the pool is full or not active
+func (p *vmPool) adopt(instance *wrappedInstance) bool {
+	p.stateLock.RLock()
+	defer p.stateLock.RUnlock()
+
+	if p.state() != poolActive || instance.generation != atomic.LoadInt32(&p.generation) {
+		return false
+	}
+	for {
+		size := atomic.LoadInt32(&p.currentSize)
+		if size >= p.config.MaxSize {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.currentSize, size, size+1) {
+			break
+		}
 	}
+	instance.ephemeral = false
+	p.track(instance)
+	p.instances <- instance
+	return true
 }
 
 // NewInstance create a wasmer instance directly, for cross contract call
@@ -657,6 +859,7 @@ func (p *vmPool) NewInstance() (*wrappedInstance, error) {
 // CloseInstance close a wasmer instance directly, for cross contract call
 func (p *vmPool) CloseInstance(instance *wrappedInstance) {
 	if instance != nil {
+		p.untrack(instance)
 		if err := CallDeallocate(instance.wasmInstance); err != nil {
 			p.log.Errorf("CallDeallocate(...) error: %v", err)
 		}
@@ -665,277 +868,92 @@ func (p *vmPool) CloseInstance(instance *wrappedInstance) {
 	}
 }
 
-func newVmPool(contractId *commonPb.Contract, byteCode []byte, log *logger.CMLogger) (*vmPool, error) {
-	// gas成本表opcode-cost
-	//opmap := map[wasmergo.Opcode]uint32{
-	//	LocalGet:            1,
-	//	Block:               0,
-	//	Br:                  2,
-	//	Call:                2,
-	//	Catch:               100000,
-	//	DataDrop:            100000,
-	//	Drop:                3,
-	//	ElemDrop:            100000,
-	//	Else:                2,
-	//	End:                 0,
-	//	F32Abs:              100000,
-	//	F32Add:              100000,
-	//	F32Ceil:             100000,
-	//	F32Const:            0,
-	//	F32Copysign:         100000,
-	//	F32DemoteF64:        100000,
-	//	F32Div:              100000,
-	//	F32Eq:               100000,
-	//	F32Floor:            100000,
-	//	F32Ge:               100000,
-	//	F32Gt:               100000,
-	//	F32Le:               100000,
-	//	F32Load:             100000,
-	//	F32Lt:               100000,
-	//	F32Max:              100000,
-	//	F32Min:              100000,
-	//	F32Mul:              100000,
-	//	F32Ne:               100000,
-	//	F32Nearest:          100000,
-	//	F32Neg:              100000,
-	//	F32ReinterpretI32:   100000,
-	//	F32Sqrt:             100000,
-	//	F32Store:            100000,
-	//	F32Sub:              100000,
-	//	F32Trunc:            100000,
-	//	F32x4Abs:            100000,
-	//	F32x4Add:            100000,
-	//	F32x4Div:            100000,
-	//	F32x4Eq:             100000,
-	//	F32x4Ge:             100000,
-	//	F32x4Gt:             100000,
-	//	F32x4Le:             100000,
-	//	F32x4Lt:             100000,
-	//	F32x4Max:            100000,
-	//	F32x4Min:            100000,
-	//	F32x4Mul:            100000,
-	//	F32x4Ne:             100000,
-	//	F32x4Neg:            100000,
-	//	F32x4Splat:          100000,
-	//	F32x4Sqrt:           100000,
-	//	F32x4Sub:            100000,
-	//	F64Abs:              100000,
-	//	F64Add:              100000,
-	//	F64Ceil:             100000,
-	//	F64Const:            0,
-	//	F64Copysign:         100000,
-	//	F64Div:              100000,
-	//	F64Eq:               100000,
-	//	F64Floor:            100000,
-	//	F64Ge:               100000,
-	//	F64Gt:               100000,
-	//	F64Le:               100000,
-	//	F64Load:             100000,
-	//	F64Lt:               100000,
-	//	F64Max:              100000,
-	//	F64Min:              100000,
-	//	F64Mul:              100000,
-	//	F64Ne:               100000,
-	//	F64Nearest:          100000,
-	//	F64Neg:              100000,
-	//	F64PromoteF32:       100000,
-	//	F64ReinterpretI64:   100000,
-	//	F64Sqrt:             100000,
-	//	F64Store:            100000,
-	//	F64Sub:              100000,
-	//	F64Trunc:            100000,
-	//	F64x2Abs:            100000,
-	//	F64x2Add:            100000,
-	//	F64x2Div:            100000,
-	//	F64x2Eq:             100000,
-	//	F64x2Ge:             100000,
-	//	F64x2Gt:             100000,
-	//	F64x2Le:             100000,
-	//	F64x2Lt:             100000,
-	//	F64x2Max:            100000,
-	//	F64x2Min:            100000,
-	//	F64x2Mul:            100000,
-	//	F64x2Ne:             100000,
-	//	F64x2Neg:            100000,
-	//	F64x2Splat:          100000,
-	//	F64x2Sqrt:           100000,
-	//	F64x2Sub:            100000,
-	//	I16x8Add:            100000,
-	//	I16x8Eq:             100000,
-	//	I16x8Mul:            100000,
-	//	I16x8Ne:             100000,
-	//	I16x8Neg:            100000,
-	//	I16x8Shl:            100000,
-	//	I16x8Splat:          100000,
-	//	I16x8Sub:            100000,
-	//	I32Add:              1,
-	//	I32And:              1,
-	//	I32AtomicLoad:       100000,
-	//	I32AtomicRmwAdd:     100000,
-	//	I32AtomicRmwAnd:     100000,
-	//	I32AtomicRmwCmpxchg: 100000,
-	//	I32AtomicRmwOr:      100000,
-	//	I32AtomicRmwSub:     100000,
-	//	I32AtomicRmwXchg:    100000,
-	//	I32AtomicRmwXor:     100000,
-	//	I32AtomicStore:      100000,
-	//	I32AtomicStore16:    100000,
-	//	I32AtomicStore8:     100000,
-	//	I32Clz:              105,
-	//	I32Const:            0,
-	//	I32Ctz:              105,
-	//	I32Eq:               1,
-	//	I32Eqz:              1,
-	//	I32Load:             3,
-	//	I32Mul:              3,
-	//	I32Ne:               1,
-	//	I32Or:               1,
-	//	I32Popcnt:           3,
-	//	I32ReinterpretF32:   3,
-	//	I32Rotl:             2,
-	//	I32Rotr:             2,
-	//	I32Shl:              2,
-	//	I32Store:            3,
-	//	I32Store16:          3,
-	//	I32Store8:           3,
-	//	I32Sub:              1,
-	//	I32WrapI64:          3,
-	//	I32Xor:              1,
-	//	I32x4Add:            100000,
-	//	I32x4Eq:             100000,
-	//	I32x4Mul:            100000,
-	//	I32x4Ne:             100000,
-	//	I32x4Neg:            100000,
-	//	I32x4Shl:            100000,
-	//	I32x4Splat:          100000,
-	//	I32x4Sub:            100000,
-	//	I64Add:              1,
-	//	I64And:              1,
-	//	I64AtomicLoad:       100000,
-	//	I64AtomicRmwAdd:     100000,
-	//	I64AtomicRmwAnd:     100000,
-	//	I64AtomicRmwCmpxchg: 100000,
-	//	I64AtomicRmwOr:      100000,
-	//	I64AtomicRmwSub:     100000,
-	//	I64AtomicRmwXchg:    100000,
-	//	I64AtomicRmwXor:     100000,
-	//	I64AtomicStore:      100000,
-	//	I64AtomicStore16:    100000,
-	//	I64AtomicStore32:    100000,
-	//	I64AtomicStore8:     100000,
-	//	I64Clz:              105,
-	//	I64Const:            0,
-	//	I64Ctz:              105,
-	//	I64Eq:               1,
-	//	I64Eqz:              1,
-	//	I64Load:             3,
-	//	I64Mul:              3,
-	//	I64Ne:               1,
-	//	I64Or:               1,
-	//	I64Popcnt:           1,
-	//	I64ReinterpretF64:   3,
-	//	I64Rotl:             2,
-	//	I64Rotr:             2,
-	//	I64Shl:              2,
-	//	I64Store:            3,
-	//	I64Store16:          3,
-	//	I64Store32:          3,
-	//	I64Store8:           3,
-	//	I64Sub:              1,
-	//	I64Xor:              1,
-	//	I64x2Add:            100000,
-	//	I64x2Neg:            100000,
-	//	I64x2Shl:            100000,
-	//	I64x2Splat:          100000,
-	//	I64x2Sub:            100000,
-	//	I8x16Add:            100000,
-	//	I8x16Eq:             100000,
-	//	I8x16Ne:             100000,
-	//	I8x16Neg:            100000,
-	//	I8x16Shl:            100000,
-	//	I8x16Splat:          100000,
-	//	I8x16Sub:            100000,
-	//	If:                  0,
-	//	Loop:                0,
-	//	MemoryCopy:          100000,
-	//	MemoryFill:          100000,
-	//	MemoryGrow:          100000,
-	//	MemoryInit:          100000,
-	//	MemorySize:          10000000,
-	//	Nop:                 0,
-	//	RefFunc:             100000,
-	//	RefNull:             100000,
-	//	Rethrow:             100000,
-	//	Return:              2,
-	//	Select:              3,
-	//	TableCopy:           100000,
-	//	TableFill:           100000,
-	//	TableGet:            100000,
-	//	TableGrow:           100000,
-	//	TableInit:           100000,
-	//	TableSet:            100000,
-	//	Throw:               100000,
-	//	Try:                 100000,
-	//	Unreachable:         0,
-	//	V128And:             100000,
-	//	V128Bitselect:       100000,
-	//	V128Const:           0,
-	//	V128Load:            100000,
-	//	V128Not:             100000,
-	//	V128Or:              100000,
-	//	V128Store:           100000,
-	//	V128Xor:             100000,
-	//}
-	//opmap: gas成本表，opcode-cost，目前gas未完善，该表为空，即所有wasm指令的gas值都是0
-	opmap := map[wasmergo.Opcode]uint32{
-		//LocalGet: 2,
-		//MemoryGrow: 1,
+// newVmPool compile the byte code with the shared engine (or load it from cache if cache is not nil)
+// and build an empty pool, the process wide default engine is used if engine is nil.
+// If allowList is not nil the imports of the module are checked right after it is compiled,
+// a forbidden module is never instantiated, so its _start or _initialize never runs
+func newVmPool(contractId *commonPb.Contract, byteCode []byte, poolConfig *PoolConfig, engine *sharedEngine,
+	cache *moduleCache, allowList *importAllowList, log *logger.CMLogger) (*vmPool, error) {
+	if engine == nil {
+		engine = defaultEngine()
 	}
-	config := wasmergo.NewConfig()
-	fmt.Printf("opmap length %d \n", len(opmap))
-	config.PushMeteringMiddleware(protocol.GasLimit, opmap)
-	//设置实例内存上限为1234页，每页64KB
-	//如果不设置默认上限为256页
-	config.MaxPagesLimit(128)
-
-	engine := wasmergo.NewEngineWithConfig(config)
-	store := wasmergo.NewStore(engine)
+	store := engine.newStore()
 	if err := wasmergo.ValidateModule(store, byteCode); err != nil {
 		return nil, fmt.Errorf("[%s_%s], byte code validation failed, err = %v", contractId.Name, contractId.Version, err)
 	}
 
-	module, err := wasmergo.NewModule(store, byteCode, log)
-
-	if err != nil {
-		return nil, fmt.Errorf("[%s_%s], byte code compile failed", contractId.Name, contractId.Version)
+	compileStart := time.Now()
+	cacheKey := engine.settings.cacheKey(byteCode)
+	module, err := cache.loadModule(store, cacheKey)
+	fromCache := err == nil
+	var artifact []byte
+	if fromCache {
+		log.Infof("[%s_%s], load compiled module from cache", contractId.Name, contractId.Version)
+	} else {
+		module, artifact, err = engine.compile(store, contractId, byteCode, log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = allowList.check(contractId, module); err != nil {
+		module.Close()
+		store.Close()
+		return nil, err
 	}
 
 	vmPool := &vmPool{
-		contractId:      contractId,
-		byteCode:        byteCode,
-		store:           store,
-		module:          module,
-		instances:       make(chan *wrappedInstance, defaultMaxSize),
-		currentSize:     0,
-		useCount:        0,
-		totalDelay:      0,
-		applyGrowCount:  0,
-		applySignalC:    make(chan struct{}),
-		removeInstanceC: make(chan struct{}),
-		addInstanceC:    make(chan struct{}),
-		closeC:          make(chan struct{}),
-		resetC:          make(chan struct{}),
-		log:             log,
+		contractId:     contractId,
+		byteCode:       byteCode,
+		store:          store,
+		module:         module,
+		entrypoint:     detectEntrypoint(module),
+		engine:         engine,
+		instances:      make(chan *wrappedInstance, poolConfig.MaxSize),
+		currentSize:    0,
+		useCount:       0,
+		totalDelay:     0,
+		applyGrowCount: 0,
+		applySignalC:   make(chan struct{}, 1),
+		addInstanceC:   make(chan struct{}, 1),
+		closeC:         make(chan struct{}),
+		resetC:         make(chan struct{}, 1),
+		lifecycle:      poolActive,
+		config:         poolConfig,
+		log:            log,
+		lastAccess:     utils.CurrentTimeMillisSeconds(),
+		compileTime:    time.Since(compileStart),
+		fromCache:      fromCache,
+		registry:       make(map[string]*wrappedInstance),
 	}
 
 	instance, err := vmPool.newInstanceFromModule()
+	if err != nil && fromCache {
+		// the artifact passed the checksum but can not be instantiated, never trust it again
+		log.Warnf("[%s_%s], cached module is unusable, recompile it, %v", contractId.Name, contractId.Version, err)
+		cache.remove(cacheKey)
+		module.Close()
+		fromCache = false
+		if vmPool.module, artifact, err = engine.compile(store, contractId, byteCode, log); err != nil {
+			return nil, err
+		}
+		vmPool.compileTime = time.Since(compileStart)
+		vmPool.fromCache = false
+		instance, err = vmPool.newInstanceFromModule()
+	}
 	if err != nil {
 		return nil, fmt.Errorf("[%s_%s], byte code compile failed, %s", contractId.Name, contractId.Version, err.Error())
 	}
 
+	if memory, err := instance.wasmInstance.Exports.GetMemory("memory"); err == nil {
+		vmPool.instanceMemory = int64(memory.DataSize())
+	}
 	instance.wasmInstance.Close()
 	log.Infof("vm pool verify byteCode finish.")
 
+	if !fromCache {
+		cache.storeArtifact(cacheKey, artifact)
+	}
+
 	go vmPool.startRefreshingLoop()
 	log.Infof("vm pool startRefreshingLoop...")
 	return vmPool, nil
@@ -945,72 +963,54 @@ func newVmPool(contractId *commonPb.Contract, byteCode []byte, log *logger.CMLog
 // all grow and shrink operations are called here
 func (p *vmPool) startRefreshingLoop() {
 
-	refreshTimer := time.NewTimer(defaultRefreshTime)
+	refreshTimer := time.NewTimer(p.config.RefreshTime)
 	key := p.contractId.Name + "_" + p.contractId.Version
 	for {
 		select {
 		case <-p.applySignalC:
 			log.Debug("vmPool handling an `apply` Signal")
-			p.applyGrowCount++
-			if p.shouldGrow() {
-				log.Debugf("vmPool should grow %v wrappedInstance.", defaultChangeSize)
-				p.grow(defaultChangeSize)
-				p.applyGrowCount = 0
-				p.log.Infof("[%s] vm pool grows by %d, the current size is %d",
-					key, defaultChangeSize, p.currentSize)
+			// signals are coalesced, handle every application made since the last one
+			for n := atomic.SwapInt32(&p.pendingApplies, 0); n > 0; n-- {
+				atomic.AddInt32(&p.applyGrowCount, 1)
+				if p.shouldGrow() {
+					log.Debugf("vmPool should grow %v wrappedInstance.", p.config.ChangeSize)
+					p.grow(p.config.ChangeSize)
+					atomic.StoreInt32(&p.applyGrowCount, 0)
+					p.log.Infof("[%s] vm pool grows by %d, the current size is %d",
+						key, p.config.ChangeSize, p.currentSize)
+				}
 			}
 		case <-refreshTimer.C:
 			p.log.Debugf("[%s] vmPool handling an `refresh` Signal", key)
 			if p.shouldGrow() {
-				p.grow(defaultChangeSize)
-				p.applyGrowCount = 0
+				p.grow(p.config.ChangeSize)
+				atomic.StoreInt32(&p.applyGrowCount, 0)
 				p.log.Infof("[%s] vm pool grows by %d, the current size is %d",
-					key, defaultChangeSize, p.currentSize)
+					key, p.config.ChangeSize, p.currentSize)
 			} else if p.shouldShrink() {
-				p.shrink(defaultChangeSize)
+				p.shrink(p.config.ChangeSize)
 				p.log.Infof("[%s] vm pool shrinks by %d, the current size is %d",
-					key, defaultChangeSize, p.currentSize)
+					key, p.config.ChangeSize, p.currentSize)
 			}
 
 			// other go routine may modify useCount & totalDelay
 			// so we use atomic operation here
 			atomic.StoreInt32(&p.useCount, 0)
 			atomic.StoreInt32(&p.totalDelay, 0)
-			refreshTimer.Reset(defaultRefreshTime)
+			refreshTimer.Reset(p.config.RefreshTime)
 		case <-p.closeC:
 			p.log.Debugf("[%s] vmPool handling an `close` Signal", key)
 			refreshTimer.Stop()
-			for p.currentSize > 0 {
-				instance := <-p.instances
-				if err := CallDeallocate(instance.wasmInstance); err != nil {
-					p.log.Errorf("CallDeallocate(...) error: %v", err)
-				}
-				instance.wasmInstance.Close()
-				p.currentSize--
-			}
-			close(p.instances)
-			p.module.Close()
-			p.store.Close()
+			p.handleClose()
 			return
 		case <-p.resetC:
 			p.log.Debugf("[%s] vmPool handling an `reset` Signal", key)
-			for p.currentSize > 0 {
-				instance := <-p.instances
-				if err := CallDeallocate(instance.wasmInstance); err != nil {
-					p.log.Errorf("CallDeallocate(...) error: %v", err)
-				}
-				instance.wasmInstance.Close()
-				p.currentSize--
-			}
-			close(p.instances)
-			p.instances = make(chan *wrappedInstance, defaultMaxSize)
-			p.grow(defaultMinSize)
-		case <-p.removeInstanceC:
-			p.log.Debugf("[%s] vmPool handling an `remove instance` Signal", key)
-			p.currentSize--
+			p.handleReset()
 		case <-p.addInstanceC:
 			p.log.Debugf("[%s] vmPool handling an `add instance` Signal", key)
-			p.grow(1)
+			if n := atomic.SwapInt32(&p.pendingReplenish, 0); n > 0 {
+				p.grow(n)
+			}
 		}
 	}
 }
@@ -1020,20 +1020,20 @@ func (p *vmPool) startRefreshingLoop() {
 // 2.1. apply count >= apply threshold, OR
 // 2.2. average delay > delay tolerance (int operation here is safe)
 func (p *vmPool) shouldGrow() bool {
-	if p.currentSize < defaultMinSize {
+	if p.currentSize < p.config.MinSize {
 		return true
 	}
 
-	if p.currentSize+defaultChangeSize <= defaultMaxSize {
-		if p.applyGrowCount > defaultApplyThreshold {
+	if p.currentSize+p.config.ChangeSize <= p.config.MaxSize {
+		if atomic.LoadInt32(&p.applyGrowCount) > p.config.ApplyThreshold {
 			return true
 		}
 
-		if p.getAverageDelay() > int32(defaultDelayTolerance) {
+		if p.getAverageDelay() > p.config.DelayTolerance {
 			return true
 		}
 
-		if p.currentSize < int32(defaultMinSize) {
+		if p.currentSize < p.config.MinSize {
 			return true
 		}
 	}
@@ -1042,16 +1042,25 @@ func (p *vmPool) shouldGrow() bool {
 
 func (p *vmPool) grow(count int32) {
 	for count > 0 {
-		size := int32(defaultChangeSize)
+		size := p.config.ChangeSize
 		if count < size {
 			size = count
 		}
 		count -= size
 
 		for i := int32(0); i < size; i++ {
-			instance, _ := p.newInstanceFromModule()
-			p.instances <- instance
+			instance, err := p.newInstanceFromModule()
+			if err != nil {
+				p.log.Errorf("[%s_%s] vm pool grow failed, %v", p.contractId.Name, p.contractId.Version, err)
+				return
+			}
 			atomic.AddInt32(&p.currentSize, 1)
+			p.track(instance)
+			if !p.putIdle(instance) {
+				// reset or closed meanwhile
+				p.retire(instance)
+				return
+			}
 		}
 		p.log.Infof("vm pool grow size = %d", size)
 	}
@@ -1061,8 +1070,8 @@ func (p *vmPool) grow(count int32) {
 // 1. current size > min size, AND
 // 2. average delay <= delay tolerance (int operation here is safe)
 func (p *vmPool) shouldShrink() bool {
-	if p.currentSize > defaultMinSize && p.getAverageDelay() <=
-		int32(defaultDelayTolerance) && p.currentSize > defaultChangeSize {
+	if p.currentSize > p.config.MinSize && p.getAverageDelay() <=
+		p.config.DelayTolerance && p.currentSize > p.config.ChangeSize {
 		return true
 	}
 	return false
@@ -1070,20 +1079,27 @@ func (p *vmPool) shouldShrink() bool {
 
 func (p *vmPool) shrink(count int32) {
 	for i := int32(0); i < count; i++ {
-		instance := <-p.instances
-		if err := CallDeallocate(instance.wasmInstance); err != nil {
-			p.log.Errorf("CallDeallocate(...) error: %v", err)
+		select {
+		case instance := <-p.instances:
+			p.retire(instance)
+		default:
+			// the rest are checked out
+			return
 		}
-		instance.wasmInstance.Close()
-		instance = nil
-		p.currentSize--
 	}
 }
 
 // shouldDiscard discard instance when
-// error count times more than defaultDiscardCount
+// 1. error count times more than config.DiscardCount, OR
+// 2. it can not be restored to its snapshot before next invocation
 func (p *vmPool) shouldDiscard(instance *wrappedInstance) bool {
-	return instance.errCount > defaultDiscardCount
+	if instance.discard {
+		return true
+	}
+	if instance.snapshot != nil && !instance.snapshot.restorable(instance.wasmInstance) {
+		return true
+	}
+	return atomic.LoadInt32(&instance.errCount) > p.config.DiscardCount
 }
 
 func (p *vmPool) NewInstanceFromByteCode() (*wrappedInstance, error) {
@@ -1106,20 +1122,14 @@ func (p *vmPool) NewInstanceFromByteCode() (*wrappedInstance, error) {
 
 func (p *vmPool) newInstanceFromModule() (*wrappedInstance, error) {
 	vb := GetVmBridgeManager()
-	env := CMEnvironment{
+	env := &CMEnvironment{
 		instance: nil,
 		memory:   nil,
 	}
 
-	wasiEnv, err := wasmergo.NewWasiStateBuilder("wasi-program").
-		Finalize(p.store.Inner())
-	if err != nil {
-		panic(fmt.Sprintf("Error creating WASI environment: %v", err))
-	}
-
-	importObject, err := wasiEnv.GenerateImportObject(p.store, p.module)
-
-	imports, err := vb.GetImports(p.store, &env, importObject)
+	// the whole WASI of the module is served by the sandbox of the bridge, see registerWasiSandbox,
+	// the host WASI of wasmer is never linked
+	imports, err := vb.GetImports(p.store, env, nil)
 	if imports == nil && err != nil {
 		return nil, errors.New("get imports failed when new instance from module, because of " + err.Error())
 	}
@@ -1132,29 +1142,88 @@ func (p *vmPool) newInstanceFromModule() (*wrappedInstance, error) {
 		p.log.Debugf("newInstanceFromModule success")
 	}
 
-	err = wasiEnv.Initialize(p.store, wasmInstance)
-	if err != nil {
+	// the host functions called by _start see the instance
+	env.instance = wasmInstance
+	env.memory, _ = wasmInstance.Exports.GetMemory("memory")
+
+	// 如果有wasi，执行 WASI 入口函数，command 执行 _start，reactor 执行 _initialize
+	if err = p.entrypoint.boot(wasmInstance, env); err != nil {
+		p.log.Errorf("newInstanceFromModule fail: %s", err.Error())
+		wasmInstance.Close()
 		return nil, err
 	}
-	// 如果有wasi，获取并执行 WASI start 函数
-	start, _ := wasmInstance.Exports.GetWasiStartRawFunction()
-	if start != nil {
-		start.Call()
-	}
 
-	env.instance = wasmInstance
-	env.memory, _ = wasmInstance.Exports.GetMemory("memory")
+	snapshot, err := takeSnapshot(wasmInstance)
+	if err != nil {
+		wasmInstance.Close()
+		return nil, err
+	}
 	instance := &wrappedInstance{
 		id:           uuid.GetUUID(),
 		wasmInstance: wasmInstance,
 		lastUseTime:  utils.CurrentTimeMillisSeconds(),
 		createTime:   utils.CurrentTimeMillisSeconds(),
 		errCount:     0,
+		snapshot:     snapshot,
+		generation:   atomic.LoadInt32(&p.generation),
+		env:          env,
 	}
 
 	return instance, nil
 }
 
+// retain mark the pool in use until release is called, so that it will not be evicted,
+// return false if the pool has been evicted or closed, the caller should get a new pool from InstancesManager
+func (p *vmPool) retain() bool {
+	p.usageLock.Lock()
+	defer p.usageLock.Unlock()
+
+	if p.evicted || p.state() != poolActive {
+		return false
+	}
+	p.inFlight++
+	p.lastAccess = utils.CurrentTimeMillisSeconds()
+	return true
+}
+
+// release the pool retained before
+func (p *vmPool) release() {
+	p.usageLock.Lock()
+	defer p.usageLock.Unlock()
+
+	p.inFlight--
+	p.lastAccess = utils.CurrentTimeMillisSeconds()
+}
+
+// tryEvict mark the pool evicted if nobody is using it, the caller should close the pool after that
+func (p *vmPool) tryEvict() bool {
+	p.usageLock.Lock()
+	defer p.usageLock.Unlock()
+
+	if p.evicted || p.inFlight > 0 {
+		return false
+	}
+	p.evicted = true
+	return true
+}
+
+// idleSince return the last access time in ms, or -1 if the pool is in use
+func (p *vmPool) idleSince() int64 {
+	p.usageLock.Lock()
+	defer p.usageLock.Unlock()
+
+	if p.inFlight > 0 {
+		return -1
+	}
+	return p.lastAccess
+}
+
+// estimatedMemory rough memory held by the pool, compiled module plus linear memory
+// and memory snapshot of all instances
+func (p *vmPool) estimatedMemory() int64 {
+	return int64(len(p.byteCode))*compiledCodeFactor + int64(atomic.LoadInt32(&p.currentSize))*p.instanceMemory*2
+}
+
 // getAverageDelay average delay calculation here maybe not so accurate due to concurrency
 // but we can still use it to decide grow/shrink or not
 func (p *vmPool) getAverageDelay() int32 {
@@ -1165,13 +1234,3 @@ func (p *vmPool) getAverageDelay() int32 {
 	}
 	return delay / count
 }
-
-// reset the pool instances
-func (p *vmPool) reset() {
-	p.resetC <- struct{}{}
-}
-
-// close the pool
-func (p *vmPool) close() {
-	close(p.closeC)
-}
@@ -0,0 +1,296 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+)
+
+// keys of the vm config map (chainmaker.yml -> vm.wasmer), e.g.
+//
+//	pool:
+//	  max_size: 100
+//	  min_size: 5
+//	  refresh_time: 12h
+//	  acquire_timeout: 10s
+//	  memory_budget_mb: 4096     # chain level only, 0 means no budget
+//	  idle_ttl: 30m              # chain level only, 0 means idle pools are kept
+//	  contracts:
+//	    contract_erc20:            # all versions of contract_erc20
+//	      max_size: 200
+//	    contract_erc20_v1.0.0:     # exactly this version, takes precedence
+//	      min_size: 20
+const (
+	configKeyPool           = "pool"
+	configKeyContracts      = "contracts"
+	configKeyMaxSize        = "max_size"
+	configKeyMinSize        = "min_size"
+	configKeyChangeSize     = "change_size"
+	configKeyRefreshTime    = "refresh_time"
+	configKeyDelayTolerance = "delay_tolerance"
+	configKeyApplyThreshold = "apply_threshold"
+	configKeyDiscardCount   = "discard_count"
+	configKeyAcquireTimeout = "acquire_timeout"
+	configKeyMaxWaiters     = "max_waiters"
+	configKeyMemoryBudgetMB = "memory_budget_mb"
+	configKeyIdleTTL        = "idle_ttl"
+)
+
+// PoolConfig sizing and refresh policy of a contract vm pool
+type PoolConfig struct {
+	// the max pool size
+	MaxSize int32
+	// the min pool size, also the size of a newly built pool
+	MinSize int32
+	// grow or shrink size at one time
+	ChangeSize int32
+	// refresh vmPool time, use for grow or shrink
+	RefreshTime time.Duration
+	// if get instance avg time greater than this value, should grow pool, Millisecond as unit
+	DelayTolerance int32
+	// if apply times greater than this value, should grow pool
+	ApplyThreshold int32
+	// if wasmer instance invoke error more than N times, should close and discard this instance
+	DiscardCount int32
+	// max wait time to get an instance from an exhausted pool, 0 means no timeout
+	AcquireTimeout time.Duration
+	// max callers waiting for an exhausted pool, more callers fail immediately
+	MaxWaiters int32
+}
+
+// DefaultPoolConfig return the pool config used when nothing is configured
+func DefaultPoolConfig() *PoolConfig {
+	return &PoolConfig{
+		MaxSize:        defaultMaxSize,
+		MinSize:        defaultMinSize,
+		ChangeSize:     defaultChangeSize,
+		RefreshTime:    defaultRefreshTime,
+		DelayTolerance: defaultDelayTolerance,
+		ApplyThreshold: defaultApplyThreshold,
+		DiscardCount:   defaultDiscardCount,
+		AcquireTimeout: defaultAcquireTimeout,
+		MaxWaiters:     defaultMaxWaiters,
+	}
+}
+
+// clone return a copy of the config, overrides are applied on the copy
+func (c *PoolConfig) clone() *PoolConfig {
+	cp := *c
+	return &cp
+}
+
+// validate check the config can be used to build a pool
+func (c *PoolConfig) validate() error {
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("%s must be positive, got %d", configKeyMaxSize, c.MaxSize)
+	}
+	if c.MinSize < 0 || c.MinSize > c.MaxSize {
+		return fmt.Errorf("%s must be in [0, %s(%d)], got %d", configKeyMinSize, configKeyMaxSize, c.MaxSize, c.MinSize)
+	}
+	if c.ChangeSize <= 0 {
+		return fmt.Errorf("%s must be positive, got %d", configKeyChangeSize, c.ChangeSize)
+	}
+	if c.RefreshTime <= 0 {
+		return fmt.Errorf("%s must be positive, got %v", configKeyRefreshTime, c.RefreshTime)
+	}
+	if c.DelayTolerance < 0 || c.ApplyThreshold < 0 || c.DiscardCount < 0 || c.AcquireTimeout < 0 {
+		return fmt.Errorf("%s, %s, %s and %s must not be negative", configKeyDelayTolerance,
+			configKeyApplyThreshold, configKeyDiscardCount, configKeyAcquireTimeout)
+	}
+	if c.MaxWaiters <= 0 {
+		return fmt.Errorf("%s must be positive, got %d", configKeyMaxWaiters, c.MaxWaiters)
+	}
+	return nil
+}
+
+// applyMap override the config fields that present in m
+func (c *PoolConfig) applyMap(m map[string]interface{}) error {
+	int32Fields := map[string]*int32{
+		configKeyMaxSize:        &c.MaxSize,
+		configKeyMinSize:        &c.MinSize,
+		configKeyChangeSize:     &c.ChangeSize,
+		configKeyDelayTolerance: &c.DelayTolerance,
+		configKeyApplyThreshold: &c.ApplyThreshold,
+		configKeyDiscardCount:   &c.DiscardCount,
+		configKeyMaxWaiters:     &c.MaxWaiters,
+	}
+	for key, field := range int32Fields {
+		val, ok := m[key]
+		if !ok {
+			continue
+		}
+		i, err := toInt64(val)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+		if i < 0 || i > math.MaxInt32 {
+			return fmt.Errorf("invalid %s: %d out of range [0, %d]", key, i, math.MaxInt32)
+		}
+		*field = int32(i)
+	}
+
+	durationFields := map[string]*time.Duration{
+		configKeyRefreshTime:    &c.RefreshTime,
+		configKeyAcquireTimeout: &c.AcquireTimeout,
+	}
+	for key, field := range durationFields {
+		val, ok := m[key]
+		if !ok {
+			continue
+		}
+		d, err := toDuration(val)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+		*field = d
+	}
+	return c.validate()
+}
+
+// poolConfigs the chain level pool config and the per-contract overrides
+type poolConfigs struct {
+	chain *PoolConfig
+	// contractName or contractName_contractVersion -> config
+	contracts map[string]*PoolConfig
+	// estimated memory of all pools (in bytes) that triggers eviction, 0 means unlimited
+	memoryBudget int64
+	// pools not used for idleTTL are evicted, 0 means never
+	idleTTL time.Duration
+}
+
+// parsePoolConfigs parse the pool section of the vm config map,
+// missing fields fall back to the chain level config, then to the defaults
+func parsePoolConfigs(configs map[string]interface{}) (*poolConfigs, error) {
+	pc := &poolConfigs{
+		chain:     DefaultPoolConfig(),
+		contracts: make(map[string]*PoolConfig),
+	}
+	if configs == nil {
+		return pc, nil
+	}
+	raw, ok := configs[configKeyPool]
+	if !ok || raw == nil {
+		return pc, nil
+	}
+	poolMap, err := toStringMap(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s config: %v", configKeyPool, err)
+	}
+	if err = pc.chain.applyMap(poolMap); err != nil {
+		return nil, fmt.Errorf("invalid %s config: %v", configKeyPool, err)
+	}
+	if val, ok := poolMap[configKeyMemoryBudgetMB]; ok {
+		mb, err := toInt64(val)
+		if err != nil || mb < 0 {
+			return nil, fmt.Errorf("invalid %s.%s config: %v", configKeyPool, configKeyMemoryBudgetMB, val)
+		}
+		pc.memoryBudget = mb << 20
+	}
+	if val, ok := poolMap[configKeyIdleTTL]; ok {
+		ttl, err := toDuration(val)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid %s.%s config: %v", configKeyPool, configKeyIdleTTL, val)
+		}
+		pc.idleTTL = ttl
+	}
+
+	rawContracts, ok := poolMap[configKeyContracts]
+	if !ok || rawContracts == nil {
+		return pc, nil
+	}
+	contractsMap, err := toStringMap(rawContracts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s.%s config: %v", configKeyPool, configKeyContracts, err)
+	}
+	for key, rawContract := range contractsMap {
+		contractMap, err := toStringMap(rawContract)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool config of contract %s: %v", key, err)
+		}
+		c := pc.chain.clone()
+		if err = c.applyMap(contractMap); err != nil {
+			return nil, fmt.Errorf("invalid pool config of contract %s: %v", key, err)
+		}
+		pc.contracts[key] = c
+	}
+	return pc, nil
+}
+
+// get return the pool config of the contract,
+// contractName_contractVersion is preferred over contractName
+func (pc *poolConfigs) get(contractId *commonPb.Contract) *PoolConfig {
+	if c, ok := pc.contracts[contractId.Name+"_"+contractId.Version]; ok {
+		return c
+	}
+	if c, ok := pc.contracts[contractId.Name]; ok {
+		return c
+	}
+	return pc.chain
+}
+
+// toStringMap yaml decoders may produce map[interface{}]interface{}, convert it to map[string]interface{}
+func toStringMap(val interface{}) (map[string]interface{}, error) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = value
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("expect a map, got %T", val)
+	}
+}
+
+func toInt64(val interface{}) (int64, error) {
+	switch v := val.(type) {
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, fmt.Errorf("%d out of range", v)
+		}
+		return int64(v), nil
+	case float64:
+		if v < math.MinInt64 || v >= math.MaxInt64 || v != math.Trunc(v) {
+			return 0, fmt.Errorf("expect an integer, got %v", v)
+		}
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	default:
+		return 0, fmt.Errorf("expect an integer, got %T", val)
+	}
+}
+
+// toDuration accept a duration string such as "12h", or a number of seconds
+func toDuration(val interface{}) (time.Duration, error) {
+	if s, ok := val.(string); ok {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d, nil
+		}
+	}
+	seconds, err := toInt64(val)
+	if err != nil {
+		return 0, fmt.Errorf("expect a duration like \"12h\" or seconds, got %v", val)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"testing"
+	"time"
+
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePoolConfigs(t *testing.T) {
+	configs := map[string]interface{}{
+		"pool": map[interface{}]interface{}{
+			"max_size":     100,
+			"min_size":     "2",
+			"refresh_time": "1h",
+			"contracts": map[string]interface{}{
+				"erc20": map[string]interface{}{
+					"max_size": float64(200),
+				},
+				"erc20_v2": map[string]interface{}{
+					"min_size":     20,
+					"refresh_time": 60,
+				},
+			},
+		},
+	}
+
+	pc, err := parsePoolConfigs(configs)
+	assert.Nil(t, err)
+
+	chain := pc.get(&commonPb.Contract{Name: "other", Version: "v1"})
+	assert.Equal(t, int32(100), chain.MaxSize)
+	assert.Equal(t, int32(2), chain.MinSize)
+	assert.Equal(t, int32(defaultChangeSize), chain.ChangeSize)
+	assert.Equal(t, time.Hour, chain.RefreshTime)
+
+	// contract name override, other fields inherit chain config
+	erc20v1 := pc.get(&commonPb.Contract{Name: "erc20", Version: "v1"})
+	assert.Equal(t, int32(200), erc20v1.MaxSize)
+	assert.Equal(t, int32(2), erc20v1.MinSize)
+
+	// name_version override takes precedence over name
+	erc20v2 := pc.get(&commonPb.Contract{Name: "erc20", Version: "v2"})
+	assert.Equal(t, int32(100), erc20v2.MaxSize)
+	assert.Equal(t, int32(20), erc20v2.MinSize)
+	assert.Equal(t, time.Minute, erc20v2.RefreshTime)
+}
+
+func TestParsePoolConfigsDefaultAndInvalid(t *testing.T) {
+	pc, err := parsePoolConfigs(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultPoolConfig(), pc.get(&commonPb.Contract{Name: "any", Version: "v1"}))
+
+	_, err = parsePoolConfigs(map[string]interface{}{
+		"pool": map[string]interface{}{"min_size": 10, "max_size": 5},
+	})
+	assert.NotNil(t, err)
+
+	_, err = parsePoolConfigs(map[string]interface{}{
+		"pool": map[string]interface{}{"refresh_time": "soon"},
+	})
+	assert.NotNil(t, err)
+
+	_, err = parsePoolConfigs(map[string]interface{}{
+		"pool": map[string]interface{}{
+			"contracts": map[string]interface{}{"erc20": map[string]interface{}{"change_size": 0}},
+		},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestParsePoolConfigsOutOfRange(t *testing.T) {
+	// sizes must fit into an int32 and must not be negative, whatever type the yaml decoder produced
+	for _, val := range []interface{}{4294967297, int64(-1), "4294967297", "-3", uint64(1) << 63, 1e19} {
+		_, err := parsePoolConfigs(map[string]interface{}{
+			"pool": map[string]interface{}{"max_size": val},
+		})
+		if assert.NotNil(t, err, "%v", val) {
+			assert.Contains(t, err.Error(), "max_size", "%v", val)
+		}
+	}
+
+	pc, err := parsePoolConfigs(map[string]interface{}{
+		"pool": map[string]interface{}{"max_waiters": "2147483647"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2147483647), pc.chain.MaxWaiters)
+}
@@ -0,0 +1,175 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// lifecycle of a vm pool
+//
+//	active --close()--> draining --last instance returned--> closed
+//
+// An active pool serves instances. reset() keeps the pool active but bumps its generation,
+// instances of an older generation are closed when they are returned instead of going back to the pool.
+// A draining pool serves nothing, idle instances are closed at once, checked out instances are closed
+// when they are returned. The module and the store are closed when no instance is left, so that
+// an instance is never used after its store is gone, and a late RevertInstance never panics.
+const (
+	poolActive int32 = iota
+	poolDraining
+	poolClosed
+)
+
+// ErrPoolClosed is returned by GetInstance when the pool is closed, or being closed
+var ErrPoolClosed = errors.New("vm pool closed")
+
+// state of the pool, see poolActive
+func (p *vmPool) state() int32 {
+	return atomic.LoadInt32(&p.lifecycle)
+}
+
+// reset the pool instances, instances checked out now are closed when they are returned
+func (p *vmPool) reset() {
+	p.stateLock.Lock()
+	if p.state() != poolActive {
+		p.stateLock.Unlock()
+		return
+	}
+	atomic.AddInt32(&p.generation, 1)
+	p.stateLock.Unlock()
+
+	select {
+	case p.resetC <- struct{}{}:
+	default:
+		// a reset is pending already
+	}
+}
+
+// close the pool, it is safe to close a pool more than once, or while instances are checked out
+func (p *vmPool) close() {
+	p.stateLock.Lock()
+	if p.state() != poolActive {
+		p.stateLock.Unlock()
+		return
+	}
+	atomic.StoreInt32(&p.lifecycle, poolDraining)
+	p.stateLock.Unlock()
+
+	close(p.closeC)
+}
+
+// putIdle put an instance of the pool back, false if it does not belong to the pool any more
+func (p *vmPool) putIdle(instance *wrappedInstance) bool {
+	p.stateLock.RLock()
+	defer p.stateLock.RUnlock()
+
+	if p.state() != poolActive || instance.generation != atomic.LoadInt32(&p.generation) {
+		return false
+	}
+	// never blocks, the pool never holds more than config.MaxSize instances
+	p.instances <- instance
+	return true
+}
+
+// retire close an instance counted in the pool size
+func (p *vmPool) retire(instance *wrappedInstance) {
+	p.CloseInstance(instance)
+	if atomic.AddInt32(&p.currentSize, -1) == 0 {
+		p.tryFinishClose()
+	}
+}
+
+// beginEphemeral account an ephemeral instance about to be built, false if the pool is not active
+func (p *vmPool) beginEphemeral() bool {
+	p.stateLock.RLock()
+	defer p.stateLock.RUnlock()
+
+	if p.state() != poolActive {
+		return false
+	}
+	atomic.AddInt32(&p.ephemeralLive, 1)
+	return true
+}
+
+// endEphemeral an ephemeral instance is closed or failed to build
+func (p *vmPool) endEphemeral() {
+	if atomic.AddInt32(&p.ephemeralLive, -1) == 0 {
+		p.tryFinishClose()
+	}
+}
+
+// tryFinishClose close the module and the store of a draining pool once nothing uses them any more
+func (p *vmPool) tryFinishClose() {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	if p.state() != poolDraining || !p.loopDone ||
+		atomic.LoadInt32(&p.currentSize) > 0 || atomic.LoadInt32(&p.ephemeralLive) > 0 {
+		return
+	}
+	atomic.StoreInt32(&p.lifecycle, poolClosed)
+	p.module.Close()
+	p.store.Close()
+	p.log.Debugf("[%s_%s] vm pool closed", p.contractId.Name, p.contractId.Version)
+}
+
+// drainIdle close the idle instances that do not belong to the current generation, or all of them
+// when the pool is draining, return the number of idle instances kept
+func (p *vmPool) drainIdle() int32 {
+	var kept []*wrappedInstance
+drain:
+	for {
+		select {
+		case instance := <-p.instances:
+			if p.state() == poolActive && instance.generation == atomic.LoadInt32(&p.generation) {
+				kept = append(kept, instance)
+			} else {
+				p.retire(instance)
+			}
+		default:
+			break drain
+		}
+	}
+	for _, instance := range kept {
+		if !p.putIdle(instance) {
+			p.retire(instance)
+		}
+	}
+	return int32(len(kept))
+}
+
+// handleClose run by the refreshing loop when the pool is closed, the loop exits after it
+func (p *vmPool) handleClose() {
+	p.drainIdle()
+	p.stateLock.Lock()
+	p.loopDone = true
+	p.stateLock.Unlock()
+	p.tryFinishClose()
+}
+
+// replenish ask the refreshing loop for a new instance in place of a discarded one
+func (p *vmPool) replenish() {
+	if p.state() != poolActive {
+		return
+	}
+	atomic.AddInt32(&p.pendingReplenish, 1)
+	select {
+	case p.addInstanceC <- struct{}{}:
+	default:
+	}
+}
+
+// handleReset run by the refreshing loop when the pool is reset
+func (p *vmPool) handleReset() {
+	kept := p.drainIdle()
+	if kept < p.config.MinSize {
+		p.grow(p.config.MinSize - kept)
+	}
+}
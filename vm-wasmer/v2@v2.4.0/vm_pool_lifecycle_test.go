@@ -0,0 +1,97 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolCloseWhileCheckedOut(t *testing.T) {
+	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+
+	config := DefaultPoolConfig()
+	config.MaxSize = 2
+	config.MinSize = 2
+	vmPool, err := newVmPool(&contractId, wasmBytes, config, nil, nil, nil, logger)
+	if err != nil {
+		t.Fatalf("create vmPool error: %v", err)
+	}
+	vmPool.grow(config.MinSize)
+
+	first, err := vmPool.GetInstance(context.Background())
+	assert.Nil(t, err)
+	second, err := vmPool.GetInstance(context.Background())
+	assert.Nil(t, err)
+
+	// a waiter is woken up by close
+	waiterDone := make(chan error)
+	go func() {
+		_, err := vmPool.GetInstance(context.Background())
+		waiterDone <- err
+	}()
+	for atomic.LoadInt32(&vmPool.waiters) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	vmPool.close()
+	vmPool.close()
+	assert.True(t, errors.Is(<-waiterDone, ErrPoolClosed))
+	_, err = vmPool.GetInstance(context.Background())
+	assert.True(t, errors.Is(err, ErrPoolClosed))
+	_, err = vmPool.GetCrossCallInstance()
+	assert.True(t, errors.Is(err, ErrPoolClosed))
+
+	// late returns are closed, the store is closed with the last one
+	vmPool.RevertInstance(first)
+	assert.Equal(t, poolDraining, vmPool.state())
+	vmPool.RevertInstance(second)
+	assert.Eventually(t, func() bool {
+		return vmPool.state() == poolClosed
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&vmPool.currentSize))
+}
+
+func TestPoolResetWhileCheckedOut(t *testing.T) {
+	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+
+	config := DefaultPoolConfig()
+	config.MaxSize = 4
+	config.MinSize = 2
+	vmPool, err := newVmPool(&contractId, wasmBytes, config, nil, nil, nil, logger)
+	if err != nil {
+		t.Fatalf("create vmPool error: %v", err)
+	}
+	defer vmPool.close()
+	vmPool.grow(config.MinSize)
+
+	old, err := vmPool.GetInstance(context.Background())
+	assert.Nil(t, err)
+
+	vmPool.reset()
+	// the idle instance is replaced, the checked out one is still counted
+	assert.Eventually(t, func() bool {
+		return len(vmPool.instances) == int(config.MinSize)
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, config.MinSize+1, atomic.LoadInt32(&vmPool.currentSize))
+
+	// the instance of the old generation is closed when it is returned
+	vmPool.RevertInstance(old)
+	assert.Equal(t, config.MinSize, atomic.LoadInt32(&vmPool.currentSize))
+	assert.Equal(t, int(config.MinSize), len(vmPool.instances))
+
+	instance, err := vmPool.GetInstance(context.Background())
+	assert.Nil(t, err)
+	assert.NotEqual(t, old.id, instance.id)
+	vmPool.RevertInstance(instance)
+}
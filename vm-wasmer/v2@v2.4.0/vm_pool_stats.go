@@ -0,0 +1,140 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// PoolStats statistics of a contract vm pool, for monitoring and admin tools
+type PoolStats struct {
+	ContractName    string
+	ContractVersion string
+	// instances owned by the pool, idle or in use
+	CurrentSize int32
+	// instances waiting in the pool
+	IdleSize int32
+	// callers currently using the pool
+	InFlight int32
+	// instance acquisitions since last refresh
+	UseCount int32
+	// total wait time (in ms) of the acquisitions since last refresh
+	TotalDelay int32
+	// TotalDelay / UseCount
+	AverageDelay int32
+	// acquisitions that found the pool empty since last grow
+	ApplyGrowCount int32
+	// instances discarded since the pool was built
+	DiscardCount int32
+	// ephemeral instances built for cross contract calls since the pool was built
+	EphemeralCount int32
+	// time spent to compile the module, or to load it from the module cache
+	CompileTime time.Duration
+	// module was loaded from the module cache
+	FromCache bool
+	// rough memory held by the pool, in bytes
+	EstimatedMemory int64
+	// sorted by create time
+	Instances []InstanceStats
+}
+
+// InstanceStats statistics of a pooled instance
+type InstanceStats struct {
+	Id string
+	// invoke errors of the instance
+	ErrCount int32
+	// unix timestamp in ms
+	CreateTime int64
+	// unix timestamp in ms
+	LastUseTime int64
+}
+
+// Stats return the statistics of all contract vm pools, keyed by contractName_contractVersion
+func (m *InstancesManager) Stats() map[string]*PoolStats {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	stats := make(map[string]*PoolStats, len(m.instanceMap))
+	for key, pool := range m.instanceMap {
+		stats[key] = pool.stats()
+	}
+	return stats
+}
+
+// GetPoolStats return the statistics of the contract vm pool, false if the pool is not built
+func (m *InstancesManager) GetPoolStats(contractName, contractVersion string) (*PoolStats, bool) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	pool, ok := m.instanceMap[contractName+"_"+contractVersion]
+	if !ok {
+		return nil, false
+	}
+	return pool.stats(), true
+}
+
+// track register a pool member, so that it shows in the statistics
+func (p *vmPool) track(instance *wrappedInstance) {
+	if instance == nil {
+		return
+	}
+	p.registryLock.Lock()
+	defer p.registryLock.Unlock()
+
+	p.registry[instance.id] = instance
+}
+
+// untrack remove a closed instance from the statistics
+func (p *vmPool) untrack(instance *wrappedInstance) {
+	p.registryLock.Lock()
+	defer p.registryLock.Unlock()
+
+	delete(p.registry, instance.id)
+}
+
+func (p *vmPool) stats() *PoolStats {
+	p.usageLock.Lock()
+	inFlight := p.inFlight
+	p.usageLock.Unlock()
+
+	stats := &PoolStats{
+		ContractName:    p.contractId.Name,
+		ContractVersion: p.contractId.Version,
+		CurrentSize:     atomic.LoadInt32(&p.currentSize),
+		IdleSize:        int32(len(p.instances)),
+		InFlight:        inFlight,
+		UseCount:        atomic.LoadInt32(&p.useCount),
+		TotalDelay:      atomic.LoadInt32(&p.totalDelay),
+		AverageDelay:    p.getAverageDelay(),
+		ApplyGrowCount:  atomic.LoadInt32(&p.applyGrowCount),
+		DiscardCount:    atomic.LoadInt32(&p.discardCount),
+		EphemeralCount:  atomic.LoadInt32(&p.ephemeralCount),
+		CompileTime:     p.compileTime,
+		FromCache:       p.fromCache,
+		EstimatedMemory: p.estimatedMemory(),
+	}
+
+	p.registryLock.Lock()
+	stats.Instances = make([]InstanceStats, 0, len(p.registry))
+	for _, instance := range p.registry {
+		stats.Instances = append(stats.Instances, InstanceStats{
+			Id:          instance.id,
+			ErrCount:    atomic.LoadInt32(&instance.errCount),
+			CreateTime:  instance.createTime,
+			LastUseTime: atomic.LoadInt64(&instance.lastUseTime),
+		})
+	}
+	p.registryLock.Unlock()
+
+	sort.Slice(stats.Instances, func(i, j int) bool {
+		return stats.Instances[i].CreateTime < stats.Instances[j].CreateTime
+	})
+	return stats
+}
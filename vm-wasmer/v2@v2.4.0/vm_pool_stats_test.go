@@ -0,0 +1,55 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolStats(t *testing.T) {
+	wasmBytes, contractId, _ := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+
+	manager, err := NewInstancesManager(ChainId, map[string]interface{}{
+		"pool": map[string]interface{}{"min_size": 2},
+	})
+	assert.Nil(t, err)
+	defer manager.CloseAllVmPool()
+
+	_, ok := manager.GetPoolStats(contractId.Name, contractId.Version)
+	assert.False(t, ok)
+
+	pool, err := manager.getVmPool(&contractId, wasmBytes, baseGasSchedule(), nil)
+	assert.Nil(t, err)
+
+	instance, err := pool.GetInstance(context.Background())
+	assert.Nil(t, err)
+	instance.errCount++
+	stats, ok := manager.GetPoolStats(contractId.Name, contractId.Version)
+	assert.True(t, ok)
+	assert.Equal(t, int32(2), stats.CurrentSize)
+	assert.Equal(t, int32(1), stats.IdleSize)
+	assert.Equal(t, int32(1), stats.UseCount)
+	assert.Equal(t, 2, len(stats.Instances))
+	assert.True(t, stats.CompileTime > 0)
+
+	var errCount int32
+	for _, s := range stats.Instances {
+		errCount += s.ErrCount
+	}
+	assert.Equal(t, int32(1), errCount)
+
+	// discarded instance is counted and replaced
+	instance.discard = true
+	pool.RevertInstance(instance)
+	all := manager.Stats()
+	assert.Equal(t, 1, len(all))
+	assert.Equal(t, int32(1), all[contractId.Name+"_"+contractId.Version].DiscardCount)
+}
@@ -8,12 +8,15 @@ SPDX-License-Identifier: Apache-2.0
 package wasmer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"chainmaker.org/chainmaker/protocol/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,7 +24,7 @@ func TestNewWrappedInstance(t *testing.T) {
 
 	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-1.2.0.wasm", t)
 
-	vmPool, err := newVmPool(&contractId, wasmBytes, logger)
+	vmPool, err := newVmPool(&contractId, wasmBytes, DefaultPoolConfig(), nil, nil, nil, logger)
 	if err != nil {
 		t.Fatalf("create vmPool error: %v", err)
 	}
@@ -47,7 +50,7 @@ func TestGetWrappedInstance(t *testing.T) {
 
 	wasmBytes, contractId, logger := prepareContract("./testdata/rust-func-verify-2.0.0.wasm", t)
 
-	vmPool, err := newVmPool(&contractId, wasmBytes, logger)
+	vmPool, err := newVmPool(&contractId, wasmBytes, DefaultPoolConfig(), nil, nil, nil, logger)
 	if err != nil {
 		t.Fatalf("create vmPool error: %v", err)
 	}
@@ -62,7 +65,8 @@ func TestGetWrappedInstance(t *testing.T) {
 		go func(no int) {
 			defer wg.Done()
 
-			wrappedInstance := vmPool.GetInstance()
+			wrappedInstance, err := vmPool.GetInstance(context.Background())
+			assert.Nil(t, err)
 			defer vmPool.RevertInstance(wrappedInstance)
 
 			fmt.Printf("vmPool used %v instane.\n", atomic.LoadInt32(&vmPool.useCount))
@@ -78,7 +82,7 @@ func TestGetWrappedInstance(t *testing.T) {
 func TestGrowAndShrink(t *testing.T) {
 	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
 
-	vmPool, err := newVmPool(&contractId, wasmBytes, logger)
+	vmPool, err := newVmPool(&contractId, wasmBytes, DefaultPoolConfig(), nil, nil, nil, logger)
 	if err != nil {
 		t.Fatalf("create vmPool error: %v", err)
 	}
@@ -94,7 +98,8 @@ func TestGrowAndShrink(t *testing.T) {
 		go func(no int) {
 			defer wg.Done()
 
-			wrappedInstance := vmPool.GetInstance()
+			wrappedInstance, err := vmPool.GetInstance(context.Background())
+			assert.Nil(t, err)
 			defer vmPool.RevertInstance(wrappedInstance)
 
 			fmt.Printf("vmPool used %v instane, currentSize = %v \n", atomic.LoadInt32(&vmPool.useCount), atomic.LoadInt32(&vmPool.currentSize))
@@ -116,7 +121,8 @@ func TestGrowAndShrink(t *testing.T) {
 			defer wg.Done()
 
 			fmt.Printf("GoRoutine(%v) try to get an instance \n", no)
-			wrappedInstance := vmPool.GetInstance()
+			wrappedInstance, err := vmPool.GetInstance(context.Background())
+			assert.Nil(t, err)
 			fmt.Printf("GoRoutine(%v) got an instance \n", no)
 			lock.Lock()
 			instancePool = append(instancePool, wrappedInstance)
@@ -137,3 +143,131 @@ func TestGrowAndShrink(t *testing.T) {
 	assert.Equal(t, vmPool.currentSize, int32(25), "new vmPool should has 10 instances after shrink.")
 
 }
+
+func TestGetInstanceExhausted(t *testing.T) {
+	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+
+	config := DefaultPoolConfig()
+	config.MaxSize = 1
+	config.MinSize = 1
+	config.MaxWaiters = 1
+	vmPool, err := newVmPool(&contractId, wasmBytes, config, nil, nil, nil, logger)
+	if err != nil {
+		t.Fatalf("create vmPool error: %v", err)
+	}
+	defer vmPool.close()
+	vmPool.grow(config.MinSize)
+
+	busy, err := vmPool.GetInstance(context.Background())
+	assert.Nil(t, err)
+
+	// the pool can not grow, waiting times out
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	_, err = vmPool.GetInstance(ctx)
+	cancel()
+	assert.True(t, errors.Is(err, ErrPoolExhausted))
+
+	// the wait queue is full, the second waiter fails immediately
+	ctx, cancel = context.WithCancel(context.Background())
+	waiterDone := make(chan error)
+	go func() {
+		instance, err := vmPool.GetInstance(ctx)
+		if err == nil {
+			vmPool.RevertInstance(instance)
+		}
+		waiterDone <- err
+	}()
+	for atomic.LoadInt32(&vmPool.waiters) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = vmPool.GetInstance(context.Background())
+	assert.True(t, errors.Is(err, ErrPoolExhausted))
+
+	// the waiter gets the reverted instance
+	vmPool.RevertInstance(busy)
+	assert.Nil(t, <-waiterDone)
+	cancel()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&vmPool.waiters))
+}
+
+// callFrames simulate a tx whose call frames alternate over pools, e.g. A->A->A or A->B->A,
+// the top frame waits for the pool, the nested frames use GetCrossCallInstance
+func callFrames(pools []*vmPool, depth int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	held := make([]*wrappedInstance, 0, depth+1)
+	for d := 0; d <= depth; d++ {
+		pool := pools[d%len(pools)]
+		var instance *wrappedInstance
+		var err error
+		if d == 0 {
+			instance, err = pool.GetInstance(ctx)
+		} else {
+			instance, err = pool.GetCrossCallInstance()
+		}
+		if err != nil {
+			return err
+		}
+		held = append(held, instance)
+	}
+	for d := len(held) - 1; d >= 0; d-- {
+		pools[d%len(pools)].RevertInstance(held[d])
+	}
+	return nil
+}
+
+func TestCrossCallRecursion(t *testing.T) {
+	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+	contractB := contractId
+	contractB.Name = contractId.Name + "_b"
+
+	// pools smaller than the call depth
+	config := DefaultPoolConfig()
+	config.MaxSize = 2
+	config.MinSize = 1
+	config.ChangeSize = 1
+	poolA, err := newVmPool(&contractId, wasmBytes, config, nil, nil, nil, logger)
+	if err != nil {
+		t.Fatalf("create vmPool error: %v", err)
+	}
+	defer poolA.close()
+	poolA.grow(config.MinSize)
+	poolB, err := newVmPool(&contractB, wasmBytes, config, nil, nil, nil, logger)
+	if err != nil {
+		t.Fatalf("create vmPool error: %v", err)
+	}
+	defer poolB.close()
+	poolB.grow(config.MinSize)
+
+	for depth := 0; depth <= protocol.CallContractDepth; depth++ {
+		// recursion A->A->...->A
+		assert.Nil(t, callFrames([]*vmPool{poolA}, depth))
+		// re-entrance A->B->A->...
+		assert.Nil(t, callFrames([]*vmPool{poolA, poolB}, depth))
+	}
+	assert.True(t, atomic.LoadInt32(&poolA.ephemeralCount) > 0)
+	// ephemeral instances are adopted up to the max size, the rest are closed
+	assert.True(t, atomic.LoadInt32(&poolA.currentSize) <= config.MaxSize)
+	assert.True(t, atomic.LoadInt32(&poolB.currentSize) <= config.MaxSize)
+
+	// concurrent txs recursing to the max depth always make progress
+	var wg sync.WaitGroup
+	errC := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(no int) {
+			defer wg.Done()
+			pools := []*vmPool{poolA, poolB}
+			if no%2 == 0 {
+				pools = pools[:1]
+			}
+			errC <- callFrames(pools, protocol.CallContractDepth)
+		}(i)
+	}
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		assert.Nil(t, err)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"fmt"
+
+	wasmergo "chainmaker.org/chainmaker/vm-wasmer/v2/wasmer-go"
+)
+
+// instanceSnapshot the pristine state of an instance, taken after instantiation and WASI `_start` or `_initialize`,
+// and restored before every invocation, so that a tx never sees what the previous tx left in the instance.
+//
+// Only the linear memory and the exported mutable globals are reachable from the host, the module-internal
+// globals are not restored. They are the stack pointer of rust, c and TinyGo, and the SP and g registers of
+// the Go runtime, which are back to their initial value whenever an export returns normally, the rest of the
+// runtime state lives in the memory (see TestInstanceSnapshotGo). An instance that trapped or exited is never
+// reused, see wrappedInstance.discard.
+//
+// Linear memory can not shrink, and it is not restored to its grown size either: the Go and TinyGo runtimes
+// only grow the memory when their heap runs out, the next tx in a grown instance would skip the growth and be
+// charged less gas (see gasMeter.chargeMemory) than in a fresh instance. An instance whose memory grew is
+// discarded and replaced, so a tx costs the same on every node, at the price of replacing the instances of a
+// contract whose txs grow the memory. The memory is copied in full by every restore.
+type instanceSnapshot struct {
+	memory  []byte
+	pages   wasmergo.Pages
+	globals []globalSnapshot
+}
+
+type globalSnapshot struct {
+	name   string
+	global *wasmergo.Global
+	kind   wasmergo.ValueKind
+	value  interface{}
+}
+
+// takeSnapshot copy the memory and the exported mutable globals of the instance
+func takeSnapshot(instance *wasmergo.Instance) (*instanceSnapshot, error) {
+	snapshot := &instanceSnapshot{}
+
+	if memory, err := instance.Exports.GetMemory("memory"); err == nil && memory != nil {
+		data := memory.Data()
+		snapshot.memory = make([]byte, len(data))
+		copy(snapshot.memory, data)
+		snapshot.pages = memory.Size()
+	}
+
+	for name, global := range instance.Exports.GetGlobals() {
+		ty := global.Type()
+		mutability := ty.Mutability()
+		kind := ty.ValueType().Kind()
+		if mutability != wasmergo.MUTABLE {
+			continue
+		}
+		if kind != wasmergo.I32 && kind != wasmergo.I64 && kind != wasmergo.F32 && kind != wasmergo.F64 {
+			return nil, fmt.Errorf("snapshot global `%s` failed, unsupported value kind %s", name, kind)
+		}
+		value, err := global.Get()
+		if err != nil {
+			return nil, fmt.Errorf("snapshot global `%s` failed, %v", name, err)
+		}
+		snapshot.globals = append(snapshot.globals, globalSnapshot{
+			name:   name,
+			global: global,
+			kind:   kind,
+			value:  value,
+		})
+	}
+	return snapshot, nil
+}
+
+// restorable memory of the instance has not grown since the snapshot was taken
+func (s *instanceSnapshot) restorable(instance *wasmergo.Instance) bool {
+	if s.memory == nil {
+		return true
+	}
+	memory, err := instance.Exports.GetMemory("memory")
+	if err != nil || memory == nil {
+		return false
+	}
+	return memory.Size() == s.pages
+}
+
+// restore write the snapshot back into the instance
+func (s *instanceSnapshot) restore(instance *wasmergo.Instance) error {
+	if s.memory != nil {
+		if !s.restorable(instance) {
+			return fmt.Errorf("memory grew from %d pages, can not be restored", s.pages)
+		}
+		memory, _ := instance.Exports.GetMemory("memory")
+		copy(memory.Data(), s.memory)
+	}
+
+	for _, g := range s.globals {
+		if err := g.global.Set(g.value, g.kind); err != nil {
+			return fmt.Errorf("restore global `%s` failed, %v", g.name, err)
+		}
+	}
+	return nil
+}
+
+// size of the memory copy, in bytes
+func (s *instanceSnapshot) size() int64 {
+	return int64(len(s.memory))
+}
@@ -0,0 +1,95 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package wasmer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceSnapshotRestore(t *testing.T) {
+	wasmBytes, contractId, logger := prepareContract("./testdata/rust-counter-2.0.0.wasm", t)
+
+	vmPool, err := newVmPool(&contractId, wasmBytes, DefaultPoolConfig(), nil, nil, nil, logger)
+	if err != nil {
+		t.Fatalf("create vmPool error: %v", err)
+	}
+	defer vmPool.close()
+
+	instance, err := vmPool.NewInstance()
+	if err != nil {
+		t.Fatalf("vmPool.NewInstance() error: %v", err)
+	}
+	defer vmPool.CloseInstance(instance)
+	assert.NotNil(t, instance.snapshot)
+
+	memory, err := instance.wasmInstance.Exports.GetMemory("memory")
+	assert.Nil(t, err)
+	pristine := make([]byte, len(memory.Data()))
+	copy(pristine, memory.Data())
+
+	// a tx dirties the memory
+	data := memory.Data()
+	for i := 1024; i < 2048; i++ {
+		data[i] ^= 0xff
+	}
+	assert.False(t, bytes.Equal(pristine, memory.Data()))
+
+	assert.Nil(t, instance.restore())
+	assert.True(t, bytes.Equal(pristine, memory.Data()))
+	assert.False(t, vmPool.shouldDiscard(instance))
+
+	// grown memory can not be restored, the instance should be discarded
+	assert.True(t, memory.Grow(1))
+	assert.True(t, vmPool.shouldDiscard(instance))
+	assert.NotNil(t, instance.restore())
+	assert.True(t, instance.discard)
+}
+
+func TestInstanceSnapshotGo(t *testing.T) {
+	// the runtime state of Go lives in the memory and in internal globals, the counter and the heap of a tx
+	// must not leak into the next one, and the runtime must keep working after it is restored
+	wasmBytes, contractId, logger := prepareContract("./testdata/snapshot-go.wasm", t)
+	vmPool, err := newVmPool(&contractId, wasmBytes, DefaultPoolConfig(), nil, nil, nil, logger)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer vmPool.close()
+	assert.Equal(t, entrypointReactor, vmPool.entrypoint)
+
+	instance, err := vmPool.newInstanceFromModule()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer vmPool.CloseInstance(instance)
+	bump, err := instance.wasmInstance.Exports.GetFunction("bump")
+	assert.Nil(t, err)
+
+	// without restore the state is kept between calls
+	for i := int32(1); i <= 2; i++ {
+		count, err := bump()
+		assert.Nil(t, err)
+		assert.Equal(t, i, count)
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, instance.restore())
+		count, err := bump()
+		assert.Nil(t, err)
+		assert.Equal(t, int32(1), count)
+	}
+	assert.False(t, vmPool.shouldDiscard(instance))
+
+	// a tx which grows the heap leaves an instance which is not reused
+	grow, err := instance.wasmInstance.Exports.GetFunction("grow")
+	assert.Nil(t, err)
+	_, err = grow(2)
+	assert.Nil(t, err)
+	assert.True(t, vmPool.shouldDiscard(instance))
+}
@@ -2,6 +2,7 @@ package wasmer
 
 // #include <wasmer.h>
 // extern uint64_t metering_delegate(enum wasmer_parser_operator_t op);
+// extern uint64_t metering_slot_delegate(int slot, enum wasmer_parser_operator_t op);
 import "C"
 import "unsafe"
 
@@ -708,7 +709,14 @@ func metering_delegate(op C.wasmer_parser_operator_t) C.uint64_t {
 	return C.uint64_t(v)
 }
 
-// PushMeteringMiddleware allows the middleware metering to be engaged on a map of opcode to cost
+//export metering_slot_delegate
+func metering_slot_delegate(slot C.int, op C.wasmer_parser_operator_t) C.uint64_t {
+	return C.uint64_t(meteringSlotCost(int(slot), Opcode(op)))
+}
+
+// PushMeteringMiddleware allows the middleware metering to be engaged on a map of opcode to cost,
+// the map is shared by the whole process and only the first one is kept, use PushMeteringTable
+// for configs with different costs
 //
 //	  config := NewConfig()
 //		 opmap := map[uint32]uint32{
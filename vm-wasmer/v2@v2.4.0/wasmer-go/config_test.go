@@ -89,6 +89,41 @@ func TestConfigForMeteringFn(t *testing.T) {
 	// total instruction count should be 27
 }
 
+func TestConfigForMeteringTable(t *testing.T) {
+	// two cost tables in use at the same time
+	cheap := NewMeteringTable(map[Opcode]uint32{End: 1, LocalGet: 1, I32Add: 4})
+	defer cheap.Release()
+	costly := NewMeteringTable(map[Opcode]uint32{End: 2, LocalGet: 2, I32Add: 8})
+	defer costly.Release()
+
+	for _, c := range []struct {
+		table *MeteringTable
+		used  int
+	}{{cheap, 7}, {costly, 14}} {
+		config := NewConfig().PushMeteringTable(800000000, c.table)
+		store := NewStore(NewEngineWithConfig(config))
+		module, err := NewModule(store, testGetBytes("tests.wasm"), nil)
+		assert.NoError(t, err)
+
+		instance, err := NewInstance(module, NewImportObject())
+		assert.NoError(t, err)
+
+		sum, err := instance.Exports.GetFunction("sum")
+		assert.NoError(t, err)
+
+		result, err := sum(37, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, result, int32(42))
+		assert.Equal(t, 800000000-c.used, int(instance.GetGasRemaining()))
+	}
+
+	// a released slot is unbound from its costs
+	cheap.Release()
+	cheap.Release()
+	assert.Equal(t, uint64(0), meteringSlotCost(cheap.slot, I32Add))
+	assert.Equal(t, uint64(8), meteringSlotCost(costly.slot, I32Add))
+}
+
 func TestConfig_AllCombinations(t *testing.T) {
 	type Test struct {
 		compilerName string
@@ -136,6 +136,26 @@ func (self *Exports) GetGlobal(name string) (*Global, error) {
 	return exports.IntoGlobal(), nil
 }
 
+// GetGlobals returns all the exported Globals by their names.
+//
+// Note: Only exported globals are reachable from the host, a
+// module-internal global (e.g. the stack pointer of most toolchains)
+// is not part of the result.
+//
+//	instance, _ := NewInstance(module, NewImportObject())
+//	globals := instance.Exports.GetGlobals()
+func (self *Exports) GetGlobals() map[string]*Global {
+	globals := make(map[string]*Global)
+
+	for name, export := range self.exports {
+		if export.Kind() == GLOBAL {
+			globals[name] = export.IntoGlobal()
+		}
+	}
+
+	return globals
+}
+
 // GetTable retrieves and returns a exported Table by its name.
 //
 // Note: If the name does not refer to an existing export, GetTable
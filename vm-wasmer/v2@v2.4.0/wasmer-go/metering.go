@@ -0,0 +1,103 @@
+package wasmer
+
+// #include <stddef.h>
+// #include <wasmer.h>
+//
+// extern uint64_t metering_slot_delegate(int slot, enum wasmer_parser_operator_t op);
+//
+// #define METERING_SLOT(name, slot) \
+//   static uint64_t metering_slot_##name(enum wasmer_parser_operator_t op) { return metering_slot_delegate(slot, op); }
+// #define METERING_SLOT8(group, base) \
+//   METERING_SLOT(group##0, base + 0) METERING_SLOT(group##1, base + 1) \
+//   METERING_SLOT(group##2, base + 2) METERING_SLOT(group##3, base + 3) \
+//   METERING_SLOT(group##4, base + 4) METERING_SLOT(group##5, base + 5) \
+//   METERING_SLOT(group##6, base + 6) METERING_SLOT(group##7, base + 7)
+//
+// METERING_SLOT8(a, 0) METERING_SLOT8(b, 8) METERING_SLOT8(c, 16) METERING_SLOT8(d, 24)
+//
+// #define METERING_CASE(name, slot) case slot: return metering_slot_##name;
+// #define METERING_CASE8(group, base) \
+//   METERING_CASE(group##0, base + 0) METERING_CASE(group##1, base + 1) \
+//   METERING_CASE(group##2, base + 2) METERING_CASE(group##3, base + 3) \
+//   METERING_CASE(group##4, base + 4) METERING_CASE(group##5, base + 5) \
+//   METERING_CASE(group##6, base + 6) METERING_CASE(group##7, base + 7)
+//
+// static wasmer_metering_cost_function_t metering_slot_function(int slot) {
+//   switch (slot) {
+//     METERING_CASE8(a, 0) METERING_CASE8(b, 8) METERING_CASE8(c, 16) METERING_CASE8(d, 24)
+//   }
+//   return NULL;
+// }
+import "C"
+import "sync"
+
+// MeteringSlots the number of cost tables that can be in use at the same time.
+// The C cost function only receives the opcode, so every slot has its own C trampoline
+// passing the slot number to metering_slot_delegate, which looks up the table bound to the slot
+const MeteringSlots = 32
+
+var (
+	meteringLock   sync.RWMutex
+	meteringTables [MeteringSlots]map[Opcode]uint32
+	meteringFree   = make(chan int, MeteringSlots)
+)
+
+func init() {
+	for i := 0; i < MeteringSlots; i++ {
+		meteringFree <- i
+	}
+}
+
+// MeteringTable an opcode cost table bound to a metering slot.
+//
+// The cost function is only called while a module is being compiled, so a table is needed
+// from PushMeteringTable until the modules compiled with the config are built, then it should be
+// released to free the slot for other compilations. Tables of different slots never interfere,
+// several gas schedules can be used in one process.
+type MeteringTable struct {
+	slot int
+	once sync.Once
+}
+
+// NewMeteringTable bind the cost table to a free slot, it blocks until a slot is free
+//
+//	table := NewMeteringTable(map[Opcode]uint32{I32Add: 1})
+//	defer table.Release()
+//	config := NewConfig().PushMeteringTable(7865444, table)
+func NewMeteringTable(opMap map[Opcode]uint32) *MeteringTable {
+	slot := <-meteringFree
+
+	meteringLock.Lock()
+	meteringTables[slot] = opMap
+	meteringLock.Unlock()
+
+	return &MeteringTable{slot: slot}
+}
+
+// Release unbind the table from its slot, modules can not be compiled with the table any more
+func (self *MeteringTable) Release() {
+	self.once.Do(func() {
+		meteringLock.Lock()
+		meteringTables[self.slot] = nil
+		meteringLock.Unlock()
+
+		meteringFree <- self.slot
+	})
+}
+
+// meteringSlotCost the cost of the opcode in the table bound to the slot, no value means no cost
+func meteringSlotCost(slot int, op Opcode) uint64 {
+	meteringLock.RLock()
+	defer meteringLock.RUnlock()
+
+	return uint64(meteringTables[slot][op])
+}
+
+// PushMeteringTable allows the middleware metering to be engaged on a cost table,
+// unlike PushMeteringMiddleware, every config can use its own table
+func (self *Config) PushMeteringTable(maxGasUsageAllowed uint64, table *MeteringTable) *Config {
+	fn := C.metering_slot_function(C.int(table.slot))
+	C.wasm_config_push_middleware(self.inner(),
+		C.wasmer_metering_as_middleware(C.wasmer_metering_new(getPlatformLong(maxGasUsageAllowed), fn)))
+	return self
+}
@@ -0,0 +1,13 @@
+package wasmer
+
+// #include <wasmer.h>
+import "C"
+
+// Version returns the version of the linked Wasmer runtime, e.g.
+// "6.0.1". Compiled artifacts produced by Module.Serialize are only
+// guaranteed to be loadable by the same runtime version.
+//
+//	version := wasmer.Version()
+func Version() string {
+	return C.GoString(C.wasmer_version())
+}
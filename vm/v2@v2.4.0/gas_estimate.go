@@ -0,0 +1,111 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	commonPb "chainmaker.org/chainmaker/pb-go/v2/common"
+	"chainmaker.org/chainmaker/protocol/v2"
+	"github.com/gogo/protobuf/proto"
+)
+
+// EstimateGasLimit the gas limit of a dry run, effectively unlimited,
+// kept below 1<<63 so that SubtractGas never sees a negative remaining gas
+const EstimateGasLimit = uint64(math.MaxInt64)
+
+// GasEstimate the result of a dry run, see VmManagerImpl.EstimateGas
+type GasEstimate struct {
+	// gas used by the method, cross contract calls included
+	GasUsed uint64
+	// number of keys read and written by the tx
+	ReadSetSize  int
+	WriteSetSize int
+	// size of the serialized rw set
+	RWSetBytes int
+	Result     *commonPb.ContractResult
+	Code       commonPb.TxStatusCode
+}
+
+// NewEstimateTxSimContext build a throwaway tx sim context of the tx of txContext for a dry run,
+// it reads the same snapshot, its tx is a copy with the gas limit EstimateGasLimit.
+// The writes of a dry run are never applied to the snapshot, the runtimes don't touch their vm pools,
+// and the sql save point is always rolled back, see IsGasEstimate
+func NewEstimateTxSimContext(txContext protocol.TxSimContext) (protocol.TxSimContext, error) {
+	impl, ok := txContext.(*txSimContextImpl)
+	if !ok {
+		return nil, fmt.Errorf("gas estimate needs a tx sim context built by NewTxSimContext, got %T", txContext)
+	}
+	return newEstimateTxSimContext(impl.vmManager, impl.snapshot, impl.tx, impl.blockVersion, impl.logger)
+}
+
+// newEstimateTxSimContext build the throwaway tx sim context of a dry run of tx
+func newEstimateTxSimContext(vmManager protocol.VmManager, snapshot protocol.Snapshot, tx *commonPb.Transaction,
+	blockVersion uint32, logger protocol.Logger) (*txSimContextImpl, error) {
+	if tx == nil || tx.Payload == nil {
+		return nil, errors.New("gas estimate needs a tx with payload")
+	}
+	estimateTx, ok := proto.Clone(tx).(*commonPb.Transaction)
+	if !ok {
+		return nil, errors.New("gas estimate failed to copy the tx")
+	}
+	estimateTx.Payload.Limit = &commonPb.Limit{GasLimit: EstimateGasLimit}
+
+	s, _ := NewTxSimContext(vmManager, snapshot, estimateTx, blockVersion, logger).(*txSimContextImpl)
+	s.estimate = true
+	return s, nil
+}
+
+// IsGasEstimate whether the tx sim context is a dry run built by NewEstimateTxSimContext
+func IsGasEstimate(txContext protocol.TxSimContext) bool {
+	impl, ok := txContext.(*txSimContextImpl)
+	return ok && impl.estimate
+}
+
+// NewGasEstimate collect the estimate of a dry run from its tx sim context and the contract result
+func NewGasEstimate(txContext protocol.TxSimContext, result *commonPb.ContractResult,
+	code commonPb.TxStatusCode) *GasEstimate {
+	rwSet := txContext.GetTxRWSet(code == commonPb.TxStatusCode_SUCCESS)
+	return &GasEstimate{
+		GasUsed:      result.GasUsed,
+		ReadSetSize:  len(rwSet.TxReads),
+		WriteSetSize: len(rwSet.TxWrites),
+		RWSetBytes:   proto.Size(rwSet),
+		Result:       result,
+		Code:         code,
+	}
+}
+
+// EstimateGas dry run the tx against the snapshot with an effectively unlimited gas limit,
+// return the gas used, the rw set size and the result. Nothing is written to the snapshot.
+func (m *VmManagerImpl) EstimateGas(snapshot protocol.Snapshot, tx *commonPb.Transaction,
+	blockVersion uint32) (*GasEstimate, error) {
+	txContext, err := newEstimateTxSimContext(m, snapshot, tx, blockVersion, m.Log)
+	if err != nil {
+		return nil, err
+	}
+	payload := txContext.tx.Payload
+	contract, err := txContext.GetContractByName(payload.ContractName)
+	if err != nil {
+		return nil, fmt.Errorf("gas estimate of tx[%s] failed, %v", payload.TxId, err)
+	}
+	var byteCode []byte
+	if contract.RuntimeType != commonPb.RuntimeType_NATIVE {
+		if byteCode, err = txContext.GetContractBytecode(contract.Name); err != nil {
+			return nil, fmt.Errorf("gas estimate of tx[%s] failed, %v", payload.TxId, err)
+		}
+	}
+	parameters := make(map[string][]byte, len(payload.Parameters))
+	for _, kv := range payload.Parameters {
+		parameters[kv.Key] = kv.Value
+	}
+
+	result, _, code := m.RunContract(contract, payload.Method, byteCode, parameters, txContext, 0, payload.TxType)
+	return NewGasEstimate(txContext, result, code), nil
+}
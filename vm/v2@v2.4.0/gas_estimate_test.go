@@ -0,0 +1,59 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package vm
+
+import (
+	"testing"
+
+	"chainmaker.org/chainmaker/pb-go/v2/common"
+	"chainmaker.org/chainmaker/protocol/v2/mock"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEstimateTxSimContext(t *testing.T) {
+	c := gomock.NewController(t)
+	defer c.Finish()
+
+	snapshot := mock.NewMockSnapshot(c)
+	snapshot.EXPECT().GetSnapshotSize().Return(0).AnyTimes()
+
+	tx := &common.Transaction{
+		Payload: &common.Payload{
+			TxId:  "111",
+			Limit: &common.Limit{GasLimit: 100},
+		},
+	}
+	txContext := NewTxSimContext(nil, snapshot, tx, v235, log)
+	assert.False(t, IsGasEstimate(txContext))
+
+	estimateContext, err := NewEstimateTxSimContext(txContext)
+	assert.Nil(t, err)
+	assert.True(t, IsGasEstimate(estimateContext))
+	assert.Equal(t, EstimateGasLimit, estimateContext.GetGasRemaining())
+	assert.Equal(t, uint32(v235), estimateContext.GetBlockVersion())
+	assert.Equal(t, "111", estimateContext.GetTx().Payload.TxId)
+	// the tx of the real context keeps its limit
+	assert.Equal(t, uint64(100), tx.Payload.Limit.GasLimit)
+	assert.Nil(t, estimateContext.SubtractGas(1<<62))
+
+	// the writes of the dry run stay in the throwaway context
+	assert.Nil(t, estimateContext.Put("contract1", []byte("key1"), []byte("value1")))
+	result := &common.ContractResult{GasUsed: 10}
+	estimate := NewGasEstimate(estimateContext, result, common.TxStatusCode_SUCCESS)
+	assert.Equal(t, uint64(10), estimate.GasUsed)
+	assert.Equal(t, 1, estimate.WriteSetSize)
+	assert.True(t, estimate.RWSetBytes > 0)
+	assert.Equal(t, 0, len(txContext.GetTxRWSet(true).TxWrites))
+
+	// a failed dry run reports no writes
+	estimate = NewGasEstimate(estimateContext, result, common.TxStatusCode_CONTRACT_FAIL)
+	assert.Equal(t, 0, estimate.WriteSetSize)
+
+	_, err = NewEstimateTxSimContext(mock.NewMockTxSimContext(c))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package vm
+
+import "chainmaker.org/chainmaker/protocol/v2"
+
+// AddGasRefund refund the gas to the contract call frame running in the tx, e.g. for the state it deleted.
+// Like its write set, the refunds of a nested call are kept by its caller if the call succeeds and dropped
+// otherwise, see txSimContextImpl.CallContract. Nothing is refunded to the tx until TakeGasRefund.
+func AddGasRefund(txSimContext protocol.TxSimContext, gas uint64) {
+	s, ok := txSimContext.(*txSimContextImpl)
+	if !ok {
+		return
+	}
+	if s.gasRefundWithDepth == nil {
+		s.gasRefundWithDepth = make([]uint64, protocol.CallContractDepth+1)
+	}
+	s.gasRefundWithDepth[s.currentDepth] = addGasRefund(s.gasRefundWithDepth[s.currentDepth], gas)
+}
+
+// TakeGasRefund return and reset the gas refunded to the contract call frame running in the tx,
+// the refunds kept from its nested calls included
+func TakeGasRefund(txSimContext protocol.TxSimContext) uint64 {
+	s, ok := txSimContext.(*txSimContextImpl)
+	if !ok || s.gasRefundWithDepth == nil {
+		return 0
+	}
+	gas := s.gasRefundWithDepth[s.currentDepth]
+	s.gasRefundWithDepth[s.currentDepth] = 0
+	return gas
+}
+
+// RefundGas give the gas back to the tx, the reverse of TxSimContext.SubtractGas
+func RefundGas(txSimContext protocol.TxSimContext, gas uint64) {
+	s, ok := txSimContext.(*txSimContextImpl)
+	if !ok {
+		return
+	}
+	s.gasRemaining = addGasRefund(s.gasRemaining, gas)
+}
+
+// commitGasRefundToPreDepth the cross contract call ends, its refunds are kept by the caller if it succeeded
+func (s *txSimContextImpl) commitGasRefundToPreDepth(kept bool) {
+	if s.gasRefundWithDepth == nil || s.currentDepth == 0 {
+		return
+	}
+	if kept {
+		pre := s.currentDepth - 1
+		s.gasRefundWithDepth[pre] = addGasRefund(s.gasRefundWithDepth[pre], s.gasRefundWithDepth[s.currentDepth])
+	}
+	s.gasRefundWithDepth[s.currentDepth] = 0
+}
+
+// addGasRefund a + b without overflow
+func addGasRefund(a, b uint64) uint64 {
+	if a+b < a {
+		return ^uint64(0)
+	}
+	return a + b
+}
@@ -0,0 +1,51 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package vm
+
+import (
+	"testing"
+
+	"chainmaker.org/chainmaker/protocol/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGasRefund(t *testing.T) {
+	s := &txSimContextImpl{gasRemaining: 100}
+	assert.Equal(t, uint64(0), TakeGasRefund(s))
+	AddGasRefund(s, 10)
+
+	// the refunds of a succeeded nested call are kept by its caller
+	s.currentDepth = 1
+	AddGasRefund(s, 5)
+	s.commitGasRefundToPreDepth(true)
+	// the refunds of a failed one are dropped
+	s.currentDepth = 2
+	AddGasRefund(s, 1000)
+	s.commitGasRefundToPreDepth(false)
+	s.currentDepth = 1
+	assert.Equal(t, uint64(0), TakeGasRefund(s))
+
+	s.currentDepth = 0
+	assert.Equal(t, uint64(15), TakeGasRefund(s))
+	assert.Equal(t, uint64(0), TakeGasRefund(s))
+
+	// no overflow
+	AddGasRefund(s, ^uint64(0))
+	AddGasRefund(s, 1)
+	assert.Equal(t, ^uint64(0), TakeGasRefund(s))
+
+	RefundGas(s, 15)
+	assert.Equal(t, uint64(115), s.GetGasRemaining())
+	assert.Nil(t, s.SubtractGas(115))
+	assert.Equal(t, uint64(0), s.GetGasRemaining())
+
+	// other tx sim contexts refund nothing
+	var other protocol.TxSimContext
+	AddGasRefund(other, 1)
+	assert.Equal(t, uint64(0), TakeGasRefund(other))
+	RefundGas(other, 1)
+}
@@ -126,6 +126,8 @@ func PutTxSimContext(tsc protocol.TxSimContext) {
 	tscImpl.vmManager = nil
 	tscImpl.gasUsed = 0
 	tscImpl.gasRemaining = 0
+	tscImpl.gasRefundWithDepth = nil
+	tscImpl.estimate = false
 	tscImpl.currentDepth = 0
 	tscImpl.hisResult = tscImpl.hisResult[:0]
 	tscImpl.blockVersion = 0
@@ -161,8 +163,10 @@ type txSimContextImpl struct {
 	keyIndex                         int
 	usedSimContextIterator           []*SimContextIterator
 	usedSimContextKeyHistoryIterator []*SimContextKeyHistoryIterator
-	dbSpendTime                      int64  //合约执行过程中，访问DB花费的时间（毫秒）
-	gasRemaining                     uint64 // 统一计费使用的字段
+	dbSpendTime                      int64    //合约执行过程中，访问DB花费的时间（毫秒）
+	gasRemaining                     uint64   // 统一计费使用的字段
+	gasRefundWithDepth               []uint64 // gas refunded to the frames of the tx, see AddGasRefund
+	estimate                         bool     // dry run of EstimateGas, see IsGasEstimate
 }
 
 // call contract result
@@ -878,6 +882,47 @@ func (s *txSimContextImpl) GetTxRWMapByContractName(contractName string) (
 	return txReads, txWrites
 }
 
+// LookupTxRWSet the value of the key as the tx sees it from its write and read sets, the snapshot is not
+// read and nothing is recorded, found is false if the tx has neither written nor read the key.
+// The value of a deleted key is nil
+func LookupTxRWSet(txSimContext protocol.TxSimContext, contractName string, key []byte) ([]byte, bool) {
+	s, ok := txSimContext.(*txSimContextImpl)
+	if !ok {
+		return nil, false
+	}
+	k := constructKey(contractName, key)
+	for depth := s.currentDepth; depth >= 0; depth-- {
+		if rwSet, ok := s.txRWSetWithDepth[depth][contractName]; ok {
+			if txWrite, ok := rwSet.txWriteKeyMap[k]; ok {
+				return txWrite.Value, true
+			}
+		}
+	}
+	for depth := s.currentDepth; depth >= 0; depth-- {
+		if rwSet, ok := s.txRWSetWithDepth[depth][contractName]; ok {
+			if txRead, ok := rwSet.txReadKeyMap[k]; ok {
+				return txRead.Value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// LookupState the value of the key as the tx sees it without recording a read: the write and read sets
+// of the tx first, see LookupTxRWSet, then the snapshot at the exec seq of the tx.
+// Used to price a blind write of the key, the earlier txs of the block writing the key conflict with the tx,
+// they are ordered before it in the DAG and every node finds the same value
+func LookupState(txSimContext protocol.TxSimContext, contractName string, key []byte) ([]byte, error) {
+	if value, found := LookupTxRWSet(txSimContext, contractName, key); found {
+		return value, nil
+	}
+	snapshot := txSimContext.GetSnapshot()
+	if snapshot == nil {
+		return nil, nil
+	}
+	return snapshot.GetKey(txSimContext.GetTxExecSeq(), contractName, key)
+}
+
 // releaseAllUsedIters At the end of the simulation, close all open iterators
 func (s *txSimContextImpl) releaseAllUsedIters() {
 	//release all used simContext iter
@@ -1012,6 +1057,7 @@ func (s *txSimContextImpl) CallContract(caller, contract *common.Contract, metho
 	}
 	s.hisResult = append(s.hisResult, &result)
 	s.currentResult = r.Result
+	s.commitGasRefundToPreDepth(r.Code == 0)
 
 	if r.Code != 0 {
 		if s.blockVersion < 2300 {
@@ -1334,3 +1334,57 @@ func Test_txSimContextImpl_SubtractGas(t *testing.T) {
 	assert.EqualError(t, err, fmt.Sprintf("tx[%s] gas is not enough", txSimContext1.tx.Payload.TxId))
 
 }
+
+func TestLookupTxRWSet(t *testing.T) {
+	s := &txSimContextImpl{
+		txRWSetWithDepth: make([]map[string]*rwSet, protocol.CallContractDepth+1),
+		logger:           log,
+	}
+	_, found := LookupTxRWSet(s, "contract1", []byte("key1"))
+	assert.False(t, found)
+
+	s.PutIntoReadSet("contract1", []byte("key1"), []byte("read"))
+	value, found := LookupTxRWSet(s, "contract1", []byte("key1"))
+	assert.True(t, found)
+	assert.Equal(t, []byte("read"), value)
+
+	// the writes of the deeper frames come first
+	assert.Nil(t, s.Put("contract1", []byte("key1"), []byte("write0")))
+	s.currentDepth = 1
+	assert.Nil(t, s.Del("contract1", []byte("key1")))
+	value, found = LookupTxRWSet(s, "contract1", []byte("key1"))
+	assert.True(t, found)
+	assert.Nil(t, value)
+	s.currentDepth = 0
+	value, _ = LookupTxRWSet(s, "contract1", []byte("key1"))
+	assert.Equal(t, []byte("write0"), value)
+
+	_, found = LookupTxRWSet(s, "contract2", []byte("key1"))
+	assert.False(t, found)
+}
+
+func TestLookupState(t *testing.T) {
+	c := gomock.NewController(t)
+	defer c.Finish()
+	snapshot := mock.NewMockSnapshot(c)
+	snapshot.EXPECT().GetKey(3, "contract1", []byte("key1")).Return([]byte("committed"), nil).AnyTimes()
+	s := &txSimContextImpl{
+		txRWSetWithDepth: make([]map[string]*rwSet, protocol.CallContractDepth+1),
+		snapshot:         snapshot,
+		txExecSeq:        3,
+		logger:           log,
+	}
+
+	// the snapshot is read and no read is recorded
+	value, err := LookupState(s, "contract1", []byte("key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("committed"), value)
+	_, found := LookupTxRWSet(s, "contract1", []byte("key1"))
+	assert.False(t, found)
+
+	// the key deleted by the tx holds nothing
+	assert.Nil(t, s.Del("contract1", []byte("key1")))
+	value, err = LookupState(s, "contract1", []byte("key1"))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+}
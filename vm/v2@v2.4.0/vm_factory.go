@@ -437,7 +437,8 @@ func (m *VmManagerImpl) invokeUserContractByRuntime(contract *commonPb.Contract,
 	executionTime := float64(endTime-startTime) / 1e9
 	m.Log.Infof("invoke vm, tx id:%s, contractName:%+v, contractMethod:%+v, runtime type:%+v, runtimeContractResult:%d ,startTime:%d, endTime:%d, executionTime:%.6f s",
 		txId, contractName, method, runtimeType, runtimeContractResult.Code, startTime, endTime, executionTime)
-	if runtimeContractResult.Code == 0 {
+	// a dry run leaves no sql writes behind, it is rolled back even if it succeeds
+	if runtimeContractResult.Code == 0 && !IsGasEstimate(txContext) {
 		return runtimeContractResult, specialTxType, commonPb.TxStatusCode_SUCCESS
 	}
 	if m.ChainConf.ChainConfig().Contract.EnableSqlSupport && txType != commonPb.TxType_QUERY_CONTRACT {
@@ -446,6 +447,12 @@ func (m *VmManagerImpl) invokeUserContractByRuntime(contract *commonPb.Contract,
 			m.Log.Warn("[%s] rollback db save point error, %s", txId, err.Error())
 		}
 	}
+	if runtimeContractResult.Code == 0 {
+		return runtimeContractResult, specialTxType, commonPb.TxStatusCode_SUCCESS
+	}
+	if reporter, ok := runtimeInstance.(TxStatusCodeReporter); ok {
+		return runtimeContractResult, specialTxType, reporter.TxStatusCode()
+	}
 	return runtimeContractResult, specialTxType, commonPb.TxStatusCode_CONTRACT_FAIL
 }
 
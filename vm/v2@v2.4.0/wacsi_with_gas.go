@@ -1,14 +1,18 @@
 package vm
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 
 	configPb "chainmaker.org/chainmaker/pb-go/v2/config"
+	vmPb "chainmaker.org/chainmaker/pb-go/v2/vm"
+	"github.com/gogo/protobuf/proto"
 
 	"chainmaker.org/chainmaker/common/v2/bytehelper"
 	"chainmaker.org/chainmaker/common/v2/crypto/paillier"
@@ -114,7 +118,7 @@ func (w *WacsiWithGasImpl) GetState(
 		msg := fmt.Errorf("[get state] fail. key=%s, field=%s, error:%s", key, field, err.Error())
 		return nil, msg
 	}
-	if err1 := gaswasm.SubtractGasForGetState(contractName, stateKey, value, txSimContext); err != nil {
+	if err1 := gaswasm.SubtractGasForGetState(contractName, stateKey, value, txSimContext); err1 != nil {
 		return nil, err1
 	}
 	w.logger.Debugf("wacsiImpl::GetState() ==> value = %s \n", value)
@@ -125,6 +129,114 @@ func (w *WacsiWithGasImpl) GetState(
 	return value, nil
 }
 
+// GetBatchState is used to get states from simContext cache, every key is charged like GetState
+func (w *WacsiWithGasImpl) GetBatchState(
+	requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte,
+	data []byte, isLen bool) ([]byte, error) {
+
+	ec := serialize.NewEasyCodecWithBytes(requestBody)
+	temp, _ := ec.GetBytes("BatchKeys")
+	keys := &vmPb.BatchKeys{}
+	if err := keys.Unmarshal(temp); err != nil {
+		return nil, err
+	}
+	valuePtr, _ := ec.GetInt32("value_ptr")
+	for _, key := range keys.Keys {
+		if err := protocol.CheckKeyFieldStr(key.Key, key.Field); err != nil {
+			return nil, err
+		}
+	}
+
+	if !isLen {
+		copy(memory[valuePtr:valuePtr+int32(len(data))], data)
+		return nil, nil
+	}
+	getKeys, err := txSimContext.GetKeys(keys.Keys)
+	if err != nil {
+		msg := fmt.Errorf("[get batch]error:%s", err.Error())
+		return nil, msg
+	}
+	for _, key := range getKeys {
+		stateKey := protocol.GetKeyStr(key.Key, key.Field)
+		if err1 := gaswasm.SubtractGasForGetState(contractName, stateKey, key.Value, txSimContext); err1 != nil {
+			return nil, err1
+		}
+	}
+	w.logger.Debugf("wacsiImpl::GetBatchState() ==> value = %v ", getKeys)
+	resp := vmPb.BatchKeys{Keys: getKeys}
+	value, err := resp.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	copy(memory[valuePtr:valuePtr+4], bytehelper.IntToBytes(int32(len(value))))
+	if len(value) == 0 {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// GetSenderAddress is used to get the address of the sender, the chain config read is charged like GetState
+func (w *WacsiWithGasImpl) GetSenderAddress(
+	requestBody []byte, contractName string, txSimContext protocol.TxSimContext, memory []byte,
+	data []byte, isLen bool) ([]byte, error) {
+
+	ec := serialize.NewEasyCodecWithBytes(requestBody)
+	valuePtr, _ := ec.GetInt32("value_ptr")
+	if !isLen {
+		copy(memory[valuePtr:valuePtr+int32(len(data))], data)
+		return nil, nil
+	}
+	bytes, err := txSimContext.Get(chainConfigContractName, []byte(keyChainConfig))
+	if err != nil {
+		w.logger.Errorf("txSimContext get failed, name[%s] key[%s] err: %s",
+			chainConfigContractName, keyChainConfig, err.Error())
+		return nil, err
+	}
+	if err = gaswasm.SubtractGasForGetState(chainConfigContractName, []byte(keyChainConfig), bytes,
+		txSimContext); err != nil {
+		return nil, err
+	}
+	var chainConfig configPb.ChainConfig
+	if err = proto.Unmarshal(bytes, &chainConfig); err != nil {
+		w.logger.Errorf("unmarshal chainConfig failed, contractName %s err: %+v", chainConfigContractName, err)
+		return nil, err
+	}
+	// the address is resolved the same way as WacsiImpl
+	address, err := (&WacsiImpl{logger: w.logger}).getSenderAddrWithBlockVersion(txSimContext.GetBlockVersion(),
+		chainConfig, txSimContext)
+	if err != nil {
+		w.logger.Error(err.Error())
+		return nil, err
+	}
+	value := []byte(address)
+	copy(memory[valuePtr:valuePtr+4], bytehelper.IntToBytes(int32(len(value))))
+	if len(value) == 0 {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// Sha256 is used to hash the input in the host, charged baseGas and wordGas for every 32 bytes word of the input
+// like the keccak256 of evm. gaswasm has no price of hashing, the prices are set by the runtime
+func (w *WacsiWithGasImpl) Sha256(requestBody []byte, contractName string, txSimContext protocol.TxSimContext,
+	memory []byte, baseGas, wordGas uint64) ([]byte, error) {
+
+	ec := serialize.NewEasyCodecWithBytes(requestBody)
+	hashInput, _ := ec.GetBytes("hashInput")
+	valuePtr, _ := ec.GetInt32("value_ptr")
+
+	words := (uint64(len(hashInput)) + 31) / 32
+	if wordGas > 0 && words > (^uint64(0)-baseGas)/wordGas {
+		return nil, fmt.Errorf("tx[%s] gas is not enough", txSimContext.GetTx().Payload.TxId)
+	}
+	if err := txSimContext.SubtractGas(baseGas + words*wordGas); err != nil {
+		return nil, err
+	}
+	value := sha256.Sum256(hashInput)
+	copy(memory[valuePtr:valuePtr+32], value[:])
+	return value[:], nil
+}
+
 // DeleteState is used to delete state from simContext cache
 func (w *WacsiWithGasImpl) DeleteState(
 	requestBody []byte, contractName string, txSimContext protocol.TxSimContext) error {
@@ -578,6 +690,143 @@ func (w *WacsiWithGasImpl) KvIteratorClose(requestBody []byte, contractName stri
 	return nil
 }
 
+// HistoryKvIterator construct a history kv iterator, charged like KvIterator
+func (w *WacsiWithGasImpl) HistoryKvIterator(requestBody []byte, contractName string,
+	txSimContext protocol.TxSimContext, memory []byte) error {
+
+	ec := serialize.NewEasyCodecWithBytes(requestBody)
+	startKey, _ := ec.GetString("start_key")
+	startField, _ := ec.GetString("start_field")
+	valuePtr, _ := ec.GetInt32("value_ptr")
+	if err := protocol.CheckKeyFieldStr(startKey, startField); err != nil {
+		return err
+	}
+
+	key := protocol.GetKeyStr(startKey, startField)
+	if err := gaswasm.SubtractGasForKvIterator(key, nil, txSimContext); err != nil {
+		return err
+	}
+
+	iter, err := txSimContext.GetHistoryIterForKey(contractName, key)
+	if err != nil {
+		return fmt.Errorf("[History kv iterator] select error, %s", err.Error())
+	}
+	// the handles share rowIndex with the kv iterators, they live in the same TxSimContext
+	index := atomic.AddInt32(&w.rowIndex, 1)
+	txSimContext.SetIterHandle(index, iter)
+	copy(memory[valuePtr:valuePtr+4], bytehelper.IntToBytes(index))
+	return nil
+}
+
+// HistoryKvIterHasNext is used to determine whether there is another element, charged like KvIteratorHasNext
+func (w *WacsiWithGasImpl) HistoryKvIterHasNext(
+	requestBody []byte, txSimContext protocol.TxSimContext, memory []byte) error {
+
+	ec := serialize.NewEasyCodecWithBytes(requestBody)
+	kvIndex, _ := ec.GetInt32("ks_index")
+	valuePtr, _ := ec.GetInt32("value_ptr")
+
+	// get
+	iter, ok := txSimContext.GetIterHandle(kvIndex)
+	if !ok {
+		return fmt.Errorf("[History kv iterator has next] can not found rs_index[%d]", kvIndex)
+	}
+
+	keyHistoryIterator, ok := iter.(protocol.KeyHistoryIterator)
+	if !ok {
+		return fmt.Errorf("[History kv iterator has next] failed, iterator %d assertion failed", kvIndex)
+	}
+
+	index := boolFalse
+	if keyHistoryIterator.Next() {
+		index = boolTrue
+	}
+	if err := gaswasm.SubtractGasForKvIteratorHasNext(kvIndex, txSimContext); err != nil {
+		return err
+	}
+
+	copy(memory[valuePtr:valuePtr+4], bytehelper.IntToBytes(int32(index)))
+	return nil
+}
+
+// HistoryKvIterNext get next element, the record read is charged like KvIteratorNext
+func (w *WacsiWithGasImpl) HistoryKvIterNext(
+	requestBody []byte, txSimContext protocol.TxSimContext, memory []byte, data []byte,
+	contractname string, isLen bool) ([]byte, error) {
+
+	ec := serialize.NewEasyCodecWithBytes(requestBody)
+	kvIndex, _ := ec.GetInt32("ks_index")
+	ptr, _ := ec.GetInt32("value_ptr")
+
+	// get handle
+	iter, ok := txSimContext.GetIterHandle(kvIndex)
+	if !ok {
+		return nil, fmt.Errorf("[History kv iterator next] can not found rs_index[%d]", kvIndex)
+	}
+	// get data
+	if !isLen {
+		copy(memory[ptr:ptr+int32(len(data))], data)
+		return nil, nil
+	}
+
+	keyHistoryIterator, ok := iter.(protocol.KeyHistoryIterator)
+	if !ok {
+		return nil, fmt.Errorf("[History kv iterator next] failed, iterator %d assertion failed", kvIndex)
+	}
+	// get len
+	ec = serialize.NewEasyCodec()
+	if keyHistoryIterator != nil {
+		historyValue, err := keyHistoryIterator.Value()
+		if err != nil {
+			return nil, fmt.Errorf("[History kv iterator next] iterator next data error, %s", err.Error())
+		}
+
+		isDelete := 1
+		if !historyValue.IsDelete {
+			isDelete = 0
+		}
+		ec.AddBytes("value", historyValue.Value)
+		ec.AddString("txId", txSimContext.GetTx().Payload.TxId)
+		ec.AddInt32("blockHeight", int32(historyValue.BlockHeight))
+		ec.AddString("timestamp", strconv.FormatInt(historyValue.Timestamp, 10))
+		ec.AddInt32("isDelete", int32(isDelete))
+	}
+	kvBytes := ec.Marshal()
+	if err := gaswasm.SubtractGasForKvIteratorNext("", "", kvBytes, txSimContext); err != nil {
+		return nil, err
+	}
+
+	copy(memory[ptr:ptr+4], bytehelper.IntToBytes(int32(len(kvBytes))))
+	return kvBytes, nil
+}
+
+// HistoryKvIterClose close iterator, charged like KvIteratorClose
+func (w *WacsiWithGasImpl) HistoryKvIterClose(requestBody []byte, contractName string,
+	txSimContext protocol.TxSimContext, memory []byte) error {
+
+	ec := serialize.NewEasyCodecWithBytes(requestBody)
+	kvIndex, _ := ec.GetInt32("ks_index")
+	valuePtr, _ := ec.GetInt32("value_ptr")
+	// get
+	iter, ok := txSimContext.GetIterHandle(kvIndex)
+	if !ok {
+		return fmt.Errorf("[History kv iterator close] ctx can not found rs_index[%d]", kvIndex)
+	}
+
+	keyHistoryIterator, ok := iter.(protocol.KeyHistoryIterator)
+	if !ok {
+		return fmt.Errorf("[History kv iterator close] failed, iterator %d assertion failed", kvIndex)
+	}
+
+	keyHistoryIterator.Release()
+	if err := gaswasm.SubtractGasForKvIteratorClose(kvIndex, txSimContext); err != nil {
+		return err
+	}
+
+	copy(memory[valuePtr:valuePtr+4], bytehelper.IntToBytes(1))
+	return nil
+}
+
 // BulletProofsOperation is used to handle bulletproofs operations
 func (w *WacsiWithGasImpl) BulletProofsOperation(requestBody []byte,
 	txSimContext protocol.TxSimContext, memory []byte, data []byte, isLen bool) ([]byte, error) {
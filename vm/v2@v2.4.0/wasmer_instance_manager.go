@@ -18,3 +18,15 @@ type WasmerInstancesManager interface {
 	// StopVM Stop vm
 	StopVM() error
 }
+
+// TxStatusCodeGasLimitExceeded the tx used up the gas limit it declared. It is not GAS_BALANCE_NOT_ENOUGH_FAILED,
+// which means the payer can not afford the limit. pb-go declares no code for it yet, the value is kept out of
+// the range of the codes it declares
+const TxStatusCodeGasLimitExceeded common.TxStatusCode = 1000
+
+// TxStatusCodeReporter implemented by runtime instances that can tell why an invoke failed,
+// e.g. the wasmer vm pool timed out, so that the tx is not reported as CONTRACT_FAIL
+type TxStatusCodeReporter interface {
+	// TxStatusCode return the tx status code of the last failed invoke
+	TxStatusCode() common.TxStatusCode
+}